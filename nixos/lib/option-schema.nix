@@ -0,0 +1,73 @@
+# Describe the type of a NixOS option as a JSON schema, so that values can be
+# checked before they reach the module system. Only the structure of common
+# types is described; any other type accepts any value.
+
+{ lib }:
+let
+  # Submodules may refer to themselves
+  maxDepth = 8;
+
+  # Nested types, before and after nixpkgs added nestedTypes
+  elemType = t: t.nestedTypes.elemType or t.functor.wrapped;
+  eitherTypes = t:
+    if t ? nestedTypes.left
+    then [ t.nestedTypes.left t.nestedTypes.right ]
+    else t.functor.wrapped;
+  enumValues = t:
+    let p = t.functor.payload; in
+    if builtins.isList p then p else p.values;
+
+  matches = re: s: builtins.match re s != null;
+
+  # Options of a submodule, which may be nested in attribute sets
+  optionsSchema = depth: opts:
+    let
+      names = builtins.filter (n: n != "_module") (builtins.attrNames opts);
+      freeform = (opts._module.freeformType.value or null) != null;
+    in {
+      type = "object";
+      properties = lib.genAttrs names (n:
+        let o = opts.${n}; in
+        if lib.isOption o
+        then schema (depth + 1) o.type
+        else optionsSchema (depth + 1) o);
+      additionalProperties = freeform;
+    };
+
+  schema = depth: t:
+    let
+      name = t.name;
+      described = s: s // { description = t.description; };
+    in
+      if depth > maxDepth then { }
+      else if name == "bool" then described { type = "boolean"; }
+      else if matches ".*[Ii]nt(Between|[0-9]+)?" name
+      then described { type = "integer"; }
+      else if name == "float" || matches "number.*" name
+      then described { type = "number"; }
+      else if name == "path"
+        || matches "str.*|singleLineStr|nonEmptyStr|separatedString" name
+      then described { type = "string"; }
+      else if name == "enum"
+      then described { enum = enumValues t; }
+      else if name == "nullOr"
+      then described {
+        anyOf = [ { type = "null"; } (schema (depth + 1) (elemType t)) ];
+      }
+      else if name == "listOf" || name == "nonEmptyListOf"
+      then described {
+        type = "array";
+        items = schema (depth + 1) (elemType t);
+      }
+      else if name == "attrsOf" || name == "lazyAttrsOf"
+      then described {
+        type = "object";
+        additionalProperties = schema (depth + 1) (elemType t);
+      }
+      else if name == "either"
+      then described { anyOf = map (schema (depth + 1)) (eitherTypes t); }
+      else if name == "submodule"
+      then described (optionsSchema depth (t.getSubOptions [ ]))
+      else { };
+in
+  schema 0
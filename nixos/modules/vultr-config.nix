@@ -1,7 +1,8 @@
 { config, pkgs, lib, modulesPath, ... }:
 {
-  # Set system
-  nixpkgs.localSystem.system = "x86_64-linux";
+  # Vultr only has x86_64 machines. Overrides the default system of the machine
+  # running Nix, but not the system attribute of packernix_os.
+  nixpkgs.localSystem = lib.mkOverride 900 { system = "x86_64-linux"; };
 
   # From hardware-configuration.nix output of nixos-generate-config
   imports =
@@ -6,20 +6,30 @@
 , modulesPath ? "{{.Nixpkgs}}/nixos/modules"
 , baseModules ? (import ({{.Nixpkgs}} + /nixos/modules/module-list.nix))
 , tfpnModulesPath ? "{{.TfpnModPath}}"
+, tfpnLibPath ? "{{.TfpnLibPath}}"
 }:
 let
   inherit (nixpkgs) lib;
+  # Option passed from terraform-provider-packernix. Left untyped and
+  # undocumented, so that configurations can declare it with a type.
   tfpnmod = { config, lib, ... }: {
-    options.tfpn = lib.mkOption {
-      description = "Option passed from terraform-provider-packernix";
-    };
+    options.tfpn = lib.mkOption { };
     config.tfpn = builtins.fromJSON (builtins.readFile ./tfpn-config.json);
   };
+  # Extra modules, overlays and arguments from tfpn-modules.json
+  tfpnExtra = builtins.fromJSON (builtins.readFile ./tfpn-modules.json);
   pkgsModule = rec {
     config = {
       nixpkgs = {
+        {{- if .LocalSystem}}
+        localSystem = {{.LocalSystem}};
+        {{- else}}
         system = lib.mkDefault builtins.currentSystem;
+        {{- end}}
+        crossSystem = {{.CrossSystem}};
         initialSystem = builtins.currentSystem;
+        config = tfpnExtra.nixpkgsConfig;
+        overlays = map (p: import (/. + p)) tfpnExtra.overlays;
       };
     };
   };
@@ -30,10 +40,27 @@ let
       tfpnmod
       pkgsModule
       mod
-    ];
-    specialArgs = {
+      ./tfpn-inline-module.nix
+    ] ++ map (p: /. + p) tfpnExtra.modules;
+    specialArgs = tfpnExtra.specialArgs // {
       inherit modulesPath baseModules tfpnModulesPath;
     };
   };
+  query = builtins.fromJSON (builtins.readFile ./tfpn-query.json);
 in
-  c.config.system.build.toplevel
+  c.config.system.build.toplevel // {
+    # Built by nix-build --attr
+    tfpnBuild = c.config.system.build;
+    # Evaluated before the build
+    tfpnEval = {
+      # Values of the option paths in tfpn-query.json
+      query = builtins.mapAttrs (n: p: lib.getAttrFromPath p c.config) query;
+      # The baseModules declaring these may not be imported
+      failedAssertions = map (a: a.message)
+        (builtins.filter (a: !a.assertion) (c.config.assertions or [ ]));
+      warnings = c.config.warnings or [ ];
+    };
+    # JSON schema of the tfpn option, checked against tfpn-config.json
+    tfpnSchema = import "${tfpnLibPath}/option-schema.nix" { inherit lib; }
+      c.options.tfpn.type;
+  }
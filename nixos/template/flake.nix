@@ -16,27 +16,56 @@
       url = "{{.TfpnModPath}}";
       flake = false;
     };
+
+    tfpnLib = {
+      url = "{{.TfpnLibPath}}";
+      flake = false;
+    };
   };
 
-  outputs = { self, base, nixpkgs, nixpkgsRaw, tfpnModules, ... }:
+  outputs = { self, base, nixpkgs, nixpkgsRaw, tfpnModules, tfpnLib, ... }:
     let
       tfpnModulesPath = tfpnModules.outPath;
       modulesPath = "${nixpkgsRaw.outPath}/nixos/modules";
       baseModules = import "${modulesPath}/module-list.nix";
+      # The installable may also name a NixOS configuration (the result of
+      # nixpkgs.lib.nixosSystem), in which case its modules and special
+      # arguments are used.
+      isConfiguration = m: builtins.isAttrs m && m ? options
+        && (m.config._module.args.modules or null) != null;
+      toModule = m:
+        if isConfiguration m
+        then { imports = baseModules ++ m.config._module.args.modules; }
+        else m;
+      # Recorded since nixpkgs 21.11
+      toSpecialArgs = m:
+        if isConfiguration m
+        then m.config._module.specialArgs or { }
+        else { };
+      # Extra modules, overlays and arguments from tfpn-modules.json. The
+      # modules and overlays are copied into this flake.
+      tfpnExtra = builtins.fromJSON (builtins.readFile ./tfpn-modules.json);
     in
       rec {
         nixosModules = {
+          # Option passed from terraform-provider-packernix. Left untyped and
+          # undocumented, so that configurations can declare it with a type.
           tfpn = { config, lib, ... }: {
-            options.tfpn = lib.mkOption {
-              description = "Option passed from terraform-provider-packernix";
-            };
+            options.tfpn = lib.mkOption { };
             config.tfpn = builtins.fromJSON (builtins.readFile ./tfpn-config.json);
           };
           pkgs = { config, lib, ... }: rec {
             config = {
               nixpkgs = {
+                {{- if .LocalSystem}}
+                localSystem = {{.LocalSystem}};
+                {{- else}}
                 system = lib.mkDefault builtins.currentSystem;
+                {{- end}}
+                crossSystem = {{.CrossSystem}};
                 initialSystem = builtins.currentSystem;
+                config = tfpnExtra.nixpkgsConfig;
+                overlays = map (p: import (./. + "/${p}")) tfpnExtra.overlays;
               };
               system = {
                 nixos = {
@@ -53,11 +82,30 @@
           modules = [
             nixosModules.tfpn
             nixosModules.pkgs
-            base.{{.Attr}}
-          ];
-          specialArgs = {
+            (toModule base.{{.Attr}})
+            ./tfpn-inline-module.nix
+          ] ++ map (p: ./. + "/${p}") tfpnExtra.modules;
+          specialArgs = toSpecialArgs base.{{.Attr}}
+            // tfpnExtra.specialArgs // {
             inherit modulesPath baseModules tfpnModulesPath;
           };
         };
+
+        # Evaluated before the build
+        tfpnEval = let c = nixosConfiguration.config; in {
+          # Values of the option paths in tfpn-query.json
+          query = builtins.mapAttrs
+            (n: p: nixpkgs.lib.getAttrFromPath p c)
+            (builtins.fromJSON (builtins.readFile ./tfpn-query.json));
+          # The baseModules declaring these may not be imported
+          failedAssertions = map (a: a.message)
+            (builtins.filter (a: !a.assertion) (c.assertions or [ ]));
+          warnings = c.warnings or [ ];
+        };
+
+        # JSON schema of the tfpn option, checked against tfpn-config.json
+        tfpnSchema = import "${tfpnLib}/option-schema.nix"
+          { inherit (nixpkgs) lib; }
+          nixosConfiguration.options.tfpn.type;
       };
 }
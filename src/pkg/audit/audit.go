@@ -0,0 +1,118 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// A JSON lines log of the commands run by the provider.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// A record of one command
+type Entry struct {
+	// When the command started
+	Time time.Time `json:"time"`
+	// Terraform type of the resource or data source, like "packernix_image"
+	ResourceType string `json:"resource_type"`
+	// Terraform operation, like "create" or "plan"
+	Operation  string   `json:"operation"`
+	Executable string   `json:"executable"`
+	Args       []string `json:"args"`
+	// Names of the environment variables set for the command
+	Env        []string `json:"env"`
+	WorkingDir string   `json:"working_dir"`
+	// Run time in seconds
+	Duration float64 `json:"duration"`
+	// -1 if the command did not exit normally
+	ExitCode int `json:"exit_code"`
+	// Error running the command, if any
+	Error string `json:"error,omitempty"`
+	// IDs of the resources the command produced or found
+	IDs []string `json:"ids"`
+}
+
+// An audit log file. Safe for concurrent use. Every entry is written with a
+// single append, so processes can share a file.
+type Log struct {
+	// Patterns passed to Redact when recording entries
+	Patterns []*regexp.Regexp
+
+	l sync.Mutex
+	f *os.File
+}
+
+// Open the audit log at p for appending, creating it and its directory if
+// needed
+func Open(p string) (*Log, error) {
+	err := os.MkdirAll(filepath.Dir(p), 0700)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{f: f}, nil
+}
+
+// Append e as a line of JSON
+func (l *Log) Write(e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	l.l.Lock()
+	defer l.l.Unlock()
+	_, err = l.f.Write(b)
+	return err
+}
+
+func (l *Log) Close() error {
+	return l.f.Close()
+}
+
+// The resource and operation commands are run for
+type Scope struct {
+	Log          *Log
+	ResourceType string
+	Operation    string
+}
+
+type ctxKey struct{}
+
+// Return a context whose commands are recorded in s
+func NewContext(ctx context.Context, s *Scope) context.Context {
+	return context.WithValue(ctx, ctxKey{}, s)
+}
+
+// The scope of ctx. nil if there is none.
+func FromContext(ctx context.Context) *Scope {
+	s, _ := ctx.Value(ctxKey{}).(*Scope)
+	return s
+}
+
+// Fill in the resource type and operation of e, redact its arguments, and
+// write it to the log. Does nothing if s or its log is nil.
+func (s *Scope) Record(e *Entry) error {
+	if s == nil || s.Log == nil {
+		return nil
+	}
+	e.ResourceType = s.ResourceType
+	e.Operation = s.Operation
+	e.Args = Redact(e.Args, s.Log.Patterns)
+	if e.Env == nil {
+		e.Env = []string{}
+	}
+	if e.IDs == nil {
+		e.IDs = []string{}
+	}
+	return s.Log.Write(e)
+}
@@ -0,0 +1,124 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package audit_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sync"
+	"testing"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/audit"
+)
+
+func TestRedact(t *testing.T) {
+	args := []string{
+		"--argstr", "rootPassword", "hunter2",
+		"--argstr", "hostname", "example",
+		"-var", "aws_secret_key=abc",
+		"--token=def",
+		"--option", "access-tokens", "github.com=ghi",
+		"https://ghp_a1b2@github.com/repo",
+	}
+	expected := []string{
+		"--argstr", "rootPassword", Redacted,
+		"--argstr", "hostname", "example",
+		"-var", "aws_secret_key=" + Redacted,
+		"--token=" + Redacted,
+		"--option", "access-tokens", Redacted,
+		"https://" + Redacted + "@github.com/repo",
+	}
+	got := Redact(
+		args,
+		[]*regexp.Regexp{regexp.MustCompile(`ghp_[0-9A-Za-z]+`)},
+	)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %#v, but got %#v", expected, got)
+	}
+	if args[2] != "hunter2" {
+		t.Errorf("Redact modified its argument")
+	}
+}
+
+func TestEnvNames(t *testing.T) {
+	got := EnvNames([]string{"B=1", "A=x=y", "C"})
+	expected := []string{"A", "B", "C"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %#v, but got %#v", expected, got)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "logs", "audit.jsonl")
+	l, err := Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Patterns = []*regexp.Regexp{regexp.MustCompile(`\.json$`)}
+
+	ctx := NewContext(context.Background(), &Scope{
+		Log:          l,
+		ResourceType: "packernix_image",
+		Operation:    "create",
+	})
+	// A context without a scope records nothing
+	err = FromContext(context.Background()).Record(&Entry{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := 50
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := FromContext(ctx).Record(&Entry{
+				Executable: "packer",
+				Args:       []string{"build", "create.json"},
+				IDs:        []string{"amazon-ebs.ami-1"},
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	l.Close()
+
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	count := 0
+	for scanner.Scan() {
+		e := &Entry{}
+		err = json.Unmarshal(scanner.Bytes(), e)
+		if err != nil {
+			t.Fatalf("invalid line %#v: %s", scanner.Text(), err)
+		}
+		if e.ResourceType != "packernix_image" || e.Operation != "create" ||
+			e.Args[1] != "create"+Redacted {
+			t.Errorf("unexpected entry %#v", e)
+		}
+		count++
+	}
+	if count != n {
+		t.Errorf("expected %d entries, but got %d", n, count)
+	}
+}
@@ -0,0 +1,59 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package audit
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Replacement of redacted values
+const Redacted = "[REDACTED]"
+
+// Names of arguments and variables that hold secrets
+var sensitiveName = regexp.MustCompile(
+	`(?i)(passw|secret|token|credential|private.?key|api.?key|access.?key)`,
+)
+
+// Options followed by a name and a value
+var namedValueOptions = map[string]bool{
+	"--arg":    true,
+	"--argstr": true,
+	"--option": true,
+}
+
+// Redact secrets from a command line. Values are redacted if
+//	- they follow "--arg", "--argstr" or "--option" and a sensitive name
+//	- they are in a "name=value" argument with a sensitive name
+// Parts of arguments matching any of patterns are also redacted.
+func Redact(args []string, patterns []*regexp.Regexp) []string {
+	r := make([]string, len(args))
+	copy(r, args)
+	for i := range r {
+		if namedValueOptions[args[i]] && i+2 < len(args) &&
+			sensitiveName.MatchString(args[i+1]) {
+			r[i+2] = Redacted
+		}
+		kv := strings.SplitN(r[i], "=", 2)
+		if len(kv) == 2 && sensitiveName.MatchString(kv[0]) {
+			r[i] = kv[0] + "=" + Redacted
+		}
+		for _, re := range patterns {
+			r[i] = re.ReplaceAllString(r[i], Redacted)
+		}
+	}
+	return r
+}
+
+// Sorted names of the variables of an environment of "name=value" strings
+func EnvNames(env []string) []string {
+	names := make([]string, 0, len(env))
+	for _, e := range env {
+		names = append(names, strings.SplitN(e, "=", 2)[0])
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,174 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Compare the closures of two store paths by package, like
+// `nix store diff-closures`
+package closurediff
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Size changes below this are not reported, as in Nix
+const minSizeDelta = 8 * 1024
+
+var outputRegexp = regexp.MustCompile(`^(.*)-([a-z]+|lib32|lib64)$`)
+
+// Split the name of a store path, like
+// /nix/store/<hash>-hello-2.10-man, into a package name and version. Output
+// names are dropped, and the version starts at the first dash not followed by
+// a letter, as in Nix.
+func ParseName(storePath string) (name string, version string) {
+	name = path.Base(storePath)
+	if i := strings.IndexByte(name, '-'); i >= 0 {
+		name = name[i+1:]
+	}
+	if m := outputRegexp.FindStringSubmatch(name); m != nil {
+		name = m[1]
+	}
+	for i := 0; i+1 < len(name); i++ {
+		c := name[i+1]
+		isLetter := ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+		if name[i] == '-' && !isLetter {
+			return name[:i], name[i+1:]
+		}
+	}
+	return name, ""
+}
+
+// Map of package names to versions to total NAR sizes
+type closureInfo map[string]map[string]int64
+
+func getClosureInfo(sizes map[string]int64) closureInfo {
+	ci := closureInfo{}
+	for p, s := range sizes {
+		n, v := ParseName(p)
+		if ci[n] == nil {
+			ci[n] = map[string]int64{}
+		}
+		ci[n][v] += s
+	}
+	return ci
+}
+
+// Versions of vs missing from ws, sorted
+func missingVersions(vs map[string]int64, ws map[string]int64) []string {
+	m := []string{}
+	for v := range vs {
+		if _, ok := ws[v]; !ok {
+			m = append(m, v)
+		}
+	}
+	sort.Strings(m)
+	return m
+}
+
+func showVersions(vs []string) string {
+	if len(vs) == 0 {
+		return "∅"
+	}
+	ss := make([]string, len(vs))
+	for i, v := range vs {
+		if v == "" {
+			v = "ε"
+		}
+		ss[i] = v
+	}
+	return strings.Join(ss, ", ")
+}
+
+func totalSize(vs map[string]int64) (t int64) {
+	for _, s := range vs {
+		t += s
+	}
+	return
+}
+
+// Format a size in bytes like 1.5 MiB
+func ShowBytes(b int64) string {
+	f := float64(b)
+	units := []string{"KiB", "MiB", "GiB", "TiB"}
+	u := "bytes"
+	for _, next := range units {
+		if f > -1024 && f < 1024 {
+			break
+		}
+		f /= 1024
+		u = next
+	}
+	if u == "bytes" {
+		return fmt.Sprintf("%d bytes", b)
+	}
+	return fmt.Sprintf("%.1f %s", f, u)
+}
+
+func showDelta(b int64) string {
+	if b >= 0 {
+		return "+" + ShowBytes(b)
+	}
+	return ShowBytes(b)
+}
+
+// Describe the packages added, removed or changed between two closures, given
+// as maps of store paths to NAR sizes. One line per package, sorted by name,
+// followed by the change of the total size. Empty if nothing changed.
+func Diff(before map[string]int64, after map[string]int64) string {
+	bi := getClosureInfo(before)
+	ai := getClosureInfo(after)
+	names := []string{}
+	for n := range bi {
+		names = append(names, n)
+	}
+	for n := range ai {
+		if _, ok := bi[n]; !ok {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, n := range names {
+		removed := missingVersions(bi[n], ai[n])
+		added := missingVersions(ai[n], bi[n])
+		delta := totalSize(ai[n]) - totalSize(bi[n])
+		showSize := delta >= minSizeDelta || delta <= -minSizeDelta
+		if len(removed) == 0 && len(added) == 0 && !showSize {
+			continue
+		}
+		items := []string{}
+		if len(removed) != 0 || len(added) != 0 {
+			items = append(
+				items,
+				showVersions(removed)+" → "+showVersions(added),
+			)
+		}
+		if showSize {
+			items = append(items, showDelta(delta))
+		}
+		fmt.Fprintf(&b, "%s: %s\n", n, strings.Join(items, ", "))
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+
+	var bt, at int64
+	for _, s := range before {
+		bt += s
+	}
+	for _, s := range after {
+		at += s
+	}
+	fmt.Fprintf(
+		&b,
+		"closure size: %s → %s (%s)\n",
+		ShowBytes(bt),
+		ShowBytes(at),
+		showDelta(at-bt),
+	)
+	return b.String()
+}
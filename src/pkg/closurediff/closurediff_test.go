@@ -0,0 +1,81 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package closurediff_test
+
+import (
+	"testing"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/closurediff"
+)
+
+func TestParseName(t *testing.T) {
+	ts := []struct {
+		in      string
+		name    string
+		version string
+	}{
+		{
+			in:      "/nix/store/00000000000000000000000000000000-hello-2.10",
+			name:    "hello",
+			version: "2.10",
+		},
+		{
+			in:      "/nix/store/00000000000000000000000000000000-hello-2.10-man",
+			name:    "hello",
+			version: "2.10",
+		},
+		{
+			in:      "/nix/store/00000000000000000000000000000000-nixos-system-tfpnhost-20.03.1",
+			name:    "nixos-system-tfpnhost",
+			version: "20.03.1",
+		},
+		{
+			in:      "/nix/store/00000000000000000000000000000000-etc",
+			name:    "etc",
+			version: "",
+		},
+	}
+	for _, tt := range ts {
+		t.Run(tt.in, func(t *testing.T) {
+			n, v := ParseName(tt.in)
+			if n != tt.name || v != tt.version {
+				t.Errorf(
+					"expected %#v %#v, but got %#v %#v",
+					tt.name,
+					tt.version,
+					n,
+					v,
+				)
+			}
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	const s = "/nix/store/00000000000000000000000000000000-"
+	before := map[string]int64{
+		s + "hello-2.10":    100 * 1024,
+		s + "openssl-1.1.1": 3 * 1024 * 1024,
+		s + "removed-1.0":   20 * 1024,
+		s + "etc":           1024,
+	}
+	after := map[string]int64{
+		s + "hello-2.10":    100 * 1024,
+		s + "openssl-3.0.0": 5 * 1024 * 1024,
+		s + "added-0.1":     1024,
+		s + "etc":           2048,
+	}
+	expected := "added: ∅ → 0.1\n" +
+		"openssl: 1.1.1 → 3.0.0, +2.0 MiB\n" +
+		"removed: 1.0 → ∅, -20.0 KiB\n" +
+		"closure size: 3.1 MiB → 5.1 MiB (+2.0 MiB)\n"
+	got := Diff(before, after)
+	if got != expected {
+		t.Errorf("expected %#v, but got %#v", expected, got)
+	}
+	if Diff(before, before) != "" {
+		t.Errorf("identical closures differ")
+	}
+}
@@ -0,0 +1,165 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Per-resource log files of the commands run by the provider.
+package cmdlog
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Format of the timestamp starting every line
+const TimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+type ctxKey struct{}
+
+// Return a context whose commands are logged to the file at p. An empty p
+// disables logging.
+func NewContext(ctx context.Context, p string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, p)
+}
+
+// The log file of ctx. Empty if commands are not logged.
+func FromContext(ctx context.Context) string {
+	p, _ := ctx.Value(ctxKey{}).(string)
+	return p
+}
+
+// Name a new log file in dir, for a resource of type kind
+func NewFile(dir string, kind string) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return filepath.Join(dir, fmt.Sprintf(
+		"%s-%s-%s.log",
+		kind,
+		time.Now().UTC().Format("20060102T150405Z"),
+		hex.EncodeToString(b),
+	))
+}
+
+// A log file. Safe for concurrent use.
+type Log struct {
+	l sync.Mutex
+	f *os.File
+}
+
+// Open the log file at p for appending, creating it and its directory if
+// needed
+func Open(p string) (*Log, error) {
+	err := os.MkdirAll(filepath.Dir(p), 0700)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{f: f}, nil
+}
+
+// Write a timestamped line
+func (lg *Log) Printf(format string, a ...interface{}) {
+	lg.l.Lock()
+	defer lg.l.Unlock()
+	fmt.Fprintf(
+		lg.f,
+		"%s %s\n",
+		time.Now().UTC().Format(TimeFormat),
+		fmt.Sprintf(format, a...),
+	)
+}
+
+func (lg *Log) Close() error {
+	return lg.f.Close()
+}
+
+// Writer that logs every line, prefixed with the name of a stream
+type lineWriter struct {
+	lg      *Log
+	stream  string
+	partial []byte
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	buf := append(w.partial, b...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		l := bytes.TrimSuffix(buf[:i], []byte("\r"))
+		w.lg.Printf("%s | %s", w.stream, l)
+		buf = buf[i+1:]
+	}
+	w.partial = append([]byte(nil), buf...)
+	return len(b), nil
+}
+
+// Log an unterminated last line
+func (w *lineWriter) flush() {
+	if len(w.partial) > 0 {
+		w.lg.Printf("%s | %s", w.stream, w.partial)
+		w.partial = nil
+	}
+}
+
+func tee(w io.Writer, lw *lineWriter) io.Writer {
+	if w == nil {
+		return lw
+	}
+	return io.MultiWriter(w, lw)
+}
+
+// Record the argv and working directory of cmd in the log file of ctx, and
+// copy its standard output and error there. Must be called after cmd's Stdout
+// and Stderr are set, and before it is started. finish must be called with
+// the result of the command once it exits.
+func Start(
+	ctx context.Context,
+	cmd *exec.Cmd,
+) (finish func(error), err error) {
+	finish = func(error) {}
+	p := FromContext(ctx)
+	if p == "" {
+		return
+	}
+	lg, err := Open(p)
+	if err != nil {
+		return
+	}
+	args := make([]string, len(cmd.Args))
+	for i, a := range cmd.Args {
+		args[i] = fmt.Sprintf("%q", a)
+	}
+	lg.Printf("$ %s", strings.Join(args, " "))
+	if cmd.Dir != "" {
+		lg.Printf("dir: %s", cmd.Dir)
+	}
+	stdout := &lineWriter{lg: lg, stream: "stdout"}
+	stderr := &lineWriter{lg: lg, stream: "stderr"}
+	cmd.Stdout = tee(cmd.Stdout, stdout)
+	cmd.Stderr = tee(cmd.Stderr, stderr)
+	finish = func(err error) {
+		stdout.flush()
+		stderr.flush()
+		if err != nil {
+			lg.Printf("failed: %s", err.Error())
+		} else {
+			lg.Printf("exit status 0")
+		}
+		lg.Close()
+	}
+	return
+}
@@ -0,0 +1,81 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package cmdlog_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/cmdlog"
+)
+
+func TestStart(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	dir, err := ioutil.TempDir("", "cmdlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := NewFile(filepath.Join(dir, "logs"), "packernix_test")
+	ctx := NewContext(context.Background(), p)
+	cmd := exec.Command(sh, "-c", "echo out; echo err >&2; printf last; exit 2")
+	outb := &bytes.Buffer{}
+	cmd.Stdout = outb
+	finish, err := Start(ctx, cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Run()
+	finish(err)
+	if outb.String() != "out\nlast" {
+		t.Errorf("stdout not passed through: %#v", outb.String())
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	ts := regexp.MustCompile(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}Z `)
+	for _, l := range lines {
+		if !ts.MatchString(l) {
+			t.Errorf("line without timestamp: %#v", l)
+		}
+	}
+	for _, e := range []string{
+		`$ "` + sh + `" "-c" "echo out; echo err >&2; printf last; exit 2"`,
+		"stdout | out",
+		"stderr | err",
+		"stdout | last",
+		"failed: exit status 2",
+	} {
+		if !strings.Contains(string(b), " "+e+"\n") {
+			t.Errorf("expected log to contain %#v, but got\n%s", e, b)
+		}
+	}
+}
+
+func TestStartDisabled(t *testing.T) {
+	cmd := exec.Command("true")
+	finish, err := Start(context.Background(), cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finish(nil)
+	if cmd.Stdout != nil || cmd.Stderr != nil {
+		t.Errorf("output redirected without a log file")
+	}
+}
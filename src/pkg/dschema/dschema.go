@@ -25,6 +25,8 @@ import (
 
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/nar"
 )
 
 // Configuration for an attribute
@@ -66,6 +68,13 @@ type ProviderDefaulter interface {
 	ProviderDefaults() map[string]interface{}
 }
 
+// An interface that provider contexts can optionally implement to control how
+// paths are hashed. If unimplemented, HashPath is used.
+// A nil filter includes every file.
+type PathHasher interface {
+	HashPath(context.Context, string, nar.Filter) (string, error)
+}
+
 //------------------------------------------------------------------------------
 
 // A convenience interface for writing functions that can easily access
@@ -176,6 +176,27 @@ func StringDSchema(
 	}
 }
 
+// A schema for possibly defaultable ints. Zero is treated as unset.
+func IntDSchema(
+	hasProviderDefault bool,
+	base func() *schema.Schema,
+) DSchema {
+	return &GenericDSchema{
+		HasProviderDefault: hasProviderDefault,
+		Base:               base,
+		GetFunc: func(dg dataGetter, k string) (interface{}, diag.Diagnostics) {
+			return getInt(dg, k)
+		},
+		MergeFunc: func(p interface{}, r interface{}) interface{} {
+			if r.(int) == 0 {
+				return p
+			} else {
+				return r
+			}
+		},
+	}
+}
+
 // A schema for possibly defaultable string slices
 func StringSliceDSchema(
 	hasProviderDefault bool,
@@ -220,3 +241,25 @@ func StringMapDSchema(
 		},
 	}
 }
+
+// A schema for possibly defaultable lists, like blocks. The resource value
+// replaces the provider value if it is not empty.
+func ListDSchema(
+	hasProviderDefault bool,
+	base func() *schema.Schema,
+) DSchema {
+	return &GenericDSchema{
+		HasProviderDefault: hasProviderDefault,
+		Base:               base,
+		GetFunc: func(dg dataGetter, k string) (interface{}, diag.Diagnostics) {
+			return getSlice(dg, k)
+		},
+		MergeFunc: func(p interface{}, r interface{}) interface{} {
+			if len(r.([]interface{})) == 0 {
+				return p
+			} else {
+				return r
+			}
+		},
+	}
+}
@@ -55,6 +55,25 @@ func TestGenericDSchema(t *testing.T) {
 				}
 			},
 		),
+		"int": IntDSchema(
+			false,
+			func() *schema.Schema {
+				return &schema.Schema{
+					Type:     schema.TypeInt,
+					Optional: true,
+					Default:  1,
+				}
+			},
+		),
+		"dint": IntDSchema(
+			true,
+			func() *schema.Schema {
+				return &schema.Schema{
+					Type:     schema.TypeInt,
+					Optional: true,
+				}
+			},
+		),
 		"ndslice": StringSliceDSchema(
 			false,
 			func() *schema.Schema {
@@ -97,6 +116,18 @@ func TestGenericDSchema(t *testing.T) {
 				}
 			},
 		),
+		"dlist": ListDSchema(
+			true,
+			func() *schema.Schema {
+				return &schema.Schema{
+					Type: schema.TypeList,
+					Elem: &schema.Schema{
+						Type: schema.TypeString,
+					},
+					Optional: true,
+				}
+			},
+		),
 		"ndmap": StringMapDSchema(
 			false,
 			func() *schema.Schema {
@@ -150,9 +181,12 @@ func TestGenericDSchema(t *testing.T) {
 				"ndstring": "",
 				"string":   "stringd",
 				"dstring":  "dstringd",
+				"int":      1,
+				"dint":     0,
 				"ndslice":  []string{},
 				"slice":    []string{"sliced"},
 				"dslice":   []string{"dsliced"},
+				"dlist":    []interface{}{},
 				"ndmap":    map[string]string{},
 				"map":      map[string]string{"k": "mapv"},
 				"dmap":     map[string]string{"k": "dmapv"},
@@ -162,7 +196,9 @@ func TestGenericDSchema(t *testing.T) {
 			name: "merge",
 			provider: map[string]interface{}{
 				"dstring": "pstring",
+				"dint":    2,
 				"dslice":  []interface{}{"pelem"},
+				"dlist":   []interface{}{"plist"},
 				"dmap": map[string]interface{}{
 					"k":        "kval",
 					"override": "wrong",
@@ -170,6 +206,7 @@ func TestGenericDSchema(t *testing.T) {
 			},
 			resource: map[string]interface{}{
 				"dstring": "rstring",
+				"int":     3,
 				"dslice":  []interface{}{"relem"},
 				"dmap": map[string]interface{}{
 					"override": "right",
@@ -178,7 +215,10 @@ func TestGenericDSchema(t *testing.T) {
 			},
 			expected: map[string]interface{}{
 				"dstring": "rstring",
+				"int":     3,
+				"dint":    2,
 				"dslice":  []string{"relem"},
+				"dlist":   []interface{}{"plist"},
 				"dmap": map[string]string{
 					"k":        "kval",
 					"override": "right",
@@ -7,27 +7,43 @@ package dschema
 import (
 	"context"
 	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/hashicorp/go-cty/cty"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/ignore"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/nar"
 )
 
 // Implements a schema that produces paths.
 // Sets in the provider:
 //	- working_dir
 //	- key
+//	- on_path_change
 // Sets in the resource:
 //	- working_dir
 //	- key
 //	- path_uses_provider_wd
 //	- path_hashes
+//	- on_path_change
+//	- path_ignore
+//	- path_ignore_files
 // Get returns a resolved absolute path.
 // Relative paths normalized to use '/' as the separator.
+//
+// If the hash of a path changes, on_path_change controls whether Resolve
+// fails, or the change shows up as a diff of path_hashes (see PathChangeDiff).
+// Files matched by path_ignore or the ignore files named in path_ignore_files
+// are left out of hashes.
 type PathDSchema struct {
 	// Set to true to create an argument in the provider to use as a default
 	HasProviderDefault bool
-	// Set to true to skip the path nix-hash check on get
+	// Set to true to skip the path hash check on get
 	SkipHashCheck bool
 	// Set to true to override Resolve()'s useConfig parameter and perform
 	// Get()s directly. Mostly intended for testing, though it should also work
@@ -48,6 +64,79 @@ type PathDSchema struct {
 
 //------------------------------------------------------------------------------
 
+// Values of on_path_change
+const (
+	// Changed hashes show up as a diff and force replacement
+	OnPathChangeReplace = "replace"
+	// Changed hashes are ignored and not saved to the state
+	OnPathChangeIgnore = "ignore"
+	// Changed hashes are an error when reading the state
+	OnPathChangeError = "error"
+)
+
+// Schema to control how changes to hashed paths are handled
+func OnPathChangeSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:     schema.TypeString,
+		Optional: true,
+		ValidateFunc: validation.StringInSlice(
+			[]string{
+				OnPathChangeReplace,
+				OnPathChangeIgnore,
+				OnPathChangeError,
+			},
+			false,
+		),
+		Description: `What to do when the contents of a path change. One of ` +
+			`"replace" (the default), "ignore" or "error"`,
+	}
+}
+
+// Schema for gitignore patterns of files left out of path hashes
+func PathIgnoreSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:     schema.TypeList,
+		Optional: true,
+		Elem: &schema.Schema{
+			Type: schema.TypeString,
+			ValidateDiagFunc: func(
+				i interface{},
+				p cty.Path,
+			) (d diag.Diagnostics) {
+				s, _ := i.(string)
+				err := ignore.ValidPattern(s)
+				if err != nil {
+					d = append(d, diag.Diagnostic{
+						Severity:      diag.Error,
+						Summary:       "invalid pattern",
+						Detail:        err.Error(),
+						AttributePath: p,
+					})
+				}
+				return
+			},
+		},
+		Description: `Patterns in gitignore syntax of files to leave out ` +
+			`when hashing paths`,
+	}
+}
+
+// Schema for names of ignore files to honor when hashing paths
+func PathIgnoreFilesSchema() *schema.Schema {
+	return &schema.Schema{
+		Type:     schema.TypeList,
+		Optional: true,
+		Elem: &schema.Schema{
+			Type: schema.TypeString,
+			ValidateFunc: validation.StringDoesNotContainAny(
+				"/" + string(filepath.Separator),
+			),
+		},
+		Description: `Names of ignore files, like ".gitignore" or ` +
+			`".nixignore", whose patterns are honored when hashing paths`,
+	}
+}
+
 // Schema to set which paths should resolve with the provider working_dir.
 func PUPWDSchema() *schema.Schema {
 	return &schema.Schema{
@@ -95,6 +184,18 @@ func (pds *PathDSchema) AddSchema(k string, m map[string]*schema.Schema) {
 		if !ok {
 			m["path_hashes"] = PathHashSchema()
 		}
+		_, ok = m["on_path_change"]
+		if !ok {
+			m["on_path_change"] = OnPathChangeSchema()
+		}
+		_, ok = m["path_ignore"]
+		if !ok {
+			m["path_ignore"] = PathIgnoreSchema()
+		}
+		_, ok = m["path_ignore_files"]
+		if !ok {
+			m["path_ignore_files"] = PathIgnoreFilesSchema()
+		}
 	}
 }
 
@@ -113,6 +214,12 @@ func (pds *PathDSchema) AddPSchema(k string, m map[string]*schema.Schema) {
 		}
 	}
 	(&WDDSchema{}).AddPSchema(k, m)
+	if !pds.SkipHashCheck {
+		_, ok := m["on_path_change"]
+		if !ok {
+			m["on_path_change"] = OnPathChangeSchema()
+		}
+	}
 }
 
 //------------------------------------------------------------------------------
@@ -137,6 +244,13 @@ func (pds *PathDSchema) Configure(
 			pd.ProviderDefaults()[k] = p
 		}
 	}
+	if !pds.SkipHashCheck {
+		opc, d0 := getString(&rdGetter{D: rd}, "on_path_change")
+		d = append(d, d0...)
+		if opc != "" {
+			pd.ProviderDefaults()["on_path_change"] = opc
+		}
+	}
 	return
 }
 
@@ -163,8 +277,58 @@ type pathResolveResult struct {
 	Absolute string
 	// True if provider working_dir was used
 	UsePWD bool
-	// nix-hash of path
+	// NAR hash of path
 	Hash string
+	// Hash of path stored in the state
+	OldHash string
+	// Value of on_path_change
+	OnChange string
+}
+
+// Get the value of on_path_change, falling back to the provider value
+func getOnPathChange(
+	dg dataGetter,
+	pd ProviderDefaulter,
+) (opc string, d diag.Diagnostics) {
+	opc, d = getString(dg, "on_path_change")
+	if opc != "" || d.HasError() {
+		return
+	}
+	opc, d = getString(&defaultGetter{M: pd}, "on_path_change")
+	if opc == "" {
+		opc = OnPathChangeReplace
+	}
+	return
+}
+
+// Build the filter for hashing a path from path_ignore and path_ignore_files.
+// Returns nil if neither is set.
+func pathFilter(
+	dg dataGetter,
+	root string,
+) (f nar.Filter, d diag.Diagnostics) {
+	patterns, d := getStringSlice(dg, "path_ignore")
+	if d.HasError() {
+		return
+	}
+	files, d0 := getStringSlice(dg, "path_ignore_files")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	if len(patterns) == 0 && len(files) == 0 {
+		return
+	}
+	m, err := ignore.New(root, patterns, files)
+	if err != nil {
+		d = append(d, diag.Diagnostic{
+			Severity:      diag.Error,
+			AttributePath: cty.GetAttrPath("path_ignore"),
+			Summary:       err.Error(),
+		})
+		return
+	}
+	return m, d
 }
 
 func getPUPWD(
@@ -259,7 +423,10 @@ func (pds *PathDSchema) Resolve(
 		return rr, d
 	}
 
-	if useConfig {
+	// Paths with a provider default that are only set in the provider always
+	// resolve with the provider working_dir, so the state does not need to be
+	// consulted. Their state may predate path_uses_provider_wd entries.
+	if useConfig || (pds.HasProviderDefault && !rpSet) {
 		rr.UsePWD = !wdrr.(*wddResolveResult).WdSet || !rpSet
 	} else {
 		rr.UsePWD, d0 = getPUPWD(rdg, k)
@@ -276,14 +443,35 @@ func (pds *PathDSchema) Resolve(
 	}
 
 	if !pds.SkipHashCheck {
-		hash, err := HashPath(ctx, rr.Absolute)
+		rr.OnChange, d0 = getOnPathChange(rdg, pd)
+		d = append(d, d0...)
+		if d.HasError() {
+			return rr, d
+		}
+		ohs, d0 := getStringMap(&stateGetter{D: rd}, "path_hashes")
+		d = append(d, d0...)
+		if d.HasError() {
+			return rr, d
+		}
+		rr.OldHash = ohs[k]
+
+		// Patterns come from the same source as the path, so hashes in the
+		// state are checked with the patterns they were computed with.
+		f, d0 := pathFilter(rdg, rr.Absolute)
+		d = append(d, d0...)
+		if d.HasError() {
+			return rr, d
+		}
+		hash, err := hashPath(ctx, pd, rr.Absolute, f)
 		rr.Hash = hash
 		if !useConfig {
 			if err != nil {
 				d = phDiag(d, err.Error())
 				return rr, d
 			}
-			d = append(d, checkHash(rdg, k, hash)...)
+			if rr.OnChange == OnPathChangeError {
+				d = append(d, checkHash(rdg, k, hash)...)
+			}
 		}
 	}
 
@@ -356,8 +544,115 @@ func (pds *PathDSchema) Set(
 	}
 
 	if !pds.SkipHashCheck {
-		d = append(d, setPathHash(rd, k, prr.Hash)...)
+		hash := prr.Hash
+		if prr.OnChange == OnPathChangeIgnore && prr.OldHash != "" {
+			hash = prr.OldHash
+		}
+		d = append(d, setPathHash(rd, k, hash)...)
+	}
+
+	return
+}
+
+//------------------------------------------------------------------------------
+
+// Migrations of path_hashes. They are registered even with SkipHashCheck, so
+// that the schema version of a resource does not depend on it.
+//
+// Versions:
+//	- 0: hashes were the output of nix-hash, with a trailing newline
+func (pds *PathDSchema) Migrations() []Migration {
+	return []Migration{
+		{Version: 0, Upgrade: trimPathHash},
+	}
+}
+
+// Strip the trailing newline from the stored hash of pname
+func trimPathHash(
+	ctx context.Context,
+	rawState map[string]interface{},
+	pname string,
+) error {
+	phi, ok := rawState["path_hashes"]
+	if !ok || phi == nil {
+		return nil
+	}
+	ph, ok := phi.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("path_hashes is a %T, not a map", phi)
+	}
+	h, ok := ph[pname].(string)
+	if ok {
+		ph[pname] = strings.TrimSpace(h)
 	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
 
+// Check a diff for hashed paths whose contents changed, while the path
+// argument itself did not. Should be called after the ConfigGetter SetAll in a
+// CustomizeDiff.
+//
+// Returns the changed keys whose on_path_change setting is "replace". The
+// resource can then either ForceNew("path_hashes") or plan an update. Keys set
+// to "error" produce error diagnostics.
+func PathChangeDiff(
+	ctx context.Context,
+	rd *schema.ResourceDiff,
+	ds DSchemas,
+	pd ProviderDefaulter,
+) (changed []string, d diag.Diagnostics) {
+	if rd.Id() == "" || !rd.HasChange("path_hashes") {
+		return
+	}
+	ohi, nhi := rd.GetChange("path_hashes")
+	ohs, _ := ohi.(map[string]interface{})
+	nhs, _ := nhi.(map[string]interface{})
+	keys := make([]string, 0, len(ds))
+	for k := range ds {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if rd.HasChange(k) || !pathHashChanged(ds[k], k, ohs, nhs) {
+			continue
+		}
+		opc, d0 := getOnPathChange(&rdGetter{D: ResourceDiffAdapter(rd)}, pd)
+		d = append(d, d0...)
+		if d.HasError() {
+			return
+		}
+		switch opc {
+		case OnPathChangeError:
+			d = phDiag(d, fmt.Sprintf("hash mismatch for %s", k))
+		case OnPathChangeReplace:
+			changed = append(changed, k)
+		}
+	}
 	return
 }
+
+// Report if the hashes of the paths of k differ between ohs and nhs
+func pathHashChanged(
+	ds DSchema,
+	k string,
+	ohs map[string]interface{},
+	nhs map[string]interface{},
+) bool {
+	switch pds := ds.(type) {
+	case *PathDSchema:
+		if pds.SkipHashCheck {
+			return false
+		}
+		oh, ok := ohs[k]
+		return ok && oh != nhs[k]
+	case *PathListDSchema:
+		for hk, oh := range ohs {
+			if isPathListKey(k, hk) && oh != nhs[hk] {
+				return true
+			}
+		}
+	}
+	return false
+}
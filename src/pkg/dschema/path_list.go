@@ -0,0 +1,261 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package dschema
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// Implements a schema that produces a list of hashed paths.
+// Sets in the provider:
+//	- working_dir
+//	- on_path_change
+// Sets in the resource:
+//	- working_dir
+//	- key
+//	- path_uses_provider_wd
+//	- path_hashes
+//	- on_path_change
+//	- path_ignore
+//	- path_ignore_files
+// Get returns a slice of resolved absolute paths.
+//
+// Paths are resolved and hashed like those of a PathDSchema. The hash of the
+// i-th path is stored under PathListKey(key, i) in path_hashes.
+type PathListDSchema struct {
+	// Set to true to override Resolve()'s useConfig parameter, as with
+	// PathDSchema
+	GetFromConfig bool
+
+	// Passed to schema.Schema
+	Optional    bool
+	ForceNew    bool
+	Description string
+}
+
+// Key of the hash of the i-th path of k in path_hashes
+func PathListKey(k string, i int) string {
+	return fmt.Sprintf("%s.%d", k, i)
+}
+
+// Report if hk is a path_hashes key of the list k
+func isPathListKey(k string, hk string) bool {
+	return strings.HasPrefix(hk, k+".")
+}
+
+//------------------------------------------------------------------------------
+
+func (plds *PathListDSchema) AddSchema(k string, m map[string]*schema.Schema) {
+	m[k] = &schema.Schema{
+		Type: schema.TypeList,
+		Elem: &schema.Schema{
+			Type: schema.TypeString,
+		},
+		Optional:    plds.Optional,
+		ForceNew:    plds.ForceNew,
+		Description: plds.Description,
+	}
+	(&PathDSchema{}).AddSchema("", m)
+	delete(m, "")
+}
+
+//------------------------------------------------------------------------------
+
+func (plds *PathListDSchema) AddPSchema(k string, m map[string]*schema.Schema) {
+	(&PathDSchema{}).AddPSchema(k, m)
+}
+
+//------------------------------------------------------------------------------
+
+func (plds *PathListDSchema) Configure(
+	ctx context.Context,
+	rd resource,
+	pd ProviderDefaulter,
+	k string,
+) diag.Diagnostics {
+	return (&PathDSchema{}).Configure(ctx, rd, pd, k)
+}
+
+//------------------------------------------------------------------------------
+
+type pathListResolveResult struct {
+	// resolved absolute paths
+	Absolute []string
+	// True if provider working_dir was used
+	UsePWD bool
+	// NAR hashes of paths
+	Hashes []string
+	// Hashes of paths stored in the state
+	OldHashes []string
+	// Value of on_path_change
+	OnChange string
+}
+
+func (plds *PathListDSchema) Resolve(
+	ctx context.Context,
+	rd resource,
+	pd ProviderDefaulter,
+	k string,
+	useConfig bool,
+) (interface{}, diag.Diagnostics) {
+	rr := &pathListResolveResult{}
+	var d diag.Diagnostics
+
+	var rdg dataGetter
+	if plds.GetFromConfig || useConfig {
+		rdg = &rdGetter{D: rd}
+	} else {
+		rdg = &stateGetter{D: rd}
+	}
+
+	ps, d0 := getStringSlice(rdg, k)
+	d = append(d, d0...)
+	if d.HasError() || len(ps) == 0 {
+		return rr, d
+	}
+
+	wdrr, d0 := (&WDDSchema{}).Resolve(ctx, rd, pd, "working_dir", useConfig)
+	d = append(d, d0...)
+	if d.HasError() {
+		return rr, d
+	}
+	if useConfig {
+		rr.UsePWD = !wdrr.(*wddResolveResult).WdSet
+	} else {
+		rr.UsePWD, d0 = getPUPWD(rdg, k)
+		d = append(d, d0...)
+		if d.HasError() {
+			return rr, d
+		}
+	}
+	wd := wdrr.(*wddResolveResult).Wd
+	if rr.UsePWD {
+		wd = wdrr.(*wddResolveResult).Pwd
+	}
+
+	rr.OnChange, d0 = getOnPathChange(rdg, pd)
+	d = append(d, d0...)
+	if d.HasError() {
+		return rr, d
+	}
+	ohs, d0 := getStringMap(&stateGetter{D: rd}, "path_hashes")
+	d = append(d, d0...)
+	if d.HasError() {
+		return rr, d
+	}
+
+	for i, p := range ps {
+		abs := readRelPath(p, wd)
+		rr.Absolute = append(rr.Absolute, abs)
+		rr.OldHashes = append(rr.OldHashes, ohs[PathListKey(k, i)])
+
+		f, d0 := pathFilter(rdg, abs)
+		d = append(d, d0...)
+		if d.HasError() {
+			return rr, d
+		}
+		hash, err := hashPath(ctx, pd, abs, f)
+		rr.Hashes = append(rr.Hashes, hash)
+		if !useConfig {
+			if err != nil {
+				d = phDiag(d, err.Error())
+				return rr, d
+			}
+			if rr.OnChange == OnPathChangeError {
+				d = append(d, checkHash(rdg, PathListKey(k, i), hash)...)
+			}
+		}
+	}
+
+	return rr, d
+}
+
+//------------------------------------------------------------------------------
+
+func (plds *PathListDSchema) Get(
+	rr interface{},
+) (interface{}, diag.Diagnostics) {
+	ps := rr.(*pathListResolveResult).Absolute
+	if ps == nil {
+		ps = []string{}
+	}
+	return ps, nil
+}
+
+//------------------------------------------------------------------------------
+
+func (plds *PathListDSchema) Set(
+	rd resource,
+	k string,
+	rr interface{},
+) (d diag.Diagnostics) {
+	prr := rr.(*pathListResolveResult)
+	if len(prr.Absolute) == 0 {
+		d = setPUPWD(rd, k, nil)
+	} else {
+		d = setPUPWD(rd, k, prr.UsePWD)
+	}
+	if d.HasError() {
+		return
+	}
+
+	phi, d0 := getMap(rd, "path_hashes")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	for hk := range phi {
+		if isPathListKey(k, hk) {
+			delete(phi, hk)
+		}
+	}
+	for i, hash := range prr.Hashes {
+		if prr.OnChange == OnPathChangeIgnore && prr.OldHashes[i] != "" {
+			hash = prr.OldHashes[i]
+		}
+		phi[PathListKey(k, i)] = hash
+	}
+	err := rd.Set("path_hashes", phi)
+	if err != nil {
+		d = phDiag(d, err.Error())
+	}
+	return
+}
+
+//------------------------------------------------------------------------------
+
+// Migrations of path_hashes, matching those of PathDSchema
+func (plds *PathListDSchema) Migrations() []Migration {
+	return []Migration{
+		{
+			Version: 0,
+			Upgrade: func(
+				ctx context.Context,
+				rawState map[string]interface{},
+				k string,
+			) error {
+				ph, ok := rawState["path_hashes"].(map[string]interface{})
+				if !ok {
+					// Missing or malformed, reported by trimPathHash
+					return trimPathHash(ctx, rawState, k)
+				}
+				for hk := range ph {
+					if isPathListKey(k, hk) {
+						err := trimPathHash(ctx, rawState, hk)
+						if err != nil {
+							return err
+						}
+					}
+				}
+				return nil
+			},
+		},
+	}
+}
@@ -0,0 +1,95 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package dschema_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
+)
+
+func TestPathListDSchema(t *testing.T) {
+	ctx := context.Background()
+
+	ds := map[string]DSchema{
+		"paths": &PathListDSchema{
+			Optional:      true,
+			GetFromConfig: true,
+		},
+	}
+
+	td, err := ioutil.TempDir("", "dschema_test")
+	if err != nil {
+		t.Skipf("ioutil.TempDir failed")
+	}
+	defer os.RemoveAll(td)
+	write := func(n string, c string) {
+		err := ioutil.WriteFile(filepath.Join(td, n), []byte(c), 0600)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	write("a.nix", "{ }")
+	write("b.nix", "{ }")
+
+	pd, diag := NewTestPD(ctx, t, ds, map[string]interface{}{})
+	rd := NewTestRD(t, ds, map[string]interface{}{
+		"paths": []interface{}{
+			filepath.Join(td, "a.nix"),
+			filepath.Join(td, "b.nix"),
+		},
+		"on_path_change": OnPathChangeError,
+	})
+	cg := &ConfigGetter{Ds: ds, Rd: rd, Pd: pd}
+	sg := &StateGetter{Ds: ds, Rd: rd, Pd: pd}
+
+	got, diag := cg.Get(ctx, "paths")
+	if diag.HasError() {
+		t.Fatalf("Get failed: %#v", diag)
+	}
+	expected := []string{
+		filepath.Join(td, "a.nix"),
+		filepath.Join(td, "b.nix"),
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %#v, but got %#v", expected, got)
+	}
+
+	diag = cg.SetAll(ctx)
+	if diag.HasError() {
+		t.Fatalf("Set failed: %#v", diag)
+	}
+	ph := rd.Get("path_hashes").(map[string]interface{})
+	for i := range expected {
+		if ph[PathListKey("paths", i)] == "" {
+			t.Errorf("no hash stored for path %d: %#v", i, ph)
+		}
+	}
+	_, diag = sg.Get(ctx, "paths")
+	if diag.HasError() {
+		t.Errorf("Check test failed: %#v", diag)
+	}
+
+	write("b.nix", "{ imports = [ ]; }")
+	_, diag = sg.Get(ctx, "paths")
+	if !diag.HasError() {
+		t.Errorf("Changed second path did not change hash")
+	}
+
+	rd.Set("paths", []interface{}{filepath.Join(td, "a.nix")})
+	diag = cg.SetAll(ctx)
+	if diag.HasError() {
+		t.Fatalf("Set failed: %#v", diag)
+	}
+	ph = rd.Get("path_hashes").(map[string]interface{})
+	if _, ok := ph[PathListKey("paths", 1)]; ok {
+		t.Errorf("hash of removed path kept: %#v", ph)
+	}
+}
@@ -7,6 +7,7 @@ package dschema_test
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -210,6 +211,55 @@ func TestPathDSchema(t *testing.T) {
 	}
 }
 
+func TestPathDSchemaProviderOnlyState(t *testing.T) {
+	ctx := context.Background()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Skipf("os.Getwd failed")
+	}
+	provider := map[string]interface{}{
+		"working_dir": filepath.Join(wd, "testdata", "d"),
+		"optional":    "file.txt",
+	}
+	// State without the path or its path_uses_provider_wd entry, as written
+	// by a version without the provider default
+	state := map[string]interface{}{
+		"path_uses_provider_wd": map[string]interface{}{},
+	}
+
+	ds := map[string]DSchema{
+		"optional": &PathDSchema{
+			Optional:           true,
+			HasProviderDefault: true,
+			SkipHashCheck:      true,
+		},
+	}
+	pd, d := NewTestPD(ctx, t, ds, provider)
+	if d.HasError() {
+		t.Fatalf("NewTestPD failed: %#v", d)
+	}
+	sg := &StateGetter{Ds: ds, Rd: NewTestRD(t, ds, state), Pd: pd}
+	got, d := sg.Get(ctx, "optional")
+	if d.HasError() {
+		t.Fatalf("Get failed: %#v", d)
+	}
+	expected := filepath.Join(wd, "testdata", "d", "file.txt")
+	if got != expected {
+		t.Errorf("expected %#v, but got %#v", expected, got)
+	}
+
+	// Without a provider default, the state is still required to record
+	// which working_dir the path used
+	ds = map[string]DSchema{
+		"optional": &PathDSchema{Optional: true, SkipHashCheck: true},
+	}
+	sg = &StateGetter{Ds: ds, Rd: NewTestRD(t, ds, state), Pd: pd}
+	_, d = sg.Get(ctx, "optional")
+	if !d.HasError() {
+		t.Errorf("missing path_uses_provider_wd entry accepted")
+	}
+}
+
 func TestHashPath(t *testing.T) {
 	ctx := context.Background()
 
@@ -258,6 +308,12 @@ func TestHashPath(t *testing.T) {
 
 	rd.Set("optional", file)
 	_, diag = sg.Get(ctx, "optional")
+	if diag.HasError() {
+		t.Errorf("Check file inside dir with on_path_change replace failed")
+	}
+
+	rd.Set("on_path_change", OnPathChangeError)
+	_, diag = sg.Get(ctx, "optional")
 	if !diag.HasError() {
 		t.Errorf("Check file inside dir failed")
 	}
@@ -272,3 +328,55 @@ func TestHashPath(t *testing.T) {
 		t.Errorf("Check test failed")
 	}
 }
+
+func TestHashPathIgnore(t *testing.T) {
+	ctx := context.Background()
+
+	ds := map[string]DSchema{
+		"optional": &PathDSchema{
+			GetFromConfig: true,
+		},
+	}
+
+	td, err := ioutil.TempDir("", "dschema_test")
+	if err != nil {
+		t.Skipf("ioutil.TempDir failed")
+	}
+	defer os.RemoveAll(td)
+	write := func(n string, c string) {
+		err := ioutil.WriteFile(filepath.Join(td, n), []byte(c), 0600)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	write("file.txt", "content")
+	write(".nixignore", "*.log\n")
+
+	pd, diag := NewTestPD(ctx, t, ds, map[string]interface{}{})
+	rd := NewTestRD(t, ds, map[string]interface{}{
+		"optional":          td,
+		"on_path_change":    OnPathChangeError,
+		"path_ignore":       []interface{}{"*.swp"},
+		"path_ignore_files": []interface{}{".nixignore"},
+	})
+	cg := &ConfigGetter{Ds: ds, Rd: rd, Pd: pd}
+	sg := &StateGetter{Ds: ds, Rd: rd, Pd: pd}
+
+	diag = cg.SetAll(ctx)
+	if diag.HasError() {
+		t.Fatalf("Set failed: %#v", diag)
+	}
+
+	write(".file.txt.swp", "swap")
+	write("build.log", "log")
+	_, diag = sg.Get(ctx, "optional")
+	if diag.HasError() {
+		t.Errorf("Ignored files changed hash: %#v", diag)
+	}
+
+	write("other.txt", "other")
+	_, diag = sg.Get(ctx, "optional")
+	if !diag.HasError() {
+		t.Errorf("Unignored file did not change hash")
+	}
+}
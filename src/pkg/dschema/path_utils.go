@@ -5,17 +5,13 @@
 package dschema
 
 import (
-	"bytes"
 	"context"
-	"fmt"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 
-	"github.com/leocp1/terraform-provider-packernix/src/pkg/logwriter"
-	"github.com/leocp1/terraform-provider-packernix/src/pkg/patches"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/nar"
 )
 
 // Prepend the working dir to a relative path
@@ -49,6 +45,11 @@ func normalizePath(p string) string {
 	}
 }
 
+// Normalize a path the way it is stored in the state
+func NormalizePath(p string) string {
+	return normalizePath(p)
+}
+
 // Normalize path before storage
 func pathStateFunc(pi interface{}) string {
 	p, ok := pi.(string)
@@ -58,28 +59,53 @@ func pathStateFunc(pi interface{}) string {
 	return normalizePath(p)
 }
 
-// Calculate a cryptographic hash of a path.
-// Implemented with the `nix-hash` command, since Nix is almost definitely
-// installed for users of this provider.
+// Calculate a cryptographic hash of a path, leaving out files excluded by f.
+// With a nil filter, equivalent to `nix-hash --type sha256 --base32`.
 func HashPath(
 	ctx context.Context,
 	path string,
+	f nar.Filter,
 ) (h string, err error) {
-	outb := &bytes.Buffer{}
-	cmd := exec.CommandContext(
-		ctx,
-		patches.NixHash(),
-		"--type", "sha256",
-		"--base32",
-		path,
-	)
-	cmd.Stdout = outb
-	cmd.Stderr = logwriter.New(fmt.Sprintf("[INFO] [nix-hash %s] ", path), nil)
-	err = cmd.Run()
+	return nar.HashPathFilter(path, f)
+}
+
+// Hash a path with the provider context if it is a PathHasher
+func hashPath(
+	ctx context.Context,
+	pd ProviderDefaulter,
+	path string,
+	f nar.Filter,
+) (string, error) {
+	var h string
+	var err error
+	ph, ok := pd.(PathHasher)
+	if ok {
+		h, err = ph.HashPath(ctx, path, f)
+	} else {
+		h, err = HashPath(ctx, path, f)
+	}
 	if err != nil {
-		return
+		return "", err
 	}
+	return h, nil
+}
 
-	h = outb.String()
+// Resolve a path set in the provider configuration against the provider
+// working_dir. Returns the empty string if unset.
+func ProviderPath(
+	pd ProviderDefaulter,
+	k string,
+) (p string, d diag.Diagnostics) {
+	dg := &defaultGetter{M: pd}
+	p, d = getPath(dg, k)
+	if p == "" || d.HasError() {
+		return
+	}
+	pwd, d0 := getPath(dg, "working_dir")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	p = readRelPath(p, pwd)
 	return
 }
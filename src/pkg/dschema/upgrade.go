@@ -0,0 +1,110 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package dschema
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+// A change to the format of attributes stored in the state
+type Migration struct {
+	// Schema version of the states the migration applies to
+	Version int
+	// Upgrade rawState from Version to Version+1. The last parameter is the
+	// key the DSchema was added under.
+	Upgrade func(context.Context, map[string]interface{}, string) error
+}
+
+// An interface that DSchemas can optionally implement to upgrade the attributes
+// they own in the states of resources.
+//
+// Migrations must never be removed or renumbered once released, since the
+// schema version of a resource is derived from them.
+type Migrator interface {
+	Migrations() []Migration
+}
+
+// The schema version of resources using ds: one more than the version of the
+// last migration of any DSchema, or 0 if there are none.
+func SchemaVersion(ds DSchemas) (v int) {
+	for _, s := range ds {
+		m, ok := s.(Migrator)
+		if !ok {
+			continue
+		}
+		for _, mi := range m.Migrations() {
+			if mi.Version+1 > v {
+				v = mi.Version + 1
+			}
+		}
+	}
+	return
+}
+
+// Generate StateUpgraders for a resource using ds, with one upgrader per
+// schema version below SchemaVersion(ds). ty is only used to read states
+// written by Terraform 0.11 and earlier, so the implied type of the current
+// schema is fine to pass.
+func StateUpgraders(ds DSchemas, ty cty.Type) (sus []schema.StateUpgrader) {
+	for v := 0; v < SchemaVersion(ds); v++ {
+		v := v
+		sus = append(sus, schema.StateUpgrader{
+			Version: v,
+			Type:    ty,
+			Upgrade: func(
+				ctx context.Context,
+				rawState map[string]interface{},
+				meta interface{},
+			) (map[string]interface{}, error) {
+				return UpgradeState(ctx, ds, v, rawState)
+			},
+		})
+	}
+	return
+}
+
+// Upgrade rawState from schema version v to v+1 by running the migrations of
+// every DSchema in ds for v. DSchemas are visited in key order.
+func UpgradeState(
+	ctx context.Context,
+	ds DSchemas,
+	v int,
+	rawState map[string]interface{},
+) (map[string]interface{}, error) {
+	if rawState == nil {
+		return rawState, nil
+	}
+	ks := make([]string, 0, len(ds))
+	for k := range ds {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	for _, k := range ks {
+		m, ok := ds[k].(Migrator)
+		if !ok {
+			continue
+		}
+		for _, mi := range m.Migrations() {
+			if mi.Version != v {
+				continue
+			}
+			err := mi.Upgrade(ctx, rawState, k)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"upgrading %s from schema version %d: %w",
+					k,
+					v,
+					err,
+				)
+			}
+		}
+	}
+	return rawState, nil
+}
@@ -0,0 +1,96 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package dschema_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
+)
+
+func readState(t *testing.T, name string) (m map[string]interface{}) {
+	b, err := ioutil.ReadFile(filepath.Join("testdata", "state", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestStateUpgraders(t *testing.T) {
+	ctx := context.Background()
+
+	ds := DSchemas{
+		"path": &PathDSchema{
+			Required: true,
+		},
+		"state": StringDSchema(false, func() *schema.Schema {
+			return &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
+			}
+		}),
+		"working_dir": &WDDSchema{},
+	}
+	if v := SchemaVersion(ds); v != 1 {
+		t.Fatalf("SchemaVersion: expected 1, got %d", v)
+	}
+	if v := SchemaVersion(DSchemas{"working_dir": &WDDSchema{}}); v != 0 {
+		t.Fatalf("SchemaVersion without migrations: expected 0, got %d", v)
+	}
+
+	sus := StateUpgraders(ds, cty.EmptyObject)
+	if len(sus) != 1 || sus[0].Version != 0 {
+		t.Fatalf("expected a single upgrader from version 0, got %#v", sus)
+	}
+
+	got, err := sus[0].Upgrade(ctx, readState(t, "v0.json"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := readState(t, "v1.json")
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %#v, got %#v", expected, got)
+	}
+
+	// Upgrading an upgraded state is harmless
+	got, err = sus[0].Upgrade(ctx, got, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("second upgrade: expected %#v, got %#v", expected, got)
+	}
+
+	// States without hashes are left alone
+	noHashes := map[string]interface{}{"path": "/bin"}
+	got, err = sus[0].Upgrade(ctx, noHashes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, map[string]interface{}{"path": "/bin"}) {
+		t.Errorf("state without hashes changed: %#v", got)
+	}
+
+	_, err = sus[0].Upgrade(
+		ctx,
+		map[string]interface{}{"path_hashes": "not a map"},
+		nil,
+	)
+	if err == nil {
+		t.Errorf("expected an error for malformed path_hashes")
+	}
+}
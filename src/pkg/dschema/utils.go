@@ -102,6 +102,23 @@ func getBool(dg dataGetter, k string) (b bool, d diag.Diagnostics) {
 	return
 }
 
+// Quick cast to int
+func getInt(dg dataGetter, k string) (i int, d diag.Diagnostics) {
+	ii := dg.Get(k)
+	if ii == nil {
+		return
+	}
+	i, ok := ii.(int)
+	if !ok {
+		d = append(d, diag.Diagnostic{
+			Severity:      diag.Error,
+			AttributePath: cty.GetAttrPath(k),
+			Summary:       "Provider error: not an int",
+		})
+	}
+	return
+}
+
 // Quick cast to string check
 func getString(dg dataGetter, k string) (v string, d diag.Diagnostics) {
 	vi := dg.Get(k)
@@ -5,16 +5,45 @@
 // Immediately fail if we attempt to write to a file that has been "locked".
 //
 // This is mainly intended as a sanity check against build_path being set to the
-// same directory for different resources
+// same directory for different resources. Paths are considered the same if one
+// is equal to or nested inside the other.
+//
+// Within a process, locks are tracked in memory. Across processes (e.g. two
+// `terraform apply` runs sharing a build_path), locks are backed by advisory
+// flock(2) locks on files in LockDir, named after the hash of the locked path.
+// To detect nesting across processes, a shared lock is also taken on the lock
+// file of every ancestor of the path. Lock files are never removed, since
+// removing them would race with other processes.
 package faillock
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 )
 
+// How often to retry a blocking lock
+var PollInterval = 100 * time.Millisecond
+
+// Directory holding the lock files. Shared by every process of the user.
+var LockDir = defaultLockDir()
+
+func defaultLockDir() string {
+	d, err := os.UserCacheDir()
+	if err != nil {
+		d = filepath.Join(os.TempDir(), fmt.Sprintf("%d", os.Getuid()))
+	}
+	return filepath.Join(d, "terraform-provider-packernix", "locks")
+}
+
 type Faillock struct {
 	l sync.Mutex
 	s map[string]struct{}
@@ -30,36 +59,150 @@ func New() *Faillock {
 type Unlocker struct {
 	fl *Faillock
 	p  string
+	fs []*os.File
 }
 
 func (ul *Unlocker) Unlock() {
 	ul.fl.l.Lock()
 	defer ul.fl.l.Unlock()
+	for _, f := range ul.fs {
+		funlock(f)
+		f.Close()
+	}
+	ul.fs = nil
 	delete(ul.fl.s, ul.p)
 }
 
+// Lock file for a path
+func LockFile(p string) string {
+	h := sha256.Sum256([]byte(p))
+	return filepath.Join(LockDir, hex.EncodeToString(h[:])+".lock")
+}
+
+// True if a is b or one contains the other
+func overlaps(a string, b string) bool {
+	if a == b {
+		return true
+	}
+	sep := string(filepath.Separator)
+	return strings.HasPrefix(a, strings.TrimSuffix(b, sep)+sep) ||
+		strings.HasPrefix(b, strings.TrimSuffix(a, sep)+sep)
+}
+
+func conflictDiag(p string, o string) diag.Diagnostics {
+	var s string
+	if p == o {
+		s = fmt.Sprintf("Multiple resources attempted to write to %s", p)
+	} else {
+		s = fmt.Sprintf(
+			"Multiple resources attempted to write to %s and %s",
+			p,
+			o,
+		)
+	}
+	return diag.Diagnostics{
+		diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  s,
+		},
+	}
+}
+
+// Take the file locks for p. Returns the opened files, or the path that
+// conflicted.
+func lockFiles(p string) (fs []*os.File, conflict string, err error) {
+	unwind := func() {
+		for _, f := range fs {
+			funlock(f)
+			f.Close()
+		}
+		fs = nil
+	}
+
+	err = os.MkdirAll(LockDir, 0700)
+	if err != nil {
+		return
+	}
+	// The path takes an exclusive lock, and its ancestors shared ones
+	exclusive := true
+	for a := p; ; a = filepath.Dir(a) {
+		var f *os.File
+		f, err = os.OpenFile(LockFile(a), os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			unwind()
+			return
+		}
+		fs = append(fs, f)
+		var ok bool
+		ok, err = flock(f, exclusive)
+		if err != nil || !ok {
+			conflict = a
+			unwind()
+			return
+		}
+		exclusive = false
+		if filepath.Dir(a) == a {
+			break
+		}
+	}
+	return
+}
+
 // Attempt to lock a path. Returns a struct used to unlock the path if
 // successful
 func (fl *Faillock) TryLock(
 	p string,
 ) (ul *Unlocker, d diag.Diagnostics) {
+	ap, err := filepath.Abs(p)
+	if err != nil {
+		return nil, diag.FromErr(err)
+	}
+	ap = filepath.Clean(ap)
+
 	fl.l.Lock()
 	defer fl.l.Unlock()
-	_, ok := fl.s[p]
-	if ok {
-		d = append(d, diag.Diagnostic{
-			Severity: diag.Error,
-			Summary: fmt.Sprintf(
-				"Multiple resources attempted to write to %s",
-				p,
-			),
-		})
-	} else {
-		fl.s[p] = struct{}{}
-		ul = &Unlocker{
-			fl: fl,
-			p:  p,
+	for o := range fl.s {
+		if overlaps(ap, o) {
+			return nil, conflictDiag(ap, o)
 		}
 	}
+
+	fs, conflict, err := lockFiles(ap)
+	if err != nil {
+		return nil, diag.FromErr(err)
+	}
+	if conflict != "" {
+		d = conflictDiag(ap, conflict)
+		d[0].Detail = "The path is locked by another process"
+		return
+	}
+
+	fl.s[ap] = struct{}{}
+	ul = &Unlocker{
+		fl: fl,
+		p:  ap,
+		fs: fs,
+	}
 	return
 }
+
+// Lock a path, waiting up to timeout for other holders to unlock it.
+// A timeout of zero behaves like TryLock.
+func (fl *Faillock) Lock(
+	ctx context.Context,
+	p string,
+	timeout time.Duration,
+) (ul *Unlocker, d diag.Diagnostics) {
+	deadline := time.Now().Add(timeout)
+	for {
+		ul, d = fl.TryLock(p)
+		if !d.HasError() || !time.Now().Before(deadline) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(PollInterval):
+		}
+	}
+}
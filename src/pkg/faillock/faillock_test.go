@@ -5,25 +5,142 @@
 package faillock_test
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	. "github.com/leocp1/terraform-provider-packernix/src/pkg/faillock"
 )
 
+func tempDir(t *testing.T) string {
+	t.Helper()
+	td, err := ioutil.TempDir("", "faillock_test")
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	LockDir = filepath.Join(td, "locks")
+	return td
+}
+
 func TestFaillock(t *testing.T) {
+	td := tempDir(t)
+	defer os.RemoveAll(td)
+	p := filepath.Join(td, "faillock.go")
+
 	fl := New()
-	ul, d := fl.TryLock("./faillock.go")
+	ul, d := fl.TryLock(p)
 	if d.HasError() {
 		t.Fatalf("Locking from new faillock failed")
 	}
-	_, d = fl.TryLock("./faillock.go")
+	_, d = fl.TryLock(p)
 	if !d.HasError() {
 		t.Fatalf("Locking a locked file succeeded")
 	}
 	ul.Unlock()
-	ul, d = fl.TryLock("./faillock.go")
+	ul, d = fl.TryLock(p)
 	if d.HasError() {
 		t.Fatalf("Locking a unlocked file failed")
 	}
 	ul.Unlock()
 }
+
+func TestFaillockNested(t *testing.T) {
+	td := tempDir(t)
+	defer os.RemoveAll(td)
+	outer := filepath.Join(td, "build")
+	inner := filepath.Join(outer, "nested")
+	sibling := filepath.Join(td, "build2")
+
+	fl := New()
+	ul, d := fl.TryLock(outer)
+	if d.HasError() {
+		t.Fatalf("Locking outer path failed: %#v", d)
+	}
+	_, d = fl.TryLock(inner)
+	if !d.HasError() {
+		t.Errorf("Locking nested path succeeded")
+	}
+	sul, d := fl.TryLock(sibling)
+	if d.HasError() {
+		t.Errorf("Locking sibling with common prefix failed: %#v", d)
+	} else {
+		sul.Unlock()
+	}
+	ul.Unlock()
+
+	ul, d = fl.TryLock(inner)
+	if d.HasError() {
+		t.Fatalf("Locking inner path failed: %#v", d)
+	}
+	_, d = fl.TryLock(outer)
+	if !d.HasError() {
+		t.Errorf("Locking parent of locked path succeeded")
+	}
+	ul.Unlock()
+}
+
+// Separate Faillocks only share flock(2) locks, like separate processes
+func TestFaillockFile(t *testing.T) {
+	if _, err := os.Stat("/proc"); err != nil {
+		if _, err := os.Stat("/System"); err != nil {
+			t.Skip("flock(2) not supported")
+		}
+	}
+	ctx := context.Background()
+	td := tempDir(t)
+	defer os.RemoveAll(td)
+	outer := filepath.Join(td, "build")
+	inner := filepath.Join(outer, "nested")
+
+	fl1 := New()
+	fl2 := New()
+	ul, d := fl1.TryLock(outer)
+	if d.HasError() {
+		t.Fatalf("Locking failed: %#v", d)
+	}
+	_, d = fl2.TryLock(outer)
+	if !d.HasError() {
+		t.Errorf("Locking path locked by other faillock succeeded")
+	}
+	_, d = fl2.TryLock(inner)
+	if !d.HasError() {
+		t.Errorf("Locking nested path locked by other faillock succeeded")
+	}
+
+	_, d = fl2.Lock(ctx, outer, 10*time.Millisecond)
+	if !d.HasError() {
+		t.Errorf("Blocking lock did not time out")
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ul.Unlock()
+	}()
+	ul2, d := fl2.Lock(ctx, outer, 10*time.Second)
+	if d.HasError() {
+		t.Fatalf("Blocking lock failed: %#v", d)
+	}
+
+	ul2.Unlock()
+
+	// Nesting is detected in reverse, even for paths never locked before
+	outer = filepath.Join(td, "build2")
+	inner = filepath.Join(outer, "nested")
+	ul, d = fl1.TryLock(inner)
+	if d.HasError() {
+		t.Fatalf("Locking inner path failed: %#v", d)
+	}
+	_, d = fl2.TryLock(outer)
+	if !d.HasError() {
+		t.Errorf("Locking parent of path locked by other faillock succeeded")
+	}
+	ul.Unlock()
+
+	// Lock files are kept out of the locked paths
+	if _, err := os.Stat(outer); !os.IsNotExist(err) {
+		t.Errorf("Locking created %s", outer)
+	}
+}
@@ -0,0 +1,266 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Filtering of directory trees with gitignore patterns.
+//
+// Supports the syntax described in gitignore(5): comments, negation with "!",
+// directory only patterns with a trailing "/", anchoring with a leading or
+// inner "/", and the "*", "?", "[...]" and "**" wildcards.
+package ignore
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type pattern struct {
+	// slash separated directory the pattern is relative to
+	base    string
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Convert a glob to a regular expression. Wildcards do not match "/".
+func globToRegexp(g string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(g); i++ {
+		c := g[i]
+		switch c {
+		case '*':
+			if i+1 < len(g) && g[i+1] == '*' {
+				atStart := i == 0 || g[i-1] == '/'
+				switch {
+				case atStart && i+2 < len(g) && g[i+2] == '/':
+					// "**/" matches zero or more directories
+					b.WriteString("(?:.*/)?")
+					i += 2
+				case atStart && i+2 == len(g):
+					// trailing "/**" matches everything inside
+					b.WriteString(".*")
+					i++
+				default:
+					b.WriteString("[^/]*")
+					i++
+				}
+				continue
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			j := i + 1
+			if j < len(g) && (g[j] == '!' || g[j] == '^') {
+				j++
+			}
+			if j < len(g) && g[j] == ']' {
+				j++
+			}
+			for j < len(g) && g[j] != ']' {
+				j++
+			}
+			if j >= len(g) {
+				return "", fmt.Errorf("unterminated character class in %q", g)
+			}
+			class := g[i+1 : j]
+			b.WriteByte('[')
+			if class[0] == '!' || class[0] == '^' {
+				b.WriteByte('^')
+				class = class[1:]
+			}
+			b.WriteString(strings.Replace(class, `\`, `\\`, -1))
+			b.WriteByte(']')
+			i = j
+		case '\\':
+			if i+1 == len(g) {
+				return "", fmt.Errorf("trailing backslash in %q", g)
+			}
+			i++
+			b.WriteString(regexp.QuoteMeta(string(g[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String(), nil
+}
+
+// Trim unescaped trailing spaces
+func trimTrailingSpace(l string) string {
+	for strings.HasSuffix(l, " ") && !strings.HasSuffix(l, `\ `) {
+		l = l[:len(l)-1]
+	}
+	return l
+}
+
+// Parse a line of a gitignore file. Returns nil for blank lines and comments.
+func parse(base string, l string) (*pattern, error) {
+	l = trimTrailingSpace(strings.TrimSuffix(l, "\r"))
+	if l == "" || strings.HasPrefix(l, "#") {
+		return nil, nil
+	}
+	p := &pattern{base: base}
+	if strings.HasPrefix(l, "!") {
+		p.negate = true
+		l = l[1:]
+	}
+	if strings.HasSuffix(l, "/") {
+		p.dirOnly = true
+		l = strings.TrimRight(l, "/")
+	}
+	if l == "" {
+		return nil, nil
+	}
+	anchored := strings.Contains(l, "/")
+	l = strings.TrimPrefix(l, "/")
+	r, err := globToRegexp(l)
+	if err != nil {
+		return nil, err
+	}
+	if !anchored {
+		r = "(?:.*/)?" + r
+	}
+	p.re, err = regexp.Compile("^" + r + "$")
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Check that a string is a valid gitignore pattern
+func ValidPattern(l string) error {
+	_, err := parse("", l)
+	return err
+}
+
+func (p *pattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.base != "" {
+		if !strings.HasPrefix(rel, p.base+"/") {
+			return false
+		}
+		rel = rel[len(p.base)+1:]
+	}
+	return p.re.MatchString(rel)
+}
+
+// Decides which files of a directory tree are included.
+//
+// Patterns passed to New have the lowest precedence, followed by the ignore
+// files of each directory from the root down. As in git, the last matching
+// pattern wins, and the contents of an ignored directory are never included.
+type Matcher struct {
+	root     string
+	files    []string
+	patterns []*pattern
+	// patterns loaded from ignore files, keyed by slash separated directory
+	dirs map[string][]*pattern
+	// contents of loaded ignore files, keyed by slash separated path
+	sources map[string][]byte
+}
+
+// Create a Matcher for the tree at root. files are the names of ignore files
+// (like ".gitignore") to read from each directory.
+func New(root string, patterns []string, files []string) (*Matcher, error) {
+	m := &Matcher{
+		root:    root,
+		files:   files,
+		dirs:    map[string][]*pattern{},
+		sources: map[string][]byte{},
+	}
+	for _, l := range patterns {
+		p, err := parse("", l)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			m.patterns = append(m.patterns, p)
+		}
+	}
+	return m, nil
+}
+
+// Load the patterns of the ignore files in a directory
+func (m *Matcher) load(dir string) ([]*pattern, error) {
+	ps, ok := m.dirs[dir]
+	if ok {
+		return ps, nil
+	}
+	for _, f := range m.files {
+		rel := path.Join(dir, f)
+		b, err := ioutil.ReadFile(filepath.Join(m.root, filepath.FromSlash(rel)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.sources[rel] = b
+		for _, l := range strings.Split(string(b), "\n") {
+			p, err := parse(dir, l)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", rel, err)
+			}
+			if p != nil {
+				ps = append(ps, p)
+			}
+		}
+	}
+	m.dirs[dir] = ps
+	return ps, nil
+}
+
+// Report if the file at the slash separated path rel should be included
+func (m *Matcher) Include(rel string, fi os.FileInfo) (bool, error) {
+	ignored := false
+	check := func(ps []*pattern) {
+		for _, p := range ps {
+			if p.match(rel, fi.IsDir()) {
+				ignored = !p.negate
+			}
+		}
+	}
+	check(m.patterns)
+	if len(m.files) > 0 {
+		dirs := []string{""}
+		parts := strings.Split(rel, "/")
+		for i := 1; i < len(parts); i++ {
+			dirs = append(dirs, strings.Join(parts[:i], "/"))
+		}
+		for _, dir := range dirs {
+			ps, err := m.load(dir)
+			if err != nil {
+				return false, err
+			}
+			check(ps)
+		}
+	}
+	return !ignored, nil
+}
+
+// A string identifying the patterns and the ignore files read so far
+func (m *Matcher) Key() string {
+	h := sha256.New()
+	for _, p := range m.patterns {
+		fmt.Fprintf(h, "%q %v %v\n", p.re.String(), p.negate, p.dirOnly)
+	}
+	srcs := make([]string, 0, len(m.sources))
+	for s := range m.sources {
+		srcs = append(srcs, s)
+	}
+	sort.Strings(srcs)
+	for _, s := range srcs {
+		fmt.Fprintf(h, "%q %d\n", s, len(m.sources[s]))
+		h.Write(m.sources[s])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
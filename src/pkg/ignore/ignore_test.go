@@ -0,0 +1,146 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ignore_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/ignore"
+)
+
+type fakeInfo struct {
+	dir bool
+}
+
+func (fi fakeInfo) Name() string       { return "" }
+func (fi fakeInfo) Size() int64        { return 0 }
+func (fi fakeInfo) Mode() os.FileMode  { return 0 }
+func (fi fakeInfo) ModTime() time.Time { return time.Time{} }
+func (fi fakeInfo) IsDir() bool        { return fi.dir }
+func (fi fakeInfo) Sys() interface{}   { return nil }
+
+func TestPatterns(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		rel      string
+		dir      bool
+		expected bool
+	}{
+		{"empty", nil, "a", false, true},
+		{"comment", []string{"# a"}, "a", false, true},
+		{"name", []string{"a"}, "a", false, false},
+		{"name nested", []string{"a"}, "b/a", false, false},
+		{"name prefix", []string{"a"}, "ab", false, true},
+		{"star", []string{"*.swp"}, "b/.a.swp", false, false},
+		{"star no slash", []string{"b*c"}, "b/c", false, true},
+		{"question", []string{"?.txt"}, "a.txt", false, false},
+		{"class", []string{"[ab].txt"}, "b.txt", false, false},
+		{"negated class", []string{"[!ab].txt"}, "b.txt", false, true},
+		{"anchored", []string{"/a"}, "b/a", false, true},
+		{"anchored root", []string{"/a"}, "a", false, false},
+		{"inner slash", []string{"b/a"}, "b/a", false, false},
+		{"inner slash nested", []string{"b/a"}, "c/b/a", false, true},
+		{"dir only file", []string{"result/"}, "result", false, true},
+		{"dir only dir", []string{"result/"}, "result", true, false},
+		{"leading double star", []string{"**/a"}, "b/c/a", false, false},
+		{"trailing double star", []string{"b/**"}, "b/c/a", false, false},
+		{"inner double star", []string{"b/**/a"}, "b/a", false, false},
+		{"inner double star deep", []string{"b/**/a"}, "b/c/d/a", false, false},
+		{"negation", []string{"*.txt", "!a.txt"}, "a.txt", false, true},
+		{"last match wins", []string{"!a.txt", "*.txt"}, "a.txt", false, false},
+		{"escaped", []string{`\!a`}, "!a", false, false},
+		{"trailing space", []string{"a  "}, "a", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New("", tt.patterns, nil)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			got, err := m.Include(tt.rel, fakeInfo{dir: tt.dir})
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if got != tt.expected {
+				t.Errorf("expected %#v, but got %#v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestValidPattern(t *testing.T) {
+	if ValidPattern("[a") == nil {
+		t.Errorf("unterminated class accepted")
+	}
+	if ValidPattern("a/**/b") != nil {
+		t.Errorf("valid pattern rejected")
+	}
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	td, err := ioutil.TempDir("", "ignore_test")
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	defer os.RemoveAll(td)
+	err = os.MkdirAll(filepath.Join(td, "sub"), 0700)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	files := map[string]string{
+		".gitignore":     "*.log\n/build\n",
+		"sub/.nixignore": "!keep.log\n",
+	}
+	for f, c := range files {
+		err = ioutil.WriteFile(filepath.Join(td, f), []byte(c), 0600)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	m, err := New(td, []string{"*.tmp"}, []string{".gitignore", ".nixignore"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tests := []struct {
+		rel      string
+		dir      bool
+		expected bool
+	}{
+		{"a.log", false, false},
+		{"build", true, false},
+		{"sub/build", true, true},
+		{"sub/a.log", false, false},
+		{"sub/keep.log", false, true},
+		{"sub/a.tmp", false, false},
+		{"sub/a.txt", false, true},
+	}
+	for _, tt := range tests {
+		got, err := m.Include(tt.rel, fakeInfo{dir: tt.dir})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if got != tt.expected {
+			t.Errorf("%s: expected %#v, but got %#v", tt.rel, tt.expected, got)
+		}
+	}
+
+	m2, err := New(td, []string{"*.tmp"}, []string{".gitignore"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, err = m2.Include("sub/keep.log", fakeInfo{})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if m.Key() == m2.Key() {
+		t.Errorf("key does not depend on loaded ignore files")
+	}
+}
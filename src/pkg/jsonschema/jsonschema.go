@@ -0,0 +1,210 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Validate decoded JSON values against the subset of JSON Schema produced by
+// nixos/lib/option-schema.nix
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+type Schema struct {
+	Type                 string             `json:"type,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+
+	// Set for the boolean schema false, which matches nothing
+	never bool
+}
+
+type schemaFields Schema
+
+// Also accept the boolean schemas true and false
+func (s *Schema) UnmarshalJSON(b []byte) error {
+	switch string(bytes.TrimSpace(b)) {
+	case "true":
+		*s = Schema{}
+		return nil
+	case "false":
+		*s = Schema{never: true}
+		return nil
+	}
+	return json.Unmarshal(b, (*schemaFields)(s))
+}
+
+func (s *Schema) MarshalJSON() ([]byte, error) {
+	if s.never {
+		return []byte("false"), nil
+	}
+	return json.Marshal((*schemaFields)(s))
+}
+
+// A value not matching a schema
+type Error struct {
+	// Object keys (string) and array indices (int) leading to the value
+	Path    []interface{}
+	Message string
+}
+
+// Path in jq syntax, like .users[0].name
+func (e *Error) PathString() string {
+	var b strings.Builder
+	for _, p := range e.Path {
+		switch p := p.(type) {
+		case int:
+			fmt.Fprintf(&b, "[%d]", p)
+		case string:
+			fmt.Fprintf(&b, ".%s", p)
+		}
+	}
+	if b.Len() == 0 {
+		return "."
+	}
+	return b.String()
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.PathString(), e.Message)
+}
+
+// Name of the JSON type of a value decoded by encoding/json
+func typeOf(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// What the schema expects, for error messages
+func (s *Schema) expected() string {
+	if s.Description != "" {
+		return s.Description
+	}
+	if s.Type != "" {
+		return s.Type
+	}
+	return "a different value"
+}
+
+// Check a value decoded by encoding/json. Returns one error per mismatched
+// value, with object keys visited in sorted order.
+func (s *Schema) Validate(v interface{}) (errs []*Error) {
+	s.validate(v, nil, &errs)
+	return
+}
+
+func (s *Schema) validate(v interface{}, path []interface{}, errs *[]*Error) {
+	fail := func(format string, a ...interface{}) {
+		*errs = append(*errs, &Error{
+			Path:    append([]interface{}{}, path...),
+			Message: fmt.Sprintf(format, a...),
+		})
+	}
+
+	if s.never {
+		fail("not allowed")
+		return
+	}
+
+	if s.Type != "" {
+		t := typeOf(v)
+		if t != s.Type && !(s.Type == "number" && t == "integer") {
+			fail("expected %s, got %s", s.expected(), t)
+			return
+		}
+	}
+
+	if len(s.Enum) != 0 {
+		found := false
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			b, _ := json.Marshal(s.Enum)
+			fail("expected one of %s", string(b))
+			return
+		}
+	}
+
+	if len(s.AnyOf) != 0 {
+		matched := false
+		for _, as := range s.AnyOf {
+			var aerrs []*Error
+			as.validate(v, path, &aerrs)
+			if len(aerrs) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("expected %s, got %s", s.expected(), typeOf(v))
+			return
+		}
+	}
+
+	switch v := v.(type) {
+	case []interface{}:
+		if s.Items != nil {
+			for i, e := range v {
+				s.Items.validate(e, append(path, i), errs)
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ps, ok := s.Properties[k]
+			if !ok {
+				ps = s.AdditionalProperties
+			}
+			if ps == nil {
+				continue
+			}
+			if ps.never {
+				*errs = append(*errs, &Error{
+					Path:    append(append([]interface{}{}, path...), k),
+					Message: "unknown key",
+				})
+				continue
+			}
+			ps.validate(v[k], append(path, k), errs)
+		}
+	}
+}
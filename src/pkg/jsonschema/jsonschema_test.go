@@ -0,0 +1,123 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package jsonschema_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/jsonschema"
+)
+
+// As produced by nixos/lib/option-schema.nix for
+//
+//	types.submodule {
+//	  options.hostName = mkOption { type = types.str; };
+//	  options.ports = mkOption { type = types.listOf types.port; };
+//	  options.role = mkOption { type = types.nullOr (types.enum [ "web" ]); };
+//	  options.labels = mkOption { type = types.attrsOf types.str; };
+//	}
+const testSchema = `{
+  "type": "object",
+  "description": "submodule",
+  "additionalProperties": false,
+  "properties": {
+    "hostName": {"type": "string", "description": "string"},
+    "ports": {
+      "type": "array",
+      "description": "list of 16 bit unsigned integer; between 0 and 65535 (both inclusive)s",
+      "items": {"type": "integer", "description": "16 bit unsigned integer; between 0 and 65535 (both inclusive)"}
+    },
+    "role": {
+      "description": "null or one of \"web\"",
+      "anyOf": [{"type": "null"}, {"enum": ["web"], "description": "one of \"web\""}]
+    },
+    "labels": {
+      "type": "object",
+      "description": "attribute set of strings",
+      "additionalProperties": {"type": "string", "description": "string"}
+    }
+  }
+}`
+
+func TestValidate(t *testing.T) {
+	s := &Schema{}
+	err := json.Unmarshal([]byte(testSchema), s)
+	if err != nil {
+		t.Fatalf("could not parse schema: %s", err.Error())
+	}
+
+	ts := []struct {
+		name     string
+		value    string
+		expected []string
+	}{
+		{
+			name:  "valid",
+			value: `{"hostName": "a", "ports": [22, 80], "role": "web", "labels": {"a": "b"}}`,
+		},
+		{
+			name:  "null",
+			value: `{"role": null}`,
+		},
+		{
+			name:     "unknown key",
+			value:    `{"hostname": "a"}`,
+			expected: []string{".hostname: unknown key"},
+		},
+		{
+			name:  "wrong types",
+			value: `{"hostName": 1, "ports": [22, "80", 1.5], "labels": {"a": true}}`,
+			expected: []string{
+				".hostName: expected string, got integer",
+				".labels.a: expected string, got boolean",
+				".ports[1]: expected 16 bit unsigned integer; between 0 and 65535 (both inclusive), got string",
+				".ports[2]: expected 16 bit unsigned integer; between 0 and 65535 (both inclusive), got number",
+			},
+		},
+		{
+			name:     "enum",
+			value:    `{"role": "db"}`,
+			expected: []string{`.role: expected null or one of "web", got string`},
+		},
+		{
+			name:     "not an object",
+			value:    `[]`,
+			expected: []string{".: expected submodule, got array"},
+		},
+	}
+	for _, tt := range ts {
+		t.Run(tt.name, func(t *testing.T) {
+			var v interface{}
+			err := json.Unmarshal([]byte(tt.value), &v)
+			if err != nil {
+				t.Fatalf("could not parse value: %s", err.Error())
+			}
+			var got []string
+			for _, e := range s.Validate(v) {
+				got = append(got, e.Error())
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %#v, but got %#v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestMarshalBooleanSchema(t *testing.T) {
+	s := &Schema{}
+	err := json.Unmarshal([]byte(`{"additionalProperties": false}`), s)
+	if err != nil {
+		t.Fatalf("could not parse schema: %s", err.Error())
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("could not encode schema: %s", err.Error())
+	}
+	if string(b) != `{"additionalProperties":false}` {
+		t.Errorf("expected false schema, but got %s", string(b))
+	}
+}
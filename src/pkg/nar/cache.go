@@ -0,0 +1,126 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package nar
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type cacheEntry struct {
+	fingerprint [sha256.Size]byte
+	hash        string
+}
+
+// Cache of path hashes.
+//
+// Before a cached hash is reused, the path, size, modification time, inode and
+// mode of every file in the tree are compared against the values seen when the
+// hash was computed. This only requires stat calls, so unchanged trees are not
+// read again.
+type Cache struct {
+	l sync.Mutex
+	m map[string]cacheEntry
+}
+
+func NewCache() *Cache {
+	return &Cache{
+		m: map[string]cacheEntry{},
+	}
+}
+
+func fingerprintNode(h hash.Hash, p string, rel string, flt Filter) error {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	var b [8]byte
+	h.Write([]byte(rel))
+	h.Write([]byte{0})
+	binary.LittleEndian.PutUint64(b[:], uint64(fi.Mode()))
+	h.Write(b[:])
+	binary.LittleEndian.PutUint64(b[:], uint64(fi.Size()))
+	h.Write(b[:])
+	binary.LittleEndian.PutUint64(b[:], uint64(fi.ModTime().UnixNano()))
+	h.Write(b[:])
+	binary.LittleEndian.PutUint64(b[:], inode(fi))
+	h.Write(b[:])
+	if fi.IsDir() {
+		names, err := readDirNames(p, rel, flt)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			err = fingerprintNode(
+				h,
+				filepath.Join(p, n),
+				joinRel(rel, n),
+				flt,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func fingerprint(p string, flt Filter) (f [sha256.Size]byte, err error) {
+	h := sha256.New()
+	err = fingerprintNode(h, p, "", flt)
+	if err != nil {
+		return
+	}
+	copy(f[:], h.Sum(nil))
+	return
+}
+
+// HashPath, reusing previous results for unchanged trees
+func (c *Cache) HashPath(p string) (string, error) {
+	return c.HashPathFilter(p, nil)
+}
+
+// HashPathFilter, reusing previous results for unchanged trees.
+//
+// Only entries included by the filter are compared. The filter's Key is read
+// after the tree is walked, so it can cover any state the filter loaded from
+// the tree, like ignore files.
+func (c *Cache) HashPathFilter(p string, flt Filter) (string, error) {
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	f, err := fingerprint(p, flt)
+	if err != nil {
+		return "", err
+	}
+	k := p
+	if flt != nil {
+		k += "\x00" + flt.Key()
+	}
+	c.l.Lock()
+	e, ok := c.m[k]
+	c.l.Unlock()
+	if ok && e.fingerprint == f {
+		return e.hash, nil
+	}
+
+	h, err := HashPathFilter(p, flt)
+	if err != nil {
+		return "", err
+	}
+	// Only cache if nothing changed while hashing
+	f2, err := fingerprint(p, flt)
+	if err == nil && f2 == f {
+		c.l.Lock()
+		c.m[k] = cacheEntry{fingerprint: f, hash: h}
+		c.l.Unlock()
+	}
+	return h, nil
+}
@@ -0,0 +1,229 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Nix archive (NAR) serialization and hashing.
+//
+// Produces the same hashes as `nix-hash --type sha256 --base32`, without
+// needing Nix installed.
+package nar
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Nix's base32 alphabet. Omits e, o, u, and t.
+const base32Chars = "0123456789abcdfghijklmnpqrsvwxyz"
+
+// Encode bytes with Nix's base32 encoding
+func Base32(b []byte) string {
+	n := (len(b)*8-1)/5 + 1
+	out := make([]byte, 0, n)
+	for i := n - 1; i >= 0; i-- {
+		bit := i * 5
+		j := bit / 8
+		k := uint(bit % 8)
+		c := b[j] >> k
+		if j+1 < len(b) {
+			c |= b[j+1] << (8 - k)
+		}
+		out = append(out, base32Chars[c&0x1f])
+	}
+	return string(out)
+}
+
+// Decides which entries of a directory tree are serialized
+type Filter interface {
+	// Report if the entry at the slash separated path rel, relative to the
+	// root of the tree, should be included
+	Include(rel string, fi os.FileInfo) (bool, error)
+	// A string identifying the filter's behavior, used in cache keys
+	Key() string
+}
+
+type narWriter struct {
+	w   io.Writer
+	f   Filter
+	err error
+}
+
+var padding [8]byte
+
+func (nw *narWriter) write(b []byte) {
+	if nw.err != nil {
+		return
+	}
+	_, nw.err = nw.w.Write(b)
+}
+
+func (nw *narWriter) writeLen(n uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], n)
+	nw.write(b[:])
+}
+
+func (nw *narWriter) writePad(n uint64) {
+	if n%8 != 0 {
+		nw.write(padding[:8-n%8])
+	}
+}
+
+func (nw *narWriter) str(s string) {
+	nw.writeLen(uint64(len(s)))
+	nw.write([]byte(s))
+	nw.writePad(uint64(len(s)))
+}
+
+func (nw *narWriter) contents(p string, size int64) {
+	if nw.err != nil {
+		return
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		nw.err = err
+		return
+	}
+	defer f.Close()
+	nw.writeLen(uint64(size))
+	if nw.err != nil {
+		return
+	}
+	n, err := io.Copy(nw.w, f)
+	if err != nil {
+		nw.err = err
+		return
+	}
+	if n != size {
+		nw.err = fmt.Errorf("%s changed size while reading", p)
+		return
+	}
+	nw.writePad(uint64(size))
+}
+
+func (nw *narWriter) dump(p string, rel string) {
+	if nw.err != nil {
+		return
+	}
+	fi, err := os.Lstat(p)
+	if err != nil {
+		nw.err = err
+		return
+	}
+	nw.str("(")
+	nw.str("type")
+	switch m := fi.Mode(); {
+	case m.IsRegular():
+		nw.str("regular")
+		if m&0100 != 0 {
+			nw.str("executable")
+			nw.str("")
+		}
+		nw.str("contents")
+		nw.contents(p, fi.Size())
+	case m&os.ModeSymlink != 0:
+		t, err := os.Readlink(p)
+		if err != nil {
+			nw.err = err
+			return
+		}
+		nw.str("symlink")
+		nw.str("target")
+		nw.str(t)
+	case m.IsDir():
+		nw.str("directory")
+		names, err := readDirNames(p, rel, nw.f)
+		if err != nil {
+			nw.err = err
+			return
+		}
+		for _, n := range names {
+			nw.str("entry")
+			nw.str("(")
+			nw.str("name")
+			nw.str(n)
+			nw.str("node")
+			nw.dump(filepath.Join(p, n), joinRel(rel, n))
+			nw.str(")")
+		}
+	default:
+		nw.err = fmt.Errorf("file %s has an unsupported type", p)
+		return
+	}
+	nw.str(")")
+}
+
+func joinRel(rel string, n string) string {
+	if rel == "" {
+		return n
+	}
+	return rel + "/" + n
+}
+
+// Directory entries in the byte order Nix uses, skipping entries excluded by
+// the filter
+func readDirNames(p string, rel string, flt Filter) ([]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	if flt == nil {
+		return names, nil
+	}
+	included := names[:0]
+	for _, n := range names {
+		fi, err := os.Lstat(filepath.Join(p, n))
+		if err != nil {
+			return nil, err
+		}
+		ok, err := flt.Include(joinRel(rel, n), fi)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			included = append(included, n)
+		}
+	}
+	return included, nil
+}
+
+// Write the NAR serialization of a path to w. Symlinks are not followed.
+func Dump(w io.Writer, p string) error {
+	return DumpFilter(w, p, nil)
+}
+
+// Dump, leaving out entries excluded by f. The root is always included.
+// A nil filter includes everything.
+func DumpFilter(w io.Writer, p string, f Filter) error {
+	nw := &narWriter{w: w, f: f}
+	nw.str("nix-archive-1")
+	nw.dump(p, "")
+	return nw.err
+}
+
+// Compute the base32 encoded sha256 of the NAR serialization of a path.
+// Equivalent to `nix-hash --type sha256 --base32`.
+func HashPath(p string) (string, error) {
+	return HashPathFilter(p, nil)
+}
+
+// HashPath, leaving out entries excluded by f
+func HashPathFilter(p string, f Filter) (string, error) {
+	h := sha256.New()
+	err := DumpFilter(h, p, f)
+	if err != nil {
+		return "", err
+	}
+	return Base32(h.Sum(nil)), nil
+}
@@ -0,0 +1,247 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package nar_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/nar"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	td, err := ioutil.TempDir("", "nar_test")
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	return td
+}
+
+func TestBase32(t *testing.T) {
+	h := sha256.Sum256(nil)
+	got := Base32(h[:])
+	expected := "0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73"
+	if got != expected {
+		t.Errorf("expected %#v, but got %#v", expected, got)
+	}
+}
+
+// NAR string encoding
+func narStr(s string) []byte {
+	b := make([]byte, 8, 8+len(s)+8)
+	binary.LittleEndian.PutUint64(b, uint64(len(s)))
+	b = append(b, s...)
+	for len(b)%8 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func narStrs(ss ...string) []byte {
+	b := []byte{}
+	for _, s := range ss {
+		b = append(b, narStr(s)...)
+	}
+	return b
+}
+
+func TestDump(t *testing.T) {
+	td := tempDir(t)
+	defer os.RemoveAll(td)
+	err := ioutil.WriteFile(filepath.Join(td, "b"), []byte("hi"), 0755)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	err = os.Symlink("b", filepath.Join(td, "a"))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	expected := narStrs(
+		"nix-archive-1",
+		"(", "type", "directory",
+		"entry", "(", "name", "a", "node",
+		"(", "type", "symlink", "target", "b", ")",
+		")",
+		"entry", "(", "name", "b", "node",
+		"(", "type", "regular", "executable", "", "contents", "hi", ")",
+		")",
+		")",
+	)
+	got := &bytes.Buffer{}
+	err = Dump(got, td)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !bytes.Equal(got.Bytes(), expected) {
+		t.Errorf("expected %#v, but got %#v", expected, got.Bytes())
+	}
+}
+
+// Write a random tree of files, directories and symlinks
+func randomTree(r *rand.Rand, p string, depth int) error {
+	err := os.Mkdir(p, 0755)
+	if err != nil {
+		return err
+	}
+	n := r.Intn(5)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("%c%d", 'a'+r.Intn(26), i)
+		cp := filepath.Join(p, name)
+		switch k := r.Intn(4); {
+		case k == 0 && depth > 0:
+			err = randomTree(r, cp, depth-1)
+		case k == 1:
+			err = os.Symlink(fmt.Sprintf("../target%d", r.Intn(3)), cp)
+		default:
+			c := make([]byte, r.Intn(64))
+			r.Read(c)
+			mode := os.FileMode(0644)
+			if r.Intn(2) == 0 {
+				mode = 0755
+			}
+			err = ioutil.WriteFile(cp, c, mode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestHashPathNixHash(t *testing.T) {
+	nixHash, err := exec.LookPath("nix-hash")
+	if err != nil {
+		t.Skip("nix-hash not found")
+	}
+	td := tempDir(t)
+	defer os.RemoveAll(td)
+	seed := time.Now().UnixNano()
+	t.Logf("seed %d", seed)
+	r := rand.New(rand.NewSource(seed))
+	for i := 0; i < 20; i++ {
+		p := filepath.Join(td, fmt.Sprintf("tree%d", i))
+		err = randomTree(r, p, 3)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		out, err := exec.Command(
+			nixHash,
+			"--type", "sha256",
+			"--base32",
+			p,
+		).Output()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		got, err := HashPath(p)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if got != strings.TrimSpace(string(out)) {
+			t.Errorf("%s: nix-hash %#v, but got %#v", p, string(out), got)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	td := tempDir(t)
+	defer os.RemoveAll(td)
+	f := filepath.Join(td, "file.txt")
+	err := ioutil.WriteFile(f, []byte("a"), 0644)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	c := NewCache()
+	h1, err := c.HashPath(td)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	h2, err := c.HashPath(td)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if h1 != h2 {
+		t.Errorf("cached hash changed")
+	}
+
+	err = ioutil.WriteFile(f, []byte("bb"), 0644)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	h3, err := c.HashPath(td)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	h4, err := HashPath(td)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if h3 == h1 || h3 != h4 {
+		t.Errorf("cache returned a stale hash")
+	}
+}
+
+type skipFilter struct {
+	name string
+}
+
+func (sf skipFilter) Include(rel string, fi os.FileInfo) (bool, error) {
+	return filepath.Base(rel) != sf.name, nil
+}
+
+func (sf skipFilter) Key() string {
+	return sf.name
+}
+
+func TestHashPathFilter(t *testing.T) {
+	td := tempDir(t)
+	defer os.RemoveAll(td)
+	err := ioutil.WriteFile(filepath.Join(td, "a"), []byte("a"), 0644)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	h1, err := HashPath(td)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	err = ioutil.WriteFile(filepath.Join(td, "b"), []byte("b"), 0644)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	h2, err := HashPathFilter(td, skipFilter{name: "b"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if h1 != h2 {
+		t.Errorf("filtered entry changed the hash")
+	}
+
+	c := NewCache()
+	h3, err := c.HashPathFilter(td, skipFilter{name: "b"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	h4, err := c.HashPathFilter(td, skipFilter{name: "a"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if h3 != h1 || h3 == h4 {
+		t.Errorf("cache did not distinguish filters")
+	}
+}
@@ -19,6 +19,34 @@ type PackerOut struct {
 	ID         string
 	String     string
 	FilesCount int
+	// Messages of the last MaxErrors error and "ui,error" lines
+	Errors []string
+	// If set, called with the type ("say", "message" or "error") and the
+	// unescaped message of every ui line
+	OnUI func(kind string, msg string)
+}
+
+// Undo the escaping of machine readable output
+func unescape(s string) string {
+	s = strings.ReplaceAll(s, "%!(PACKER_COMMA)", ",")
+	s = strings.ReplaceAll(s, "\\n", "\n")
+	s = strings.ReplaceAll(s, "\\r", "\r")
+	return s
+}
+
+// Number of error lines kept in PackerOut
+const MaxErrors = 100
+
+// Get the message of an error line
+func getErrorLine(line string) (msg string, ok bool) {
+	cl := strings.SplitN(line, ",", 5)
+	if len(cl) >= 4 && cl[2] == "error" {
+		return strings.Join(cl[3:], ","), true
+	}
+	if len(cl) == 5 && cl[2] == "ui" && cl[3] == "error" {
+		return cl[4], true
+	}
+	return "", false
 }
 
 func getArtifactLine(
@@ -82,6 +110,19 @@ func (pout *PackerOut) ParsePackerOut(
 	ok := false
 	for scanner.Scan() {
 		line := scanner.Text()
+		if pout.OnUI != nil {
+			cl := strings.SplitN(line, ",", 5)
+			if len(cl) == 5 && cl[2] == "ui" {
+				pout.OnUI(cl[3], unescape(cl[4]))
+			}
+		}
+		msg, isErr := getErrorLine(line)
+		if isErr {
+			pout.Errors = append(pout.Errors, msg)
+			if len(pout.Errors) > MaxErrors {
+				pout.Errors = pout.Errors[1:]
+			}
+		}
 		field, value, ok = getArtifactLine(
 			logger,
 			line,
@@ -114,13 +155,18 @@ func (pout *PackerOut) ParsePackerOut(
 }
 
 // Run a Packer comand configured on cmd and ParsePackerOut its output.
+// The output is also copied to cmd.Stdout if it is set.
 func (pout *PackerOut) RunPacker(
 	logger *log.Logger,
 	cmd *exec.Cmd,
 	builderName string,
 ) error {
 	pr, pw := io.Pipe()
-	cmd.Stdout = pw
+	if cmd.Stdout != nil {
+		cmd.Stdout = io.MultiWriter(pw, cmd.Stdout)
+	} else {
+		cmd.Stdout = pw
+	}
 
 	err := cmd.Start()
 	if err != nil {
@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	. "github.com/leocp1/terraform-provider-packernix/src/pkg/packerout"
@@ -20,6 +21,9 @@ func TestPackerOut(t *testing.T) {
 		bname    string
 		inpath   string
 		expected *PackerOut
+		// number of error lines and the last one
+		errors    int
+		lastError string
 	}{
 		{
 			name:  "vultr",
@@ -34,6 +38,8 @@ func TestPackerOut(t *testing.T) {
 				String:     "Vultr Snapshot: /nix/store/scrubbedhash-nixos-system-nixos-20.03post-git (scrubbed)",
 				FilesCount: 0,
 			},
+			errors:    55,
+			lastError: "==> vultr: note: currently hard linking saves -0.00 MiB",
 		},
 		{
 			name:  "vultr-read",
@@ -61,6 +67,20 @@ func TestPackerOut(t *testing.T) {
 			if err != nil {
 				t.Fatalf(err.Error())
 			}
+			if len(got.Errors) != tt.errors {
+				t.Errorf(
+					"expected %d error lines, but got %d",
+					tt.errors,
+					len(got.Errors),
+				)
+			} else if tt.errors > 0 && got.Errors[tt.errors-1] != tt.lastError {
+				t.Errorf(
+					"expected last error line %#v, but got %#v",
+					tt.lastError,
+					got.Errors[tt.errors-1],
+				)
+			}
+			got.Errors = nil
 			if !reflect.DeepEqual(got, tt.expected) {
 				t.Errorf(
 					"expected %#v, but got %#v",
@@ -71,3 +91,34 @@ func TestPackerOut(t *testing.T) {
 		})
 	}
 }
+
+func TestPackerOutUI(t *testing.T) {
+	pin, err := os.Open(
+		filepath.Join("./testdata", "packer-builder-vultr-output.txt"),
+	)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer pin.Close()
+	counts := map[string]int{}
+	msgs := []string{}
+	pout := &PackerOut{
+		OnUI: func(kind string, msg string) {
+			counts[kind]++
+			msgs = append(msgs, msg)
+		},
+	}
+	err = pout.ParsePackerOut(nil, pin, "vultr")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := map[string]int{"error": 55, "message": 2, "say": 21}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("expected %#v, but got %#v", expected, counts)
+	}
+	for _, m := range msgs {
+		if strings.Contains(m, "%!(PACKER_COMMA)") {
+			t.Errorf("message not unescaped: %#v", m)
+		}
+	}
+}
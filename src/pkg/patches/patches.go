@@ -22,14 +22,6 @@ func Nix() string {
 	}
 }
 
-func NixHash() string {
-	if "@nix@" == ("@" + "nix@") {
-		return "nix-hash"
-	} else {
-		return filepath.Join("@nix@", "bin", "nix-hash")
-	}
-}
-
 func NixBuild() string {
 	if "@nix@" == ("@" + "nix@") {
 		return "nix-build"
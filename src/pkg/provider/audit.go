@@ -0,0 +1,108 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/audit"
+)
+
+// Executable recorded in the audit log for path hashes
+const auditHashPathExe = "hash_path"
+
+func AddAuditPSchema(m map[string]*schema.Schema) {
+	m["audit_log"] = &schema.Schema{
+		Type:        schema.TypeString,
+		Optional:    true,
+		Description: "A JSON lines file to append a record of each command to",
+	}
+	m["audit_redact"] = &schema.Schema{
+		Type:     schema.TypeList,
+		Optional: true,
+		Elem: &schema.Schema{
+			Type:         schema.TypeString,
+			ValidateFunc: validation.StringIsValidRegExp,
+		},
+		Description: "Regular expressions matching parts of command " +
+			"arguments to redact from the audit log",
+	}
+}
+
+// Open the audit log from the provider configuration
+func ConfigureAudit(
+	pc *ProviderContext,
+	rd *schema.ResourceData,
+) (d diag.Diagnostics) {
+	p, ok := rd.GetOk("audit_log")
+	if !ok {
+		return
+	}
+	l, err := audit.Open(p.(string))
+	if err != nil {
+		return append(d, diag.FromErr(err)...)
+	}
+	for _, s := range rd.Get("audit_redact").([]interface{}) {
+		re, err := regexp.Compile(s.(string))
+		if err != nil {
+			return append(d, diag.FromErr(err)...)
+		}
+		l.Patterns = append(l.Patterns, re)
+	}
+	pc.Audit = l
+	return
+}
+
+// Return a context whose commands are recorded in the audit log as run for
+// operation op of a resource of type kind
+func auditContext(
+	ctx context.Context,
+	i interface{},
+	kind string,
+	op string,
+) context.Context {
+	pc, ok := i.(*ProviderContext)
+	if !ok || pc.Audit == nil {
+		return ctx
+	}
+	return audit.NewContext(ctx, &audit.Scope{
+		Log:          pc.Audit,
+		ResourceType: kind,
+		Operation:    op,
+	})
+}
+
+// Record a path hash in the audit log
+func auditHashPath(
+	ctx context.Context,
+	start time.Time,
+	p string,
+	h string,
+	err error,
+) {
+	e := &audit.Entry{
+		Time:       start,
+		Executable: auditHashPathExe,
+		Args:       []string{p},
+		Duration:   time.Since(start).Seconds(),
+	}
+	if err != nil {
+		e.ExitCode = -1
+		e.Error = err.Error()
+	} else {
+		e.IDs = []string{h}
+	}
+	err = audit.FromContext(ctx).Record(e)
+	if err != nil {
+		log.Printf("[ERROR] [audit] %s", err.Error())
+	}
+}
@@ -0,0 +1,80 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/closurediff"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/tools"
+)
+
+func ClosureDiffBaseDSchema() dschema.DSchema {
+	return dschema.StringDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Description: "Nix store path to compare the closure of the " +
+					"built configuration with. Defaults to the previous " +
+					"target of out_link",
+			}
+		},
+	)
+}
+
+// Add the computed closure_diff attribute to a schema
+func AddClosureDiffSchema(m map[string]*schema.Schema) {
+	m["closure_diff"] = &schema.Schema{
+		Type:     schema.TypeString,
+		Computed: true,
+		Description: "Packages added, removed or changed between the " +
+			"closures of the previous and new NixOS configuration, with " +
+			"their size changes",
+	}
+}
+
+// Compare the closures of two store paths by package, running Nix in wd with
+// the environment env. Empty if either path is empty or they are equal.
+func ClosureDiff(
+	ctx context.Context,
+	t *tools.Tools,
+	wd string,
+	env []string,
+	before string,
+	after string,
+) (string, error) {
+	if before == "" || after == "" || before == after {
+		return "", nil
+	}
+	bs, err := t.ClosureSizes(ctx, before, wd, env)
+	if err != nil {
+		return "", err
+	}
+	as, err := t.ClosureSizes(ctx, after, wd, env)
+	if err != nil {
+		return "", err
+	}
+	return closurediff.Diff(bs, as), nil
+}
+
+// The nixos user variable of a Packer template, as set by the bundled
+// template generators. Empty if the template cannot be parsed.
+func TemplateNixOS(tmpl string) string {
+	var t struct {
+		Variables struct {
+			NixOS string `json:"nixos"`
+		} `json:"variables"`
+	}
+	if json.Unmarshal([]byte(tmpl), &t) != nil {
+		return ""
+	}
+	return t.Variables.NixOS
+}
@@ -0,0 +1,43 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"testing"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/provider"
+)
+
+func TestTemplateNixOS(t *testing.T) {
+	const p = "/nix/store/00000000000000000000000000000000-nixos-system-tfpnhost-20.03"
+	ts := []struct {
+		name     string
+		tmpl     string
+		expected string
+	}{
+		{
+			name:     "Set",
+			tmpl:     `{"variables":{"nixos":"` + p + `"},"builders":[]}`,
+			expected: p,
+		},
+		{
+			name:     "Unset",
+			tmpl:     `{"variables":{"name":"nixos"},"builders":[]}`,
+			expected: "",
+		},
+		{
+			name:     "Invalid",
+			tmpl:     `{"variables":`,
+			expected: "",
+		},
+	}
+	for _, tt := range ts {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TemplateNixOS(tt.tmpl); got != tt.expected {
+				t.Errorf("expected %#v, got %#v", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/cmdlog"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
+)
+
+func LogPathDSchema() dschema.DSchema {
+	return &dschema.PathDSchema{
+		Optional:           true,
+		HasProviderDefault: true,
+		SkipHashCheck:      true,
+		Description:        "A directory to write logs of commands to",
+	}
+}
+
+// Add the computed log_file attribute
+func AddLogFileSchema(m map[string]*schema.Schema) {
+	m["log_file"] = &schema.Schema{
+		Type:        schema.TypeString,
+		Computed:    true,
+		Description: "The log file of commands run for this resource",
+	}
+}
+
+// Report if changing k only changes where commands are logged. Such changes
+// never need a resource to be replaced or updated.
+func logOnly(k string) bool {
+	return k == "log_path"
+}
+
+// Name a new log file in log_path for a resource of type kind. Empty if
+// log_path is unset.
+func NewLogFile(
+	ctx context.Context,
+	dg dschema.DataGetter,
+	kind string,
+) (string, diag.Diagnostics) {
+	dir, d := dg.Get(ctx, "log_path")
+	if d.HasError() || dir.(string) == "" {
+		return "", d
+	}
+	return cmdlog.NewFile(dir.(string), kind), d
+}
+
+// Plan the log file of a resource of type kind. The planned file, or the one
+// in the state, is kept while it is in log_path.
+func PlanLogFile(
+	ctx context.Context,
+	cg dschema.DataGetter,
+	rd *schema.ResourceDiff,
+	kind string,
+) (lf string, d diag.Diagnostics) {
+	dir, d := cg.Get(ctx, "log_path")
+	if d.HasError() {
+		return
+	}
+	cur, _ := rd.Get("log_file").(string)
+	lf = cur
+	if dir.(string) == "" {
+		lf = ""
+	} else if lf == "" || filepath.Dir(lf) != dir.(string) {
+		lf = cmdlog.NewFile(dir.(string), kind)
+	}
+	if lf != cur {
+		err := rd.SetNew("log_file", lf)
+		if err != nil {
+			d = append(d, diag.FromErr(err)...)
+		}
+	}
+	return
+}
+
+// Log commands to a new log file, and set log_file. Used when reading data
+// sources and importing resources.
+func NewLogContext(
+	ctx context.Context,
+	cg dschema.DataGetter,
+	rd *schema.ResourceData,
+	kind string,
+) (context.Context, diag.Diagnostics) {
+	lf, d := NewLogFile(ctx, cg, kind)
+	if d.HasError() {
+		return ctx, d
+	}
+	err := rd.Set("log_file", lf)
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+	}
+	return cmdlog.NewContext(ctx, lf), d
+}
+
+// Log the commands of a resource to the log_file of rd
+func ResourceLogContext(
+	ctx context.Context,
+	rd interface{ Get(string) interface{} },
+) context.Context {
+	lf, _ := rd.Get("log_file").(string)
+	return cmdlog.NewContext(ctx, lf)
+}
@@ -0,0 +1,112 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/audit"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/cmdlog"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/tracing"
+)
+
+// A command run for a resource. Its output is copied to the command log of
+// the context, and it is traced in a span. Close records it in the audit log
+// and ends the span.
+type command struct {
+	ctx      context.Context
+	cmd      *exec.Cmd
+	span     *tracing.Span
+	start    time.Time
+	duration time.Duration
+	err      error
+	ran      bool
+	// IDs of the resources the command produced or found
+	IDs []string
+	// Extra attributes of the span
+	Attrs []tracing.Attribute
+}
+
+func newCommand(ctx context.Context, cmd *exec.Cmd) *command {
+	return &command{ctx: ctx, cmd: cmd}
+}
+
+// The span of the command. nil before Run, or if tracing is disabled.
+func (c *command) Span() *tracing.Span {
+	return c.span
+}
+
+// Run the command with run, which is usually cmd.Run
+func (c *command) Run(run func() error) error {
+	var patterns []*regexp.Regexp
+	if s := audit.FromContext(c.ctx); s != nil && s.Log != nil {
+		patterns = s.Log.Patterns
+	}
+	_, c.span = tracing.Start(
+		c.ctx,
+		filepath.Base(c.cmd.Path),
+		tracing.String("process.executable.path", c.cmd.Path),
+		tracing.StringSlice(
+			"process.command_args",
+			audit.Redact(c.cmd.Args, patterns),
+		),
+	)
+	c.start = time.Now()
+	finish, err := cmdlog.Start(c.ctx, c.cmd)
+	if err == nil {
+		err = run()
+		finish(err)
+	}
+	c.duration = time.Since(c.start)
+	c.err = err
+	c.ran = true
+	return err
+}
+
+// Record the command in the audit log, if it was run
+func (c *command) Close() {
+	if !c.ran {
+		return
+	}
+	env := c.cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	e := &audit.Entry{
+		Time:       c.start,
+		Executable: c.cmd.Path,
+		Args:       c.cmd.Args[1:],
+		Env:        audit.EnvNames(env),
+		WorkingDir: c.cmd.Dir,
+		Duration:   c.duration.Seconds(),
+		IDs:        c.IDs,
+	}
+	if c.err != nil {
+		e.ExitCode = -1
+		e.Error = c.err.Error()
+		var ee *exec.ExitError
+		if errors.As(c.err, &ee) {
+			e.ExitCode = ee.ExitCode()
+		}
+	}
+	c.span.SetAttributes(c.Attrs...)
+	c.span.SetAttributes(
+		tracing.Int("process.exit_code", e.ExitCode),
+		tracing.StringSlice("packernix.ids", e.IDs),
+	)
+	c.span.SetError(c.err)
+	c.span.End()
+	err := audit.FromContext(c.ctx).Record(e)
+	if err != nil {
+		log.Printf("[ERROR] [audit] %s", err.Error())
+	}
+}
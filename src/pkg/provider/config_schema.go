@@ -0,0 +1,101 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/jsonschema"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/tools"
+)
+
+// Evaluate the JSON schema of the type of the tfpn option. Returns the schema
+// and its JSON encoding.
+func RunNixOSConfigSchema(
+	ctx context.Context,
+	t *tools.Tools,
+	buildPath string,
+	cmdSlice []string,
+	flake bool,
+	wd string,
+	env []string,
+) (s *jsonschema.Schema, raw string, d diag.Diagnostics) {
+	out, d := evalNixOSAttr(
+		ctx,
+		t,
+		buildPath,
+		cmdSlice,
+		flake,
+		wd,
+		env,
+		"tfpnSchema",
+	)
+	if d.HasError() {
+		return
+	}
+	s = &jsonschema.Schema{}
+	err := json.Unmarshal(out, s)
+	if err != nil {
+		d = append(d, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  "could not parse the schema of the tfpn option",
+			Detail:   err.Error(),
+		})
+		return
+	}
+	raw = string(out)
+	return
+}
+
+// Attribute path of a value inside config
+func configPath(e *jsonschema.Error) cty.Path {
+	p := cty.GetAttrPath("config")
+	for _, s := range e.Path {
+		switch s := s.(type) {
+		case int:
+			p = p.IndexInt(s)
+		case string:
+			p = p.IndexString(s)
+		}
+	}
+	return p
+}
+
+// Check the config argument against the schema of the tfpn option. An unset
+// config is not checked.
+func ValidateTFPNConfig(
+	ctx context.Context,
+	dg dschema.DataGetter,
+	s *jsonschema.Schema,
+) (d diag.Diagnostics) {
+	cfgi, d := dg.Get(ctx, "config")
+	if d.HasError() || cfgi.(string) == "" {
+		return
+	}
+	var cfg interface{}
+	err := json.Unmarshal([]byte(cfgi.(string)), &cfg)
+	if err != nil {
+		d = append(d, diag.Diagnostic{
+			Severity:      diag.Error,
+			AttributePath: cty.GetAttrPath("config"),
+			Summary:       err.Error(),
+		})
+		return
+	}
+	for _, e := range s.Validate(cfg) {
+		d = append(d, diag.Diagnostic{
+			Severity:      diag.Error,
+			AttributePath: configPath(e),
+			Summary:       "config does not match the type of the tfpn option",
+			Detail:        e.Error(),
+		})
+	}
+	return
+}
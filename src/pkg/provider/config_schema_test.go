@@ -0,0 +1,68 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/jsonschema"
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/provider"
+)
+
+type configGetter string
+
+func (cg configGetter) Get(
+	ctx context.Context,
+	k string,
+) (interface{}, diag.Diagnostics) {
+	return string(cg), nil
+}
+
+func (cg configGetter) Id() string {
+	return ""
+}
+
+func TestValidateTFPNConfig(t *testing.T) {
+	ctx := context.Background()
+	s := &jsonschema.Schema{}
+	err := json.Unmarshal([]byte(`{
+	  "type": "object",
+	  "additionalProperties": false,
+	  "properties": {
+	    "users": {"type": "array", "items": {"type": "string"}}
+	  }
+	}`), s)
+	if err != nil {
+		t.Fatalf("could not parse schema: %s", err.Error())
+	}
+
+	d := ValidateTFPNConfig(ctx, configGetter(""), s)
+	if d.HasError() {
+		t.Errorf("unset config was checked: %#v", d)
+	}
+
+	d = ValidateTFPNConfig(
+		ctx,
+		configGetter(`{"users": ["a", 1], "hostname": "b"}`),
+		s,
+	)
+	expected := []cty.Path{
+		cty.GetAttrPath("config").IndexString("hostname"),
+		cty.GetAttrPath("config").IndexString("users").IndexInt(1),
+	}
+	if len(d) != len(expected) {
+		t.Fatalf("expected %d diagnostics, but got %#v", len(expected), d)
+	}
+	for i, p := range expected {
+		if d[i].Severity != diag.Error || !d[i].AttributePath.Equals(p) {
+			t.Errorf("expected an error at %#v, but got %#v", p, d[i])
+		}
+	}
+}
@@ -15,13 +15,14 @@ import (
 
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/logwriter"
-	"github.com/leocp1/terraform-provider-packernix/src/pkg/patches"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/scheduler"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/tracing"
 )
 
 func DataSourceBuild() *schema.Resource {
 	return &schema.Resource{
 		Schema:      SchemaBuild(),
-		ReadContext: ReadBuild,
+		ReadContext: instrumentCRUD("packernix_build", "read", ReadBuild),
 		Description: "Build a nix derivation",
 	}
 }
@@ -31,16 +32,19 @@ var BuildDSchema = map[string]dschema.DSchema{
 	"file":        NixFileDSchema(false),
 	"installable": NixInstallableDSchema(false),
 	// other arguments
-	"arg":         NixArgDSchema(),
-	"argstr":      NixArgstrDSchema(),
-	"attr":        NixAttrDSchema(),
-	"env":         &dschema.EnvDSchema{},
-	"flake":       FlakeDSchema(),
-	"flake_path":  FlakePathDSchema(),
-	"nix_options": NixOptionsDSchema(),
-	"nixpkgs":     NixpkgsDSchema(),
-	"out_link":    OutLinkDSchema(),
-	"working_dir": &dschema.WDDSchema{},
+	"arg":              NixArgDSchema(),
+	"argstr":           NixArgstrDSchema(),
+	"attr":             NixAttrDSchema(),
+	"env":              &dschema.EnvDSchema{},
+	"flake":            FlakeDSchema(),
+	"flake_path":       FlakePathDSchema(),
+	"log_path":         LogPathDSchema(),
+	"nix_bin_dir":      NixBinDirDSchema(),
+	"nix_options":      NixOptionsDSchema(),
+	"nixpkgs":          NixpkgsDSchema(),
+	"out_link":         OutLinkDSchema(),
+	"scheduler_weight": SchedulerWeightDSchema(),
+	"working_dir":      &dschema.WDDSchema{},
 }
 
 func SchemaBuild() (m map[string]*schema.Schema) {
@@ -52,6 +56,7 @@ func SchemaBuild() (m map[string]*schema.Schema) {
 		},
 	}
 	dschema.AddSchema(BuildDSchema, m)
+	AddLogFileSchema(m)
 	return
 }
 
@@ -65,9 +70,14 @@ func ReadBuild(
 		Rd: rd,
 		Pd: i.(*ProviderContext),
 	}
+	ctx, d = NewLogContext(ctx, cg, rd, "packernix_build")
+	if d.HasError() {
+		return
+	}
 
 	// working dir and env
-	wd, d := cg.Get(ctx, "working_dir")
+	wd, d0 := cg.Get(ctx, "working_dir")
+	d = append(d, d0...)
 	if d.HasError() {
 		return
 	}
@@ -78,20 +88,25 @@ func ReadBuild(
 	}
 
 	// command
+	t, d0 := NixTools(ctx, cg, i)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
 	_, flake := rd.GetOk("installable")
-	exe := "nix"
+	var exe string
 	cmdSlice := []string{}
 	if flake {
-		if !patches.SupportsNixFlake(ctx) {
+		if !t.SupportsNixFlake(ctx) {
 			return append(d, diag.Diagnostic{
 				Severity: diag.Error,
 				Summary:  "no flake support",
 			})
 		}
-		exe = patches.Nix()
+		exe = t.Nix()
 		cmdSlice = append(cmdSlice, "build")
 	} else {
-		exe = patches.NixBuild()
+		exe = t.NixBuild()
 	}
 
 	// options
@@ -116,6 +131,13 @@ func ReadBuild(
 		return
 	}
 
+	release, d0 := Schedule(ctx, cg, i, scheduler.NixBuild, "build")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	defer release()
+
 	log.Printf("[DEBUG] %#v %#v", exe, cmdSlice)
 	cmd := exec.CommandContext(ctx, exe, cmdSlice...)
 	outb := &bytes.Buffer{}
@@ -123,17 +145,23 @@ func ReadBuild(
 	cmd.Stderr = logwriter.New("[INFO] [build]", nil)
 	cmd.Dir = wd.(string)
 	cmd.Env = env.([]string)
-	err := cmd.Run()
-	d = exeFail(d, exe, cmdSlice, err)
+	c := newCommand(ctx, cmd)
+	defer c.Close()
+	err := c.Run(cmd.Run)
+	d = exeFail(ctx, d, exe, cmdSlice, err)
 	if d.HasError() {
 		return
 	}
 
-	outpath, d0 := GetOutPath(ctx, inst, wd, flake, outb.String())
+	outpath, d0 := GetOutPath(ctx, t, inst, wd, flake, outb.String())
 	d = append(d, d0...)
 	if d.HasError() {
 		return
 	}
+	c.IDs = []string{outpath}
+	tracing.SpanFromContext(ctx).SetAttributes(
+		tracing.String("packernix.store_path", outpath),
+	)
 
 	err = rd.Set("out_path", outpath)
 	if err != nil {
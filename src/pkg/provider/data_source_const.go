@@ -13,6 +13,7 @@ import (
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/patches"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/tools"
 )
 
 func DataSourceConst() *schema.Resource {
@@ -35,11 +36,21 @@ func SchemaConst() (m map[string]*schema.Schema) {
 			Computed:    true,
 			Description: "Nix executable",
 		},
+		"nix_bin_dir": {
+			Type:        schema.TypeString,
+			Computed:    true,
+			Description: "Directory containing the Nix executables",
+		},
 		"packer": {
 			Type:        schema.TypeString,
 			Computed:    true,
 			Description: "Directory of Packer template generators",
 		},
+		"packer_bin": {
+			Type:        schema.TypeString,
+			Computed:    true,
+			Description: "Packer executable",
+		},
 	}
 }
 
@@ -49,10 +60,33 @@ func ReadConst(
 	i interface{},
 ) diag.Diagnostics {
 
-	err := rd.Set(
-		"nix",
-		patches.Nix(),
-	)
+	t := i.(*ProviderContext).Tools
+
+	// Resolve executables found in PATH, but keep the bare names if they
+	// cannot be found, since they may only be needed by other resources.
+	nix := t.Nix()
+	if p := tools.LookPath(nix); p != "" {
+		nix = p
+	}
+	err := rd.Set("nix", nix)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	nixBinDir := t.NixBinDir
+	if nixBinDir == "" && filepath.IsAbs(nix) {
+		nixBinDir = filepath.Dir(nix)
+	}
+	err = rd.Set("nix_bin_dir", nixBinDir)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	packer := t.Packer()
+	if p := tools.LookPath(packer); p != "" {
+		packer = p
+	}
+	err = rd.Set("packer_bin", packer)
 	if err != nil {
 		return diag.FromErr(err)
 	}
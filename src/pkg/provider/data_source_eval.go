@@ -16,13 +16,13 @@ import (
 
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/logwriter"
-	"github.com/leocp1/terraform-provider-packernix/src/pkg/patches"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/scheduler"
 )
 
 func DataSourceEval() *schema.Resource {
 	return &schema.Resource{
 		Schema:      SchemaEval(),
-		ReadContext: ReadEval,
+		ReadContext: instrumentCRUD("packernix_eval", "read", ReadEval),
 		Description: "Evaluate nix expression",
 	}
 }
@@ -33,16 +33,19 @@ var EvalDSchema = map[string]dschema.DSchema{
 	"inline":      NixInlineDSchema(),
 	"installable": NixInstallableDSchema(true),
 	// other arguments
-	"arg":         NixArgDSchema(),
-	"argstr":      NixArgstrDSchema(),
-	"attr":        NixAttrDSchema(),
-	"env":         &dschema.EnvDSchema{},
-	"flake":       FlakeDSchema(),
-	"flake_path":  FlakePathDSchema(),
-	"nix_options": NixOptionsDSchema(),
-	"nixpkgs":     NixpkgsDSchema(),
-	"out_link":    OutLinkDSchema(),
-	"working_dir": &dschema.WDDSchema{},
+	"arg":              NixArgDSchema(),
+	"argstr":           NixArgstrDSchema(),
+	"attr":             NixAttrDSchema(),
+	"env":              &dschema.EnvDSchema{},
+	"flake":            FlakeDSchema(),
+	"flake_path":       FlakePathDSchema(),
+	"log_path":         LogPathDSchema(),
+	"nix_bin_dir":      NixBinDirDSchema(),
+	"nix_options":      NixOptionsDSchema(),
+	"nixpkgs":          NixpkgsDSchema(),
+	"out_link":         OutLinkDSchema(),
+	"scheduler_weight": SchedulerWeightDSchema(),
+	"working_dir":      &dschema.WDDSchema{},
 }
 
 func SchemaEval() (m map[string]*schema.Schema) {
@@ -54,6 +57,7 @@ func SchemaEval() (m map[string]*schema.Schema) {
 		},
 	}
 	dschema.AddSchema(EvalDSchema, m)
+	AddLogFileSchema(m)
 	return
 }
 
@@ -68,9 +72,14 @@ func ReadEval(
 		Rd: rd,
 		Pd: i.(*ProviderContext),
 	}
+	ctx, d = NewLogContext(ctx, cg, rd, "packernix_eval")
+	if d.HasError() {
+		return
+	}
 
 	// working dir and env
-	wd, d := cg.Get(ctx, "working_dir")
+	wd, d0 := cg.Get(ctx, "working_dir")
+	d = append(d, d0...)
 	if d.HasError() {
 		return
 	}
@@ -81,20 +90,25 @@ func ReadEval(
 	}
 
 	// command
+	t, d0 := NixTools(ctx, cg, i)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
 	_, flake := rd.GetOk("installable")
-	exe := "nix"
+	var exe string
 	cmdSlice := []string{}
 	if flake {
-		if !patches.SupportsNixFlake(ctx) {
+		if !t.SupportsNixFlake(ctx) {
 			return append(d, diag.Diagnostic{
 				Severity: diag.Error,
 				Summary:  "no flake support",
 			})
 		}
-		exe = patches.Nix()
+		exe = t.Nix()
 		cmdSlice = append(cmdSlice, "eval", "--json")
 	} else {
-		exe = patches.NixInstantiate()
+		exe = t.NixInstantiate()
 		cmdSlice = append(cmdSlice, "--eval", "--json")
 	}
 
@@ -113,6 +127,13 @@ func ReadEval(
 		return
 	}
 
+	release, d0 := Schedule(ctx, cg, i, scheduler.Eval, "eval")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	defer release()
+
 	log.Printf("[DEBUG] %#v %#v", exe, cmdSlice)
 	cmd := exec.CommandContext(ctx, exe, cmdSlice...)
 	if inb != nil {
@@ -123,15 +144,17 @@ func ReadEval(
 	cmd.Stderr = logwriter.New("[INFO] [eval]", nil)
 	cmd.Dir = wd.(string)
 	cmd.Env = env.([]string)
-	err := cmd.Run()
-	d = exeFail(d, exe, cmdSlice, err)
+	c := newCommand(ctx, cmd)
+	defer c.Close()
+	err := c.Run(cmd.Run)
+	d = exeFail(ctx, d, exe, cmdSlice, err)
 	if d.HasError() {
 		return
 	}
 
 	out := outb.String()
 
-	d = append(d, SetOutLink(ctx, cg, out, wd, flake)...)
+	d = append(d, SetOutLink(ctx, t, cg, out, wd, flake)...)
 	if d.HasError() {
 		return
 	}
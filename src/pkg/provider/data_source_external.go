@@ -7,22 +7,26 @@ package provider
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os/exec"
 	"path/filepath"
 
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
 
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/logwriter"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/retry"
 )
 
 func DataSourceExternal() *schema.Resource {
 	return &schema.Resource{
 		Schema:      SchemaExternal(),
-		ReadContext: ReadDataExternal,
+		ReadContext: instrumentCRUD("packernix_external", "read", ReadDataExternal),
 		Description: "Use an external program as a data source",
 	}
 }
@@ -48,10 +52,49 @@ var ExternalDSchema = map[string]dschema.DSchema{
 			}
 		},
 	),
-	"env":         &dschema.EnvDSchema{},
+	"env": &dschema.EnvDSchema{},
+	"input": dschema.StringMapDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type: schema.TypeMap,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Optional: true,
+				Description: `A map of strings passed to the program(s) ` +
+					`when protocol is "json"`,
+			}
+		},
+	),
+	"protocol": dschema.StringDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				ValidateFunc: validation.StringInSlice(
+					[]string{ExternalProtocolRaw, ExternalProtocolJSON},
+					false,
+				),
+				Description: `How to communicate with the program(s). ` +
+					`Either "raw" (the default) or "json"`,
+			}
+		},
+	),
+	"log_path":    LogPathDSchema(),
+	"retry":       RetryDSchema(),
 	"working_dir": &dschema.WDDSchema{},
 }
 
+// Values of protocol
+const (
+	// The ID is passed over stdin and stdout as is
+	ExternalProtocolRaw = "raw"
+	// JSON documents are passed over stdin and stdout
+	ExternalProtocolJSON = "json"
+)
+
 func SchemaExternal() (m map[string]*schema.Schema) {
 	m = map[string]*schema.Schema{
 		"state": {
@@ -59,35 +102,79 @@ func SchemaExternal() (m map[string]*schema.Schema) {
 			Computed:    true,
 			Description: "A string uniquely identifying the data source.",
 		},
+		"outputs": {
+			Type: schema.TypeMap,
+			Elem: &schema.Schema{
+				Type: schema.TypeString,
+			},
+			Computed: true,
+			Description: `A map of strings output by the program(s) when ` +
+				`protocol is "json"`,
+		},
 	}
 	dschema.AddSchema(ExternalDSchema, m)
+	AddLogFileSchema(m)
 	return
 }
 
-func RunExternal(
+// The resource an external program operated on
+type ExternalResult struct {
+	Id      string
+	Outputs map[string]string
+}
+
+// Document passed over stdin with the json protocol
+type externalJSONRequest struct {
+	Operation string            `json:"operation"`
+	Id        string            `json:"id"`
+	Input     map[string]string `json:"input"`
+	Outputs   map[string]string `json:"outputs"`
+}
+
+// Document read from stdout with the json protocol
+type externalJSONResponse struct {
+	Id      string            `json:"id"`
+	Outputs map[string]string `json:"outputs"`
+}
+
+// Path of the program for op
+func ExternalExe(
 	ctx context.Context,
 	rd dschema.DataGetter,
 	op string,
-	initId string,
-) (id string, d diag.Diagnostics) {
-	id = initId
+) (exe string, d diag.Diagnostics) {
+	p, d := rd.Get(ctx, "path")
+	if d.HasError() {
+		return
+	}
+	exe = filepath.Join(p.(string), "bin", op)
+	return
+}
 
+// Set up the command for the external program for op. Standard input and
+// output are left to the caller.
+func externalCmd(
+	ctx context.Context,
+	rd dschema.DataGetter,
+	op string,
+) (cmd *exec.Cmd, opts []string, d diag.Diagnostics) {
 	wd, d := rd.Get(ctx, "working_dir")
 	if d.HasError() {
 		return
 	}
 
-	p, d0 := rd.Get(ctx, "path")
+	exe, d0 := ExternalExe(ctx, rd, op)
 	d = append(d, d0...)
 	if d.HasError() {
 		return
 	}
 
-	opts, d0 := rd.Get(ctx, "options")
+	optsi, d0 := rd.Get(ctx, "options")
 	d = append(d, d0...)
 	if d.HasError() {
 		return
 	}
+	opts = optsi.([]string)
 
 	env, d0 := rd.Get(ctx, "env")
 	d = append(d, d0...)
@@ -95,32 +182,173 @@ func RunExternal(
 		return
 	}
 
-	exe := filepath.Join(p.(string), "bin", op)
-	inb := bytes.NewBufferString(id)
-	outb := &bytes.Buffer{}
 	log.Printf("[DEBUG] %#v %#v", exe, opts)
-	cmd := exec.CommandContext(ctx, exe, opts.([]string)...)
-	cmd.Stdin = inb
-	cmd.Stdout = outb
+	cmd = exec.CommandContext(ctx, exe, opts...)
 	cmd.Stderr = logwriter.New(fmt.Sprintf("[INFO] [%s] ", exe), nil)
 	cmd.Dir = wd.(string)
 	cmd.Env = env.([]string)
-	err := cmd.Run()
-	d = exeFail(d, exe, opts.([]string), err)
+	return
+}
+
+// Report if the programs use the json protocol
+func externalUsesJSON(
+	ctx context.Context,
+	rd dschema.DataGetter,
+) (bool, diag.Diagnostics) {
+	proto, d := rd.Get(ctx, "protocol")
+	if d.HasError() {
+		return false, d
+	}
+	return proto.(string) == ExternalProtocolJSON, d
+}
+
+// Parse the standard output of a program
+func parseExternalOutput(
+	exe string,
+	out []byte,
+	useJSON bool,
+) (res ExternalResult, d diag.Diagnostics) {
+	if !useJSON {
+		res = ExternalResult{Id: string(out)}
+		return
+	}
+	resp := externalJSONResponse{}
+	err := json.Unmarshal(out, &resp)
+	if err != nil {
+		d = append(d, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("%s did not output a JSON object", exe),
+			Detail:   err.Error(),
+		})
+		return
+	}
+	res = ExternalResult{Id: resp.Id, Outputs: resp.Outputs}
+	if res.Outputs == nil {
+		res.Outputs = map[string]string{}
+	}
+	return
+}
+
+// Run the external program for op. prev is the resource recorded in the state,
+// and should be empty when finding or creating a resource.
+//
+// Failures are retried according to the retry policy. Before a create is
+// retried, read is run to find a resource left by the failed attempt.
+func RunExternal(
+	ctx context.Context,
+	rd dschema.DataGetter,
+	op string,
+	prev ExternalResult,
+) (res ExternalResult, d diag.Diagnostics) {
+	policy, d := RetryPolicy(ctx, rd)
 	if d.HasError() {
 		return
 	}
+	var d0 diag.Diagnostics
+	err := retry.Do(ctx, policy, op, func(attempt int) bool {
+		// A failed create may have left a resource behind
+		if attempt > 1 && op == "create" {
+			fres, fd0, _ := runExternal(ctx, rd, "read", ExternalResult{}, nil)
+			if !fd0.HasError() && fres.Id != "" {
+				log.Printf(
+					"[INFO] [retry] using resource %#v left by failed create",
+					fres.Id,
+				)
+				res, d0 = fres, fd0
+				return false
+			}
+		}
+		var again bool
+		res, d0, again = runExternal(ctx, rd, op, prev, policy)
+		return again
+	})
+	d = append(d, d0...)
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+	}
+	return
+}
 
-	id = outb.String()
+// Run the external program once. again is true if the program failed, and the
+// policy allows retrying the failure.
+func runExternal(
+	ctx context.Context,
+	rd dschema.DataGetter,
+	op string,
+	prev ExternalResult,
+	policy *retry.Policy,
+) (res ExternalResult, d diag.Diagnostics, again bool) {
+	res = prev
 
+	cmd, opts, d := externalCmd(ctx, rd, op)
+	if d.HasError() {
+		return
+	}
+
+	useJSON, d0 := externalUsesJSON(ctx, rd)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+
+	inb := bytes.NewBufferString(prev.Id)
+	if useJSON {
+		input, d0 := rd.Get(ctx, "input")
+		d = append(d, d0...)
+		if d.HasError() {
+			return
+		}
+		req := externalJSONRequest{
+			Operation: op,
+			Id:        prev.Id,
+			Input:     input.(map[string]string),
+			Outputs:   prev.Outputs,
+		}
+		if req.Outputs == nil {
+			req.Outputs = map[string]string{}
+		}
+		b, err := json.Marshal(req)
+		if err != nil {
+			d = append(d, diag.FromErr(err)...)
+			return
+		}
+		inb = bytes.NewBuffer(b)
+	}
+	outb := &bytes.Buffer{}
+	stderr := retry.NewTail(retryTailLines)
+	cmd.Stdin = inb
+	cmd.Stdout = outb
+	cmd.Stderr = io.MultiWriter(cmd.Stderr, stderr)
+	c := newCommand(ctx, cmd)
+	defer c.Close()
+	err := c.Run(cmd.Run)
+	d = exeFail(ctx, d, cmd.Path, opts, err)
+	if d.HasError() {
+		again = ctx.Err() == nil && policy.Retryable(err, stderr.Lines())
+		return
+	}
+
+	// Output of delete is ignored
+	if op == "delete" {
+		return
+	}
+	res, d0 = parseExternalOutput(cmd.Path, outb.Bytes(), useJSON)
+	d = append(d, d0...)
+	if res.Id != "" {
+		c.IDs = []string{res.Id}
+	}
 	return
 }
 
-// Set both the state and id
-func SetState(rd *schema.ResourceData, id string) {
+// Set the state, outputs and id
+func SetState(rd *schema.ResourceData, res ExternalResult) {
+	id := res.Id
 	// this should never fail. if it does set id to "" so we're not left with
 	// partial state
 	err := rd.Set("state", id)
+	if err == nil {
+		err = rd.Set("outputs", res.Outputs)
+	}
 	if err != nil {
 		id = ""
 	}
@@ -138,17 +366,22 @@ func ReadDataExternal(
 		Rd: rd,
 		Pd: i.(*ProviderContext),
 	}
-	id, d := RunExternal(ctx, cg, "read", "")
+	ctx, d = NewLogContext(ctx, cg, rd, "packernix_external")
+	if d.HasError() {
+		return
+	}
+	res, d0 := RunExternal(ctx, cg, "read", ExternalResult{})
+	d = append(d, d0...)
 	if d.HasError() {
 		return
 	}
-	if id == "" {
+	if res.Id == "" {
 		d = append(d, diag.Diagnostic{
 			Severity: diag.Error,
 			Summary:  "resource not found",
 		})
 	}
-	SetState(rd, id)
+	SetState(rd, res)
 
 	return
 }
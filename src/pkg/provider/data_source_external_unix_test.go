@@ -8,19 +8,51 @@
 package provider_test
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/audit"
 )
 
+// Check that the log_file of name contains all of lines
+func testCheckLogFile(name string, lines ...string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		rs, ok := s.RootModule().Resources[name]
+		if !ok {
+			return fmt.Errorf("%s not found", name)
+		}
+		lf := rs.Primary.Attributes["log_file"]
+		b, err := ioutil.ReadFile(lf)
+		if err != nil {
+			return err
+		}
+		for _, l := range lines {
+			if !strings.Contains(string(b), l) {
+				return fmt.Errorf("%s does not contain %#v", lf, l)
+			}
+		}
+		return nil
+	}
+}
+
 func TestAccDataSourceExternal(t *testing.T) {
 	wd, err := os.Getwd()
 	if err != nil {
 		t.Skipf(err.Error())
 	}
+	logPath, err := ioutil.TempDir("", "packernix-log")
+	if err != nil {
+		t.Skipf(err.Error())
+	}
+	t.Cleanup(func() { os.RemoveAll(logPath) })
 	ts := map[string]resource.TestCase{
 		"echo": {
 			IsUnitTest:        true,
@@ -38,6 +70,19 @@ func TestAccDataSourceExternal(t *testing.T) {
 						"test",
 					),
 				},
+				{
+					Config: ReadConfig(
+						t,
+						filepath.Join("external", "echo", "echo-audit.hcl"),
+						struct{ AuditLog string }{
+							filepath.Join(logPath, "audit.jsonl"),
+						},
+					),
+					Check: testCheckAuditLog(
+						filepath.Join(logPath, "audit.jsonl"),
+						"t"+audit.Redacted+"t",
+					),
+				},
 			},
 		},
 		"env": {
@@ -82,6 +127,18 @@ func TestAccDataSourceExternal(t *testing.T) {
 					),
 					ExpectError: regexp.MustCompile("exit status"),
 				},
+				{
+					Config: ReadConfig(
+						t,
+						filepath.Join("external", "fail", "data-fail-log.hcl"),
+						struct{ LogPath string }{logPath},
+					),
+					ExpectError: regexp.MustCompile(
+						"Command output is logged to " +
+							regexp.QuoteMeta(logPath) +
+							"/packernix_external-",
+					),
+				},
 			},
 		},
 		"file": {
@@ -104,6 +161,34 @@ func TestAccDataSourceExternal(t *testing.T) {
 				},
 			},
 		},
+		"json": {
+			IsUnitTest:        true,
+			ProviderFactories: ProviderFactories(),
+			Steps: []resource.TestStep{
+				{
+					Config: ReadConfig(
+						t,
+						filepath.Join("external", "json", "data-json.hcl"),
+						struct{}{},
+					),
+					Check: resource.ComposeAggregateTestCheckFunc(
+						resource.TestCheckResourceAttr(
+							"data.packernix_external.json",
+							"state",
+							"./testdata/external/json/data-json.hcl",
+						),
+						resource.TestMatchResourceAttr(
+							"data.packernix_external.json",
+							"outputs.request",
+							regexp.MustCompile(regexp.QuoteMeta(
+								`"operation":"read","id":"",`+
+									`"input":{"key":"value"}`,
+							)),
+						),
+					),
+				},
+			},
+		},
 		"noop": {
 			IsUnitTest:        true,
 			ProviderFactories: ProviderFactories(),
@@ -152,6 +237,30 @@ func TestAccDataSourceExternal(t *testing.T) {
 						"out",
 					),
 				},
+				{
+					Config: ReadConfig(
+						t,
+						filepath.Join("external", "stderr", "stderr-log.hcl"),
+						struct{ LogPath string }{logPath},
+					),
+					Check: resource.ComposeAggregateTestCheckFunc(
+						resource.TestMatchResourceAttr(
+							"data.packernix_external.stderr",
+							"log_file",
+							regexp.MustCompile(
+								"^"+regexp.QuoteMeta(logPath)+
+									"/packernix_external-.*\\.log$",
+							),
+						),
+						testCheckLogFile(
+							"data.packernix_external.stderr",
+							"/testdata/external/stderr/bin/read\"",
+							"stdout | out\n",
+							"stderr | err\n",
+							"exit status 0\n",
+						),
+					),
+				},
 			},
 		},
 	}
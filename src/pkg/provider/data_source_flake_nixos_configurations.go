@@ -0,0 +1,264 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/logwriter"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/scheduler"
+)
+
+func DataSourceFlakeNixOSConfigurations() *schema.Resource {
+	return &schema.Resource{
+		Schema: SchemaFlakeNixOSConfigurations(),
+		ReadContext: instrumentCRUD(
+			"packernix_flake_nixos_configurations",
+			"read",
+			ReadFlakeNixOSConfigurations,
+		),
+		Description: "List the NixOS configurations of a flake",
+	}
+}
+
+var FlakeNixOSConfigurationsDSchema = map[string]dschema.DSchema{
+	"attrset": dschema.StringDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				DefaultFunc: func() (interface{}, error) {
+					return "nixosConfigurations", nil
+				},
+				Description: "Attribute path of the configurations in the flake",
+			}
+		},
+	),
+	"env":              &dschema.EnvDSchema{},
+	"flake":            FlakeDSchema(),
+	"flake_path":       FlakePathDSchema(),
+	"log_path":         LogPathDSchema(),
+	"nix_bin_dir":      NixBinDirDSchema(),
+	"nix_options":      NixOptionsDSchema(),
+	"scheduler_weight": SchedulerWeightDSchema(),
+	"working_dir":      &dschema.WDDSchema{},
+}
+
+func SchemaFlakeNixOSConfigurations() (m map[string]*schema.Schema) {
+	m = map[string]*schema.Schema{
+		"names": {
+			Type:        schema.TypeList,
+			Elem:        &schema.Schema{Type: schema.TypeString},
+			Computed:    true,
+			Description: "Sorted names of the configurations",
+		},
+		"systems": {
+			Type:     schema.TypeMap,
+			Elem:     &schema.Schema{Type: schema.TypeString},
+			Computed: true,
+			Description: "Map of configuration names to the Nix system they " +
+				"are built on. Empty for modules",
+		},
+		"installables": {
+			Type:     schema.TypeMap,
+			Elem:     &schema.Schema{Type: schema.TypeString},
+			Computed: true,
+			Description: "Map of configuration names to installables " +
+				"relative to the flake",
+		},
+	}
+	dschema.AddSchema(FlakeNixOSConfigurationsDSchema, m)
+	AddLogFileSchema(m)
+	return
+}
+
+// Applied to the attrset. Modules do not have a system, and may be functions.
+// Configurations that fail to evaluate have no system either, so that they do
+// not fail the others.
+const nixOSSystemsApply = `cs: builtins.mapAttrs (n: c:
+  let
+    r = builtins.tryEval (
+      if builtins.isAttrs c
+      then c.config.nixpkgs.localSystem.system or ""
+      else "");
+  in if r.success then r.value else "") cs`
+
+var nixAttrNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_'-]*$`)
+
+var nixStringReplacer = strings.NewReplacer(
+	`\`, `\\`,
+	`"`, `\"`,
+	"${", `\${`,
+	"\n", `\n`,
+	"\r", `\r`,
+	"\t", `\t`,
+)
+
+// Quote s as a Nix string literal
+func QuoteNixString(s string) string {
+	return `"` + nixStringReplacer.Replace(s) + `"`
+}
+
+// Installable for a configuration in attrset, relative to the flake
+func nixOSInstallable(attrset string, name string) string {
+	if !nixAttrNameRegexp.MatchString(name) {
+		name = QuoteNixString(name)
+	}
+	return fmt.Sprintf("#%s.%s", attrset, name)
+}
+
+func ReadFlakeNixOSConfigurations(
+	ctx context.Context,
+	rd *schema.ResourceData,
+	i interface{},
+) (d diag.Diagnostics) {
+	cg := &dschema.ConfigGetter{
+		Ds: FlakeNixOSConfigurationsDSchema,
+		Rd: rd,
+		Pd: i.(*ProviderContext),
+	}
+	ctx, d = NewLogContext(ctx, cg, rd, "packernix_flake_nixos_configurations")
+	if d.HasError() {
+		return
+	}
+
+	// working dir and env
+	wd, d0 := cg.Get(ctx, "working_dir")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	env, d0 := cg.Get(ctx, "env")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+
+	// flake
+	f, d0 := cg.Get(ctx, "flake")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	fp, d0 := cg.Get(ctx, "flake_path")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	flake := f.(string) + fp.(string)
+	if flake == "" {
+		return append(d, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  "one of flake or flake_path must be set",
+		})
+	}
+	attrseti, d0 := cg.Get(ctx, "attrset")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	attrset := attrseti.(string)
+	if attrset == "" {
+		return append(d, diag.Diagnostic{
+			Severity:      diag.Error,
+			AttributePath: cty.GetAttrPath("attrset"),
+			Summary:       "Must not be empty",
+		})
+	}
+
+	// command
+	t, d0 := NixTools(ctx, cg, i)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	if !t.SupportsNixFlake(ctx) {
+		return append(d, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  "no flake support",
+		})
+	}
+	exe := t.Nix()
+	cmdSlice := []string{"eval", "--json"}
+	cmdSlice, d0 = AddNixOptions(ctx, cmdSlice, cg, i, false, false, true)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	cmdSlice = append(
+		cmdSlice,
+		"--apply", nixOSSystemsApply,
+		flake+"#"+attrset,
+	)
+
+	release, d0 := Schedule(ctx, cg, i, scheduler.Eval, "eval")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	defer release()
+
+	log.Printf("[DEBUG] %#v %#v", exe, cmdSlice)
+	cmd := exec.CommandContext(ctx, exe, cmdSlice...)
+	outb := &bytes.Buffer{}
+	cmd.Stdout = outb
+	cmd.Stderr = logwriter.New("[INFO] [flake_nixos_configurations]", nil)
+	cmd.Dir = wd.(string)
+	cmd.Env = env.([]string)
+	c := newCommand(ctx, cmd)
+	defer c.Close()
+	err := c.Run(cmd.Run)
+	d = exeFail(ctx, d, exe, cmdSlice, err)
+	if d.HasError() {
+		return
+	}
+
+	systems := map[string]string{}
+	err = json.Unmarshal(outb.Bytes(), &systems)
+	if err != nil {
+		return append(d, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("%s#%s is not an attribute set", flake, attrset),
+			Detail:   err.Error(),
+		})
+	}
+	names := make([]string, 0, len(systems))
+	installables := map[string]string{}
+	for n := range systems {
+		names = append(names, n)
+		installables[n] = nixOSInstallable(attrset, n)
+	}
+	sort.Strings(names)
+	c.IDs = names
+
+	err = rd.Set("names", names)
+	if err == nil {
+		err = rd.Set("systems", systems)
+	}
+	if err == nil {
+		err = rd.Set("installables", installables)
+	}
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+		return d
+	}
+	rd.SetId(flake + "#" + attrset)
+
+	return
+}
@@ -0,0 +1,122 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/provider"
+)
+
+func TestAccDataSourceFlakeNixOSConfigurations(t *testing.T) {
+	ctx := context.Background()
+	dn := "data.packernix_flake_nixos_configurations.default"
+	hn := "data.packernix_flake_nixos_configurations.hosts"
+	logPath, err := ioutil.TempDir("", "packernix-log")
+	if err != nil {
+		t.Skipf(err.Error())
+	}
+	t.Cleanup(func() { os.RemoveAll(logPath) })
+	resource.ParallelTest(t, resource.TestCase{
+		ProviderFactories: ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: ReadConfig(
+					t,
+					filepath.Join(
+						"flake_nixos_configurations",
+						"configurations.hcl",
+					),
+					nil,
+				),
+				SkipFunc: FlakeSkipFunc(ctx, t),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr(dn, "names.#", "3"),
+					resource.TestCheckResourceAttr(dn, "names.0", "arm"),
+					resource.TestCheckResourceAttr(dn, "names.1", "broken"),
+					resource.TestCheckResourceAttr(
+						dn,
+						"names.2",
+						"web.example",
+					),
+					resource.TestCheckResourceAttr(
+						dn,
+						"systems.arm",
+						"aarch64-linux",
+					),
+					resource.TestCheckResourceAttr(dn, "systems.broken", ""),
+					resource.TestCheckResourceAttr(
+						dn,
+						"systems.web.example",
+						"",
+					),
+					resource.TestCheckResourceAttr(
+						dn,
+						"installables.arm",
+						"#nixosConfigurations.arm",
+					),
+					resource.TestCheckResourceAttr(
+						dn,
+						"installables.web.example",
+						`#nixosConfigurations."web.example"`,
+					),
+					resource.TestCheckResourceAttr(hn, "names.#", "1"),
+					resource.TestCheckResourceAttr(
+						hn,
+						"installables.db",
+						"#hosts.db",
+					),
+					resource.TestCheckResourceAttr(
+						`data.packernix_eval.each["arm"]`,
+						"out",
+						`"arm aarch64-linux"`,
+					),
+				),
+			},
+			{
+				Config: ReadConfig(
+					t,
+					filepath.Join(
+						"flake_nixos_configurations",
+						"configurations-audit.hcl",
+					),
+					struct{ AuditLog string }{
+						filepath.Join(logPath, "audit.jsonl"),
+					},
+				),
+				SkipFunc: FlakeSkipFunc(ctx, t),
+				// The flake support probe is audited
+				Check: testCheckAuditLog(
+					filepath.Join(logPath, "audit.jsonl"),
+					"flake",
+					"--help",
+				),
+			},
+		},
+	})
+}
+
+func TestQuoteNixString(t *testing.T) {
+	ts := map[string]string{
+		"web.example": `"web.example"`,
+		`a"b`:         `"a\"b"`,
+		`a\b`:         `"a\\b"`,
+		"${x}":        `"\${x}"`,
+		"$x {y}":      `"$x {y}"`,
+		"<a>&b":       `"<a>&b"`,
+		"a\nb":        `"a\nb"`,
+	}
+	for in, expected := range ts {
+		if got := QuoteNixString(in); got != expected {
+			t.Errorf("%#v: expected %s, but got %s", in, expected, got)
+		}
+	}
+}
@@ -7,24 +7,30 @@ package provider
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"time"
 
+	"github.com/hashicorp/go-cty/cty"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
 
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/logwriter"
-	"github.com/leocp1/terraform-provider-packernix/src/pkg/patches"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/scheduler"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/tools"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/tracing"
 )
 
 func DataSourceOS() *schema.Resource {
 	return &schema.Resource{
 		Schema:      SchemaOS(),
-		ReadContext: ReadOS,
+		ReadContext: instrumentCRUD("packernix_os", "read", ReadOS),
 		Description: "Build a NixOS configuration",
 	}
 }
@@ -34,17 +40,54 @@ var OSDSchema = map[string]dschema.DSchema{
 	"file":        NixFileDSchema(false),
 	"installable": NixInstallableDSchema(false),
 	// other arguments
-	"arg":         NixArgDSchema(),
-	"argstr":      NixArgstrDSchema(),
-	"build_path":  BuildPathDSchema(),
-	"config":      NixOSConfigDSchema(),
-	"env":         &dschema.EnvDSchema{},
-	"flake":       FlakeDSchema(),
-	"flake_path":  FlakePathDSchema(),
-	"nix_options": NixOptionsDSchema(),
-	"nixpkgs":     NixpkgsDSchema(),
-	"out_link":    OutLinkDSchema(),
-	"working_dir": &dschema.WDDSchema{},
+	"arg":                 NixArgDSchema(),
+	"argstr":              NixArgstrDSchema(),
+	"build_attrs":         BuildAttrsDSchema(),
+	"build_path":          BuildPathDSchema(),
+	"closure_diff_base":   ClosureDiffBaseDSchema(),
+	"config":              NixOSConfigDSchema(),
+	"cross_system":        CrossSystemDSchema(),
+	"env":                 &dschema.EnvDSchema{},
+	"flake":               FlakeDSchema(),
+	"flake_path":          FlakePathDSchema(),
+	"inline_module":       NixOSInlineModuleDSchema(),
+	"log_path":            LogPathDSchema(),
+	"modules":             NixOSModulesDSchema(),
+	"nix_bin_dir":         NixBinDirDSchema(),
+	"nix_options":         NixOptionsDSchema(),
+	"nixpkgs":             NixpkgsDSchema(),
+	"nixpkgs_config_json": NixOSNixpkgsConfigDSchema(),
+	"out_link":            OutLinkDSchema(),
+	"overlays":            NixOSOverlaysDSchema(),
+	"query":               NixOSQueryDSchema(),
+	"scheduler_weight":    SchedulerWeightDSchema(),
+	"special_args_json":   NixOSSpecialArgsDSchema(),
+	"system":              SystemDSchema(),
+	"working_dir":         &dschema.WDDSchema{},
+}
+
+func BuildAttrsDSchema() dschema.DSchema {
+	return dschema.StringSliceDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type: schema.TypeList,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+					ValidateFunc: validation.StringMatch(
+						nixAttrNameRegexp,
+						"must be an attribute name",
+					),
+				},
+				Optional: true,
+				DefaultFunc: func() (interface{}, error) {
+					return []interface{}{}, nil
+				},
+				Description: "Attributes of config.system.build to build " +
+					"besides toplevel, such as \"vm\" or \"isoImage\"",
+			}
+		},
+	)
 }
 
 func SchemaOS() (m map[string]*schema.Schema) {
@@ -54,8 +97,42 @@ func SchemaOS() (m map[string]*schema.Schema) {
 			Computed:    true,
 			Description: "Nix store path of built NixOS configuration",
 		},
+		"eval_only": {
+			Type:     schema.TypeBool,
+			Optional: true,
+			Description: "Only evaluate the query, without building the " +
+				"configuration",
+		},
+		"query_results": {
+			Type:     schema.TypeMap,
+			Elem:     &schema.Schema{Type: schema.TypeString},
+			Computed: true,
+			Description: "Map of the names in query to the JSON encoded " +
+				"values of their options",
+		},
+		"build_outputs": {
+			Type:     schema.TypeMap,
+			Elem:     &schema.Schema{Type: schema.TypeString},
+			Computed: true,
+			Description: "Map of the attributes in build_attrs to their " +
+				"Nix store paths",
+		},
+		"config_schema": {
+			Type:     schema.TypeString,
+			Computed: true,
+			Description: "JSON schema of the type of the tfpn option, which " +
+				"config is checked against",
+		},
+		"out_system": {
+			Type:     schema.TypeString,
+			Computed: true,
+			Description: "Nix system the built NixOS configuration runs on. " +
+				"Equal to cross_system when cross-compiling",
+		},
 	}
 	dschema.AddSchema(OSDSchema, m)
+	AddClosureDiffSchema(m)
+	AddLogFileSchema(m)
 	return
 }
 
@@ -70,9 +147,14 @@ func ReadOS(
 		Rd: rd,
 		Pd: i.(*ProviderContext),
 	}
+	ctx, d = NewLogContext(ctx, cg, rd, "packernix_os")
+	if d.HasError() {
+		return
+	}
 
 	// working dir and env
-	wd, d := cg.Get(ctx, "working_dir")
+	wd, d0 := cg.Get(ctx, "working_dir")
+	d = append(d, d0...)
 	if d.HasError() {
 		return
 	}
@@ -83,28 +165,35 @@ func ReadOS(
 	}
 
 	// command
+	t, d0 := NixTools(ctx, cg, i)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
 	_, flake := rd.GetOk("installable")
-	exe := "nix"
-	cmdSlice := []string{}
-	if flake {
-		if !patches.SupportsNixFlake(ctx) {
-			return append(d, diag.Diagnostic{
-				Severity: diag.Error,
-				Summary:  "no flake support",
-			})
-		}
-		exe = patches.Nix()
-		cmdSlice = append(cmdSlice, "build")
-	} else {
-		exe = patches.NixBuild()
+	if flake && !t.SupportsNixFlake(ctx) {
+		return append(d, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  "no flake support",
+		})
 	}
+	evalOnly := rd.Get("eval_only").(bool)
 
-	// options
-	cmdSlice, d0 = AddNixOptions(ctx, cmdSlice, cg, i, false, true, flake)
+	// options, shared by the query and the build
+	cmdSlice, d0 := AddNixOptions(ctx, []string{}, cg, i, false, false, flake)
 	d = append(d, d0...)
 	if d.HasError() {
 		return
 	}
+	if !evalOnly {
+		d = append(
+			d,
+			CheckBuildSystem(ctx, cg, t, wd.(string), env.([]string))...,
+		)
+		if d.HasError() {
+			return
+		}
+	}
 
 	// build path
 	buildPathi, d0 := cg.Get(ctx, "build_path")
@@ -123,6 +212,14 @@ func ReadOS(
 			return d
 		}
 		defer os.RemoveAll(buildPath)
+	} else {
+		// Lock build path, since generated files are written to it
+		bpUL, d0 := LockBuildPath(ctx, i, buildPath)
+		d = append(d, d0...)
+		if d.HasError() {
+			return
+		}
+		defer bpUL.Unlock()
 	}
 	err = os.MkdirAll(buildPath, 0700)
 	if err != nil {
@@ -131,25 +228,27 @@ func ReadOS(
 	}
 	cmdSlice = append(cmdSlice, "-I", buildPath)
 
-	// tfpn config
+	// tfpn config and query
 	d = append(d, GenTFPNConfig(ctx, cg, buildPath)...)
 	if d.HasError() {
 		return
 	}
-
-	// Lock generated file
-	var tmplFile string
-	if flake {
-		tmplFile = filepath.Join(buildPath, "flake.nix")
-	} else {
-		tmplFile = filepath.Join(buildPath, "default.nix")
+	d = append(d, GenTFPNQuery(ctx, cg, buildPath)...)
+	if d.HasError() {
+		return
 	}
-	tmplUL, d0 := i.(*ProviderContext).FL.TryLock(tmplFile)
+
+	// extra modules and nixpkgs settings, recording the hashes of the paths
+	cmdSlice, d0 = GenTFPNModules(ctx, cg, buildPath, cmdSlice, flake)
 	d = append(d, d0...)
 	if d.HasError() {
 		return
 	}
-	defer tmplUL.Unlock()
+	d = append(d, cg.Set(ctx, "modules")...)
+	d = append(d, cg.Set(ctx, "overlays")...)
+	if d.HasError() {
+		return
+	}
 
 	// Generated Nix files
 	if flake {
@@ -162,34 +261,199 @@ func ReadOS(
 		return
 	}
 
-	// expression
-	inst := buildPath + "#nixosConfiguration.config.system.build.toplevel"
-	if flake {
-		cmdSlice = append(cmdSlice, inst)
-	} else {
-		cmdSlice = append(cmdSlice, buildPath)
+	sk := scheduler.NixBuild
+	if evalOnly {
+		sk = scheduler.Eval
+	}
+	release, d0 := Schedule(ctx, cg, i, sk, "os")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
 	}
+	defer release()
 
-	log.Printf("[DEBUG] %#v %#v", exe, cmdSlice)
-	cmd := exec.CommandContext(ctx, exe, cmdSlice...)
-	outb := &bytes.Buffer{}
-	cmd.Stdout = outb
-	cmd.Stderr = logwriter.New("[INFO] [os]", nil)
-	cmd.Dir = wd.(string)
-	cmd.Env = env.([]string)
-	err = cmd.Run()
-	d = exeFail(d, exe, cmdSlice, err)
+	// tfpn config, checked against the type of the tfpn option
+	cfgSchema, cfgSchemaRaw, d0 := RunNixOSConfigSchema(
+		ctx,
+		t,
+		buildPath,
+		cmdSlice,
+		flake,
+		wd.(string),
+		env.([]string),
+	)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	err = rd.Set("config_schema", cfgSchemaRaw)
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+		return d
+	}
+	d = append(d, ValidateTFPNConfig(ctx, cg, cfgSchema)...)
 	if d.HasError() {
 		return
 	}
 
-	outpath, d0 := GetOutPath(ctx, inst, wd, flake, outb.String())
+	// query, assertions and warnings, before the build so mistakes fail fast
+	e, d0 := RunNixOSEval(
+		ctx,
+		t,
+		buildPath,
+		cmdSlice,
+		flake,
+		wd.(string),
+		env.([]string),
+	)
 	d = append(d, d0...)
 	if d.HasError() {
 		return
 	}
+	d = append(d, e.Diagnostics()...)
+	if d.HasError() {
+		return
+	}
+	err = rd.Set("query_results", e.Query)
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+		return d
+	}
+
+	if evalOnly {
+		err = rd.Set("out_path", "")
+		if err == nil {
+			err = rd.Set("out_system", "")
+		}
+		if err == nil {
+			err = rd.Set("build_outputs", map[string]string{})
+		}
+		if err == nil {
+			err = rd.Set("closure_diff", "")
+		}
+		if err != nil {
+			d = append(d, diag.FromErr(err)...)
+			return d
+		}
+		rd.SetId(time.Now().UTC().String())
+		return
+	}
+
+	outLink, d0 := cg.Get(ctx, "out_link")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	// closure diff base, read before the build replaces out_link
+	diffBase, d0 := cg.Get(ctx, "closure_diff_base")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	prevOut := diffBase.(string) == "" && outLink.(string) != ""
+	if prevOut {
+		l := outLink.(string)
+		if !filepath.IsAbs(l) {
+			l = filepath.Join(wd.(string), l)
+		}
+		diffBase, _ = os.Readlink(l)
+	}
+	outpath, d0 := buildOSAttr(
+		ctx,
+		t,
+		buildPath,
+		cmdSlice,
+		flake,
+		wd.(string),
+		env.([]string),
+		"toplevel",
+		outLink.(string),
+	)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	outSystem, d0 := OutSystem(outpath)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	tracing.SpanFromContext(ctx).SetAttributes(
+		tracing.String("packernix.store_path", outpath),
+		tracing.String("packernix.system", outSystem),
+	)
+	closureDiff, err := ClosureDiff(
+		ctx,
+		t,
+		wd.(string),
+		env.([]string),
+		diffBase.(string),
+		outpath,
+	)
+	if err != nil {
+		// The previous target of out_link may have been garbage collected
+		sev := diag.Error
+		if prevOut {
+			sev = diag.Warning
+		}
+		d = append(d, diag.Diagnostic{
+			Severity:      sev,
+			AttributePath: cty.GetAttrPath("closure_diff_base"),
+			Summary:       "could not compute the closure diff",
+			Detail:        err.Error(),
+		})
+		if d.HasError() {
+			return
+		}
+	} else if closureDiff != "" {
+		// Data sources are read while planning, so unlike the warning of
+		// packernix_image, this one shows in the plan
+		d = append(d, diag.Diagnostic{
+			Severity: diag.Warning,
+			Summary:  "NixOS configuration changed",
+			Detail:   closureDiff,
+		})
+	}
+
+	// other system.build outputs
+	buildAttrs, d0 := cg.Get(ctx, "build_attrs")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	buildOutputs := map[string]string{}
+	for _, a := range buildAttrs.([]string) {
+		l := ""
+		if outLink.(string) != "" {
+			l = outLink.(string) + "-" + a
+		}
+		buildOutputs[a], d0 = buildOSAttr(
+			ctx,
+			t,
+			buildPath,
+			cmdSlice,
+			flake,
+			wd.(string),
+			env.([]string),
+			a,
+			l,
+		)
+		d = append(d, d0...)
+		if d.HasError() {
+			return
+		}
+	}
 
 	err = rd.Set("out_path", outpath)
+	if err == nil {
+		err = rd.Set("out_system", outSystem)
+	}
+	if err == nil {
+		err = rd.Set("build_outputs", buildOutputs)
+	}
+	if err == nil {
+		err = rd.Set("closure_diff", closureDiff)
+	}
 	if err != nil {
 		d = append(d, diag.FromErr(err)...)
 		return d
@@ -198,3 +462,59 @@ func ReadOS(
 
 	return
 }
+
+// Build an attribute of system.build of the generated Nix files, linked from
+// outLink if set. cmdSlice holds the options shared with the evaluation.
+func buildOSAttr(
+	ctx context.Context,
+	t *tools.Tools,
+	buildPath string,
+	cmdSlice []string,
+	flake bool,
+	wd string,
+	env []string,
+	attr string,
+	outLink string,
+) (outpath string, d diag.Diagnostics) {
+	var exe string
+	cs := []string{}
+	if flake {
+		exe = t.Nix()
+		cs = append(cs, "build")
+	} else {
+		exe = t.NixBuild()
+	}
+	cs = append(cs, cmdSlice...)
+	cs = addOutLinkFlags(cs, outLink, flake)
+
+	// expression
+	inst := buildPath + "#nixosConfiguration.config.system.build." + attr
+	if flake {
+		cs = append(cs, inst)
+	} else {
+		cs = append(cs, buildPath, "--attr", "tfpnBuild."+attr)
+	}
+
+	log.Printf("[DEBUG] %#v %#v", exe, cs)
+	cmd := exec.CommandContext(ctx, exe, cs...)
+	outb := &bytes.Buffer{}
+	cmd.Stdout = outb
+	cmd.Stderr = logwriter.New(fmt.Sprintf("[INFO] [os %s]", attr), nil)
+	cmd.Dir = wd
+	cmd.Env = env
+	c := newCommand(ctx, cmd)
+	defer c.Close()
+	err := c.Run(cmd.Run)
+	d = exeFail(ctx, d, exe, cs, err)
+	if d.HasError() {
+		return
+	}
+
+	outpath, d0 := GetOutPath(ctx, t, inst, wd, flake, outb.String())
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	c.IDs = []string{outpath}
+	return
+}
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
 
@@ -63,6 +64,15 @@ func TestAccDataSourceOS(t *testing.T) {
 							filepath.Join(td, "result-file"),
 							"out_path",
 						),
+						resource.TestCheckResourceAttrSet(
+							"data.packernix_os.file",
+							"out_system",
+						),
+						CheckSymlink(
+							"data.packernix_os.file",
+							filepath.Join(td, "result-file-etc"),
+							"build_outputs.etc",
+						),
 					),
 				},
 			},
@@ -91,6 +101,211 @@ func TestAccDataSourceOS(t *testing.T) {
 				},
 			},
 		},
+		"assertions": {
+			ProviderFactories: ProviderFactories(),
+			Steps: []resource.TestStep{
+				{
+					Config: ReadConfig(
+						t,
+						filepath.Join("os", "assertions.hcl"),
+						tmplS,
+					),
+					ExpectError: regexp.MustCompile("tfpn failing assertion"),
+				},
+			},
+		},
+		"typed": {
+			ProviderFactories: ProviderFactories(),
+			Steps: []resource.TestStep{
+				{
+					Config: ReadConfig(
+						t,
+						filepath.Join("os", "typed.hcl"),
+						tmplS,
+					),
+					ExpectError: regexp.MustCompile(".hostname: unknown key"),
+				},
+			},
+		},
+		"closure-diff": {
+			ProviderFactories: ProviderFactories(),
+			Steps: []resource.TestStep{
+				{
+					Config: ReadConfig(
+						t,
+						filepath.Join("os", "closure-diff.hcl"),
+						tmplS,
+					),
+					Check: resource.ComposeAggregateTestCheckFunc(
+						resource.TestMatchResourceAttr(
+							"data.packernix_os.closure_diff",
+							"closure_diff",
+							regexp.MustCompile(
+								"(?m)^nixos-system-otherhost: ∅ → ",
+							),
+						),
+						resource.TestCheckResourceAttr(
+							"data.packernix_os.base",
+							"closure_diff",
+							"",
+						),
+					),
+				},
+			},
+		},
+		"eval-only": {
+			ProviderFactories: ProviderFactories(),
+			Steps: []resource.TestStep{
+				{
+					Config: ReadConfig(
+						t,
+						filepath.Join("os", "eval-only.hcl"),
+						tmplS,
+					),
+					Check: resource.ComposeAggregateTestCheckFunc(
+						resource.TestCheckResourceAttr(
+							"data.packernix_os.eval_only",
+							"query_results.hostname",
+							`"tfpnhost"`,
+						),
+						resource.TestCheckResourceAttr(
+							"data.packernix_os.eval_only",
+							"query_results.ports",
+							"[22]",
+						),
+						resource.TestCheckResourceAttr(
+							"data.packernix_os.eval_only",
+							"out_path",
+							"",
+						),
+						resource.TestCheckResourceAttr(
+							"data.packernix_os.eval_only",
+							"config_schema",
+							"{}",
+						),
+					),
+				},
+			},
+		},
+		"modules": {
+			ProviderFactories: ProviderFactories(),
+			Steps: []resource.TestStep{
+				{
+					Config: ReadConfig(
+						t,
+						filepath.Join("os", "modules.hcl"),
+						tmplS,
+					),
+					Check: resource.ComposeAggregateTestCheckFunc(
+						resource.TestCheckResourceAttr(
+							"data.packernix_os.modules",
+							"query_results.motd",
+							`"hello"`,
+						),
+						resource.TestCheckResourceAttr(
+							"data.packernix_os.modules",
+							"query_results.domain",
+							`"example.com"`,
+						),
+						resource.TestCheckResourceAttr(
+							"data.packernix_os.modules",
+							"query_results.unfree",
+							"true",
+						),
+						resource.TestCheckResourceAttr(
+							"data.packernix_os.modules",
+							"query_results.overlay",
+							`"overlaid"`,
+						),
+						resource.TestCheckResourceAttrSet(
+							"data.packernix_os.modules",
+							"path_hashes.modules.0",
+						),
+					),
+				},
+			},
+		},
+		"flake-modules": {
+			ProviderFactories: ProviderFactories(),
+			Steps: []resource.TestStep{
+				{
+					Config: ReadConfig(
+						t,
+						filepath.Join("os", "flake-modules.hcl"),
+						tmplS,
+					),
+					SkipFunc: FlakeSkipFunc(ctx, t),
+					Check: resource.ComposeAggregateTestCheckFunc(
+						resource.TestCheckResourceAttr(
+							"data.packernix_os.flake_modules",
+							"query_results.motd",
+							`"hello"`,
+						),
+						resource.TestCheckResourceAttr(
+							"data.packernix_os.flake_modules",
+							"query_results.overlay",
+							`"overlaid"`,
+						),
+						resource.TestCheckResourceAttr(
+							"data.packernix_os.flake_modules",
+							"query_results.sibling",
+							`"sibling"`,
+						),
+					),
+				},
+			},
+		},
+		"special-args": {
+			ProviderFactories: ProviderFactories(),
+			Steps: []resource.TestStep{
+				{
+					Config: ReadConfig(
+						t,
+						filepath.Join("os", "special-args.hcl"),
+						tmplS,
+					),
+					SkipFunc: FlakeSkipFunc(ctx, t),
+					Check: resource.TestCheckResourceAttr(
+						"data.packernix_os.special_args",
+						"query_results.motd",
+						`"from specialArgs"`,
+					),
+				},
+			},
+		},
+		"system": {
+			ProviderFactories: ProviderFactories(),
+			Steps: []resource.TestStep{
+				{
+					Config: ReadConfig(
+						t,
+						filepath.Join("os", "system.hcl"),
+						tmplS,
+					),
+					// nixpkgs.system of the configuration is kept
+					Check: resource.TestCheckResourceAttr(
+						"data.packernix_os.system",
+						"query_results.system",
+						`"aarch64-linux"`,
+					),
+				},
+			},
+		},
+		"no-builder": {
+			ProviderFactories: ProviderFactories(),
+			Steps: []resource.TestStep{
+				{
+					Config: ReadConfig(
+						t,
+						filepath.Join("os", "no-builder.hcl"),
+						tmplS,
+					),
+					ExpectError: regexp.MustCompile(
+						"no Nix builder for mmix-mmixware",
+					),
+				},
+			},
+		},
 	}
 
 	for k, tt := range ts {
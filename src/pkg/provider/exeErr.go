@@ -5,13 +5,17 @@
 package provider
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/cmdlog"
 )
 
 func exeFail(
+	ctx context.Context,
 	d diag.Diagnostics,
 	exe string,
 	cmdSlice []string,
@@ -25,10 +29,14 @@ func exeFail(
 			fmt.Fprintf(shcmd, " %#v", a)
 		}
 		fmt.Fprintf(shcmd, "` failed: %s", err.Error())
+		detail := "Set TF_LOG=DEBUG to see command output"
+		if lf := cmdlog.FromContext(ctx); lf != "" {
+			detail = fmt.Sprintf("Command output is logged to %s", lf)
+		}
 		d = append(d, diag.Diagnostic{
 			Severity: diag.Error,
 			Summary:  shcmd.String(),
-			Detail:   "Set TF_LOG=DEBUG to see command output",
+			Detail:   detail,
 		})
 	}
 	return d
@@ -0,0 +1,91 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/tracing"
+)
+
+// Prepare the context of operation op of a resource of type kind. Commands
+// are recorded in the audit log, and a root span is started if tracing is
+// enabled.
+func instrument(
+	ctx context.Context,
+	i interface{},
+	kind string,
+	op string,
+) (context.Context, *tracing.Span) {
+	ctx = auditContext(ctx, i, kind, op)
+	if pc, ok := i.(*ProviderContext); ok && pc.Tracer != nil {
+		ctx = tracing.NewContext(ctx, pc.Tracer)
+	}
+	return tracing.Start(
+		ctx,
+		kind+"."+op,
+		tracing.String("packernix.resource_type", kind),
+		tracing.String("packernix.operation", op),
+	)
+}
+
+// Wrap a create, read, update or delete function
+func instrumentCRUD(
+	kind string,
+	op string,
+	f func(context.Context, *schema.ResourceData, interface{}) diag.Diagnostics,
+) func(context.Context, *schema.ResourceData, interface{}) diag.Diagnostics {
+	return func(
+		ctx context.Context,
+		rd *schema.ResourceData,
+		i interface{},
+	) (d diag.Diagnostics) {
+		ctx, span := instrument(ctx, i, kind, op)
+		defer span.End()
+		d = f(ctx, rd, i)
+		span.SetError(dschema.DiagsToErr(d))
+		return
+	}
+}
+
+// Wrap a CustomizeDiff function. Its operation is "plan".
+func instrumentDiff(
+	kind string,
+	f schema.CustomizeDiffFunc,
+) schema.CustomizeDiffFunc {
+	return func(
+		ctx context.Context,
+		rd *schema.ResourceDiff,
+		i interface{},
+	) (err error) {
+		ctx, span := instrument(ctx, i, kind, "plan")
+		defer span.End()
+		err = f(ctx, rd, i)
+		span.SetError(err)
+		return
+	}
+}
+
+// Wrap an import function
+func instrumentImport(
+	kind string,
+	f schema.StateContextFunc,
+) schema.StateContextFunc {
+	return func(
+		ctx context.Context,
+		rd *schema.ResourceData,
+		i interface{},
+	) (rds []*schema.ResourceData, err error) {
+		ctx, span := instrument(ctx, i, kind, "import")
+		defer span.End()
+		rds, err = f(ctx, rd, i)
+		span.SetError(err)
+		return
+	}
+}
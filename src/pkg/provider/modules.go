@@ -0,0 +1,299 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
+)
+
+func NixOSModulesDSchema() dschema.DSchema {
+	return &dschema.PathListDSchema{
+		Optional: true,
+		Description: "Paths to NixOS modules imported along with the main " +
+			"module. Respects working_dir",
+	}
+}
+
+func NixOSOverlaysDSchema() dschema.DSchema {
+	return &dschema.PathListDSchema{
+		Optional:    true,
+		Description: "Paths to Nixpkgs overlays. Respects working_dir",
+	}
+}
+
+func NixOSInlineModuleDSchema() dschema.DSchema {
+	return dschema.StringDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Nix expression of a NixOS module",
+			}
+		},
+	)
+}
+
+// An optional JSON encoded object
+func jsonObjectDSchema(description string) dschema.DSchema {
+	return dschema.StringDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type:             schema.TypeString,
+				Optional:         true,
+				DiffSuppressFunc: JSONDiffSuppressFunc,
+				ValidateDiagFunc: func(
+					i interface{},
+					p cty.Path,
+				) (d diag.Diagnostics) {
+					o, d := JSONValidateDiagFunc(i, p)
+					if d.HasError() {
+						return
+					}
+					if _, ok := o.(map[string]interface{}); !ok {
+						d = append(d, diag.Diagnostic{
+							Severity:      diag.Error,
+							AttributePath: p,
+							Summary:       "Must be a JSON encoded object",
+						})
+					}
+					return
+				},
+				Description: description,
+			}
+		},
+	)
+}
+
+func NixOSSpecialArgsDSchema() dschema.DSchema {
+	return jsonObjectDSchema("Extra special arguments of the NixOS modules " +
+		"encoded as JSON")
+}
+
+func NixOSNixpkgsConfigDSchema() dschema.DSchema {
+	return jsonObjectDSchema("Value of the nixpkgs.config NixOS option " +
+		"encoded as JSON")
+}
+
+// Decode an optional JSON encoded object
+func getJSONObject(
+	ctx context.Context,
+	dg dschema.DataGetter,
+	k string,
+) (o map[string]interface{}, d diag.Diagnostics) {
+	o = map[string]interface{}{}
+	si, d := dg.Get(ctx, k)
+	if d.HasError() || si.(string) == "" {
+		return
+	}
+	err := json.Unmarshal([]byte(si.(string)), &o)
+	if err != nil {
+		d = append(d, diag.Diagnostic{
+			Severity:      diag.Error,
+			AttributePath: cty.GetAttrPath(k),
+			Summary:       "Must be a JSON encoded object",
+			Detail:        err.Error(),
+		})
+	}
+	return
+}
+
+// Directory of buildPath the modules and overlays are copied to in flake mode
+const tfpnExtraDir = "tfpn-extra"
+
+// Copy the file or directory src to dst. Symbolic links in directories are
+// copied as is. .git directories and the directory skip are left out.
+func copyPath(src string, dst string, skip string) error {
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && p != src && (fi.Name() == ".git" || p == skip) {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, 0700)
+		case fi.Mode()&os.ModeSymlink != 0:
+			l, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(l, target)
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, b, fi.Mode().Perm()|0600)
+	})
+}
+
+// Copies of module and overlay directories in the tfpnExtraDir of a build
+// path
+type tfpnExtraCopies struct {
+	buildPath string
+	// Source directories to their copies, relative to buildPath
+	dirs map[string]string
+}
+
+// Copy the module or overlay p into the tfpnExtraDir, and return its path
+// relative to the build path. Files are copied along with the rest of their
+// directory, so that they can refer to their siblings. Each directory is only
+// copied once.
+func (c *tfpnExtraCopies) add(p string) (string, error) {
+	dir, name := p, ""
+	fi, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		dir, name = filepath.Dir(p), filepath.Base(p)
+	}
+	rel, ok := c.dirs[dir]
+	if !ok {
+		rel = filepath.Join(
+			tfpnExtraDir,
+			fmt.Sprintf("%d-%s", len(c.dirs), filepath.Base(dir)),
+		)
+		err = copyPath(dir, filepath.Join(c.buildPath, rel), c.buildPath)
+		if err != nil {
+			return "", err
+		}
+		c.dirs[dir] = rel
+	}
+	return filepath.Join(rel, name), nil
+}
+
+// Copy the modules or overlays in ps. Returns their paths relative to the
+// build path.
+func (c *tfpnExtraCopies) addAll(ps []string) ([]string, error) {
+	rs := make([]string, len(ps))
+	for i, p := range ps {
+		r, err := c.add(p)
+		if err != nil {
+			return nil, err
+		}
+		rs[i] = r
+	}
+	return rs, nil
+}
+
+// Write the extra modules and nixpkgs settings for the generated Nix files.
+// The module and overlay paths are added to the Nix search path, so they can
+// be read under restrict-eval. Flakes are evaluated purely, so in flake mode
+// they are copied into buildPath instead, with their directories, and their
+// paths are relative to it.
+func GenTFPNModules(
+	ctx context.Context,
+	dg dschema.DataGetter,
+	buildPath string,
+	cmdSlice []string,
+	flake bool,
+) (cs []string, d diag.Diagnostics) {
+	cs = cmdSlice
+	w := struct {
+		Modules       []string               `json:"modules"`
+		Overlays      []string               `json:"overlays"`
+		SpecialArgs   map[string]interface{} `json:"specialArgs"`
+		NixpkgsConfig map[string]interface{} `json:"nixpkgsConfig"`
+	}{}
+
+	mi, d0 := dg.Get(ctx, "modules")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	w.Modules = mi.([]string)
+	oi, d0 := dg.Get(ctx, "overlays")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	w.Overlays = oi.([]string)
+	if flake {
+		c := &tfpnExtraCopies{
+			buildPath: filepath.Clean(buildPath),
+			dirs:      map[string]string{},
+		}
+		err := os.RemoveAll(filepath.Join(buildPath, tfpnExtraDir))
+		if err == nil {
+			w.Modules, err = c.addAll(w.Modules)
+		}
+		if err == nil {
+			w.Overlays, err = c.addAll(w.Overlays)
+		}
+		if err != nil {
+			d = append(d, diag.FromErr(err)...)
+			return
+		}
+	} else {
+		for _, p := range append(w.Modules, w.Overlays...) {
+			cs = append(cs, "-I", p)
+		}
+	}
+
+	w.SpecialArgs, d0 = getJSONObject(ctx, dg, "special_args_json")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	w.NixpkgsConfig, d0 = getJSONObject(ctx, dg, "nixpkgs_config_json")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+
+	b, err := json.Marshal(w)
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+		return
+	}
+	err = ioutil.WriteFile(
+		filepath.Join(buildPath, "tfpn-modules.json"),
+		b,
+		0600,
+	)
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+		return
+	}
+
+	imi, d0 := dg.Get(ctx, "inline_module")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	inline := imi.(string)
+	if inline == "" {
+		inline = "{ }"
+	}
+	err = ioutil.WriteFile(
+		filepath.Join(buildPath, "tfpn-inline-module.nix"),
+		[]byte(inline),
+		0600,
+	)
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+	}
+	return
+}
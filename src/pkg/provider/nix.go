@@ -25,6 +25,7 @@ import (
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/logwriter"
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/patches"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/tools"
 )
 
 // Primary arguments
@@ -290,20 +291,23 @@ func AddNixOptions(
 		if d.HasError() {
 			return
 		}
-		if outlink.(string) != "" {
-			cs = append(cs, "--out-link", outlink.(string))
-		} else {
-			if flake {
-				cs = append(cs, "--no-link")
-			} else {
-				cs = append(cs, "--no-out-link")
-			}
-		}
+		cs = addOutLinkFlags(cs, outlink.(string), flake)
 	}
 
 	return
 }
 
+// Add the flags creating outlink, or preventing the default result link
+func addOutLinkFlags(cs []string, outlink string, flake bool) []string {
+	if outlink != "" {
+		return append(cs, "--out-link", outlink)
+	}
+	if flake {
+		return append(cs, "--no-link")
+	}
+	return append(cs, "--no-out-link")
+}
+
 func ParseFlake(
 	ctx context.Context,
 	dg dschema.DataGetter,
@@ -385,6 +389,7 @@ func AddNixExpression(
 
 func SetOutLink(
 	ctx context.Context,
+	t *tools.Tools,
 	dg dschema.DataGetter,
 	outjson string,
 	wd interface{},
@@ -419,7 +424,7 @@ func SetOutLink(
 	// TODO: See if nix 3.0 interface has a way to register gc roots
 	var exe string
 	cmdSlice := []string{}
-	exe = patches.NixStore()
+	exe = t.NixStore()
 	cmdSlice = append(
 		cmdSlice,
 		"--realise",
@@ -430,8 +435,11 @@ func SetOutLink(
 	cmd := exec.CommandContext(ctx, exe, cmdSlice...)
 	cmd.Stderr = logwriter.New("[INFO] [setoutlink]", nil)
 	cmd.Dir = wd.(string)
-	err = cmd.Run()
-	d = exeFail(d, exe, cmdSlice, err)
+	c := newCommand(ctx, cmd)
+	defer c.Close()
+	c.IDs = []string{outp}
+	err = c.Run(cmd.Run)
+	d = exeFail(ctx, d, exe, cmdSlice, err)
 	if d.HasError() {
 		return
 	}
@@ -442,10 +450,11 @@ func SetOutLink(
 // TODO: rewrite this if --raw output is added to nix build directly
 func getFlakeOutPath(
 	ctx context.Context,
+	t *tools.Tools,
 	inst string,
 	wd interface{},
 ) (string, diag.Diagnostics) {
-	exe := patches.Nix()
+	exe := t.Nix()
 	cmdSlice := []string{
 		"eval",
 		"--raw",
@@ -457,17 +466,21 @@ func getFlakeOutPath(
 	outb := &bytes.Buffer{}
 	cmd.Dir = wd.(string)
 	cmd.Stdout = outb
-	err := cmd.Run()
-	d := exeFail(nil, exe, cmdSlice, err)
+	c := newCommand(ctx, cmd)
+	defer c.Close()
+	err := c.Run(cmd.Run)
+	d := exeFail(ctx, nil, exe, cmdSlice, err)
 	if d.HasError() {
 		return "", d
 	}
 
+	c.IDs = []string{outb.String()}
 	return outb.String(), d
 }
 
 func GetOutPath(
 	ctx context.Context,
+	t *tools.Tools,
 	inst string,
 	wd interface{},
 	flake bool,
@@ -475,7 +488,7 @@ func GetOutPath(
 ) (outpath string, d diag.Diagnostics) {
 	var err error
 	if flake {
-		outpath, d = getFlakeOutPath(ctx, inst, wd)
+		outpath, d = getFlakeOutPath(ctx, t, inst, wd)
 		if d.HasError() {
 			return
 		}
@@ -540,13 +553,20 @@ func GenNixOSFile(
 		file = "./configuration.nix"
 	}
 
+	localSystem, crossSystem, d0 := NixOSSystems(ctx, dg)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+
 	share := patches.Share()
 	tfpnModPath := filepath.Join(
 		share,
 		"nixos",
 		"modules",
 	)
-	cs = append(cs, "-I", tfpnModPath)
+	tfpnLibPath := filepath.Join(share, "nixos", "lib")
+	cs = append(cs, "-I", tfpnModPath, "-I", tfpnLibPath)
 	cfgT, err := template.ParseFiles(
 		filepath.Join(share, "nixos", "template", "default.nix"),
 	)
@@ -570,10 +590,16 @@ func GenNixOSFile(
 			Nixpkgs     string
 			File        string
 			TfpnModPath string
+			TfpnLibPath string
+			LocalSystem string
+			CrossSystem string
 		}{
 			Nixpkgs:     nixpkgs,
 			File:        file,
 			TfpnModPath: tfpnModPath,
+			TfpnLibPath: tfpnLibPath,
+			LocalSystem: localSystem,
+			CrossSystem: crossSystem,
 		},
 	)
 	if err != nil {
@@ -612,8 +638,15 @@ func GenNixOSFlake(
 		return
 	}
 
+	localSystem, crossSystem, d0 := NixOSSystems(ctx, dg)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+
 	share := patches.Share()
 	tfpnModPath := filepath.Join(share, "nixos", "modules")
+	tfpnLibPath := filepath.Join(share, "nixos", "lib")
 
 	flakeT, err := template.ParseFiles(
 		filepath.Join(share, "nixos", "template", "flake.nix"),
@@ -639,11 +672,17 @@ func GenNixOSFlake(
 			Flake       string
 			Nixpkgs     string
 			TfpnModPath string
+			TfpnLibPath string
+			LocalSystem string
+			CrossSystem string
 		}{
 			Attr:        attr,
 			Flake:       flake,
 			Nixpkgs:     nixpkgs,
 			TfpnModPath: tfpnModPath,
+			TfpnLibPath: tfpnLibPath,
+			LocalSystem: localSystem,
+			CrossSystem: crossSystem,
 		},
 	)
 	if err != nil {
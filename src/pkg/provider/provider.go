@@ -7,12 +7,19 @@ package provider
 
 import (
 	"context"
+	"time"
 
+	"github.com/hashicorp/go-cty/cty"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/audit"
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/faillock"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/nar"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/scheduler"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/tools"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/tracing"
 )
 
 // Provider
@@ -20,15 +27,18 @@ func Provider() *schema.Provider {
 	return &schema.Provider{
 		Schema: ProviderSchema(),
 		ResourcesMap: map[string]*schema.Resource{
+			"packernix_deploy":   ResourceDeploy(),
 			"packernix_external": ResourceExternal(),
 			"packernix_image":    ResourceImage(),
+			"packernix_install":  ResourceInstall(),
 		},
 		DataSourcesMap: map[string]*schema.Resource{
-			"packernix_build":    DataSourceBuild(),
-			"packernix_const":    DataSourceConst(),
-			"packernix_eval":     DataSourceEval(),
-			"packernix_external": DataSourceExternal(),
-			"packernix_os":       DataSourceOS(),
+			"packernix_build":                      DataSourceBuild(),
+			"packernix_const":                      DataSourceConst(),
+			"packernix_eval":                       DataSourceEval(),
+			"packernix_external":                   DataSourceExternal(),
+			"packernix_flake_nixos_configurations": DataSourceFlakeNixOSConfigurations(),
+			"packernix_os":                         DataSourceOS(),
 		},
 		ConfigureContextFunc: ConfigureContextFunc,
 	}
@@ -37,17 +47,44 @@ func Provider() *schema.Provider {
 func ProviderSchema() (m map[string]*schema.Schema) {
 	m = map[string]*schema.Schema{}
 	dschema.AddPSchema(BuildDSchema, m)
+	dschema.AddPSchema(DeployDSchema, m)
 	dschema.AddPSchema(EvalDSchema, m)
 	dschema.AddPSchema(ExternalDSchema, m)
+	dschema.AddPSchema(FlakeNixOSConfigurationsDSchema, m)
 	dschema.AddPSchema(ImageDSchema, m)
+	dschema.AddPSchema(InstallDSchema, m)
 	dschema.AddPSchema(OSDSchema, m)
+	AddSchedulerPSchema(m)
+	AddAuditPSchema(m)
+	AddTracingPSchema(m)
+	AddSecretFilesPSchema(m)
+	m["build_lock_timeout"] = &schema.Schema{
+		Type:     schema.TypeString,
+		Optional: true,
+		ValidateDiagFunc: func(
+			i interface{},
+			p cty.Path,
+		) diag.Diagnostics {
+			_, err := time.ParseDuration(i.(string))
+			return diag.FromErr(err)
+		},
+		Description: "How long to wait for a locked build_path",
+	}
 	return
 }
 
 // Context passed to resources. Mainly default directories
 type ProviderContext struct {
-	DMap map[string]interface{}
-	FL   *faillock.Faillock
+	Audit       *audit.Log
+	DMap        map[string]interface{}
+	FL          *faillock.Faillock
+	LockTimeout time.Duration
+	NarCache    *nar.Cache
+	Sched       *scheduler.Scheduler
+	// Key of the HMAC of secret_files. Empty if unset
+	SecretFilesKey []byte
+	Tools          *tools.Tools
+	Tracer         *tracing.Tracer
 }
 
 func (c *ProviderContext) ProviderDefaults() map[string]interface{} {
@@ -56,11 +93,34 @@ func (c *ProviderContext) ProviderDefaults() map[string]interface{} {
 
 func NewProviderContext() *ProviderContext {
 	return &ProviderContext{
-		DMap: map[string]interface{}{},
-		FL:   faillock.New(),
+		DMap:     map[string]interface{}{},
+		FL:       faillock.New(),
+		NarCache: nar.NewCache(),
+		Sched:    scheduler.New(nil),
+		Tools:    &tools.Tools{Run: runToolCommand},
 	}
 }
 
+// Hash paths, reusing hashes of unchanged trees
+func (c *ProviderContext) HashPath(
+	ctx context.Context,
+	p string,
+	f nar.Filter,
+) (string, error) {
+	ctx, span := tracing.Start(
+		ctx,
+		"hash_path",
+		tracing.String("packernix.path", p),
+	)
+	defer span.End()
+	start := time.Now()
+	h, err := c.NarCache.HashPathFilter(p, f)
+	auditHashPath(ctx, start, p, h, err)
+	span.SetAttributes(tracing.String("packernix.hash", h))
+	span.SetError(err)
+	return h, err
+}
+
 // Configure context func
 func ConfigureContextFunc(
 	ctx context.Context,
@@ -72,7 +132,12 @@ func ConfigureContextFunc(
 	if d.HasError() {
 		return
 	}
-	c, d0 := dschema.Configure(ctx, EvalDSchema, rd, c)
+	c, d0 := dschema.Configure(ctx, DeployDSchema, rd, c)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	c, d0 = dschema.Configure(ctx, EvalDSchema, rd, c)
 	d = append(d, d0...)
 	if d.HasError() {
 		return
@@ -82,12 +147,64 @@ func ConfigureContextFunc(
 	if d.HasError() {
 		return
 	}
+	c, d0 = dschema.Configure(ctx, FlakeNixOSConfigurationsDSchema, rd, c)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
 	c, d0 = dschema.Configure(ctx, ImageDSchema, rd, c)
 	d = append(d, d0...)
 	if d.HasError() {
 		return
 	}
+	c, d0 = dschema.Configure(ctx, InstallDSchema, rd, c)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
 	c, d0 = dschema.Configure(ctx, OSDSchema, rd, c)
 	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	d = append(d, ConfigureTools(c.(*ProviderContext))...)
+	if d.HasError() {
+		return
+	}
+	d = append(d, ConfigureScheduler(c.(*ProviderContext), rd)...)
+	if d.HasError() {
+		return
+	}
+	d = append(d, ConfigureAudit(c.(*ProviderContext), rd)...)
+	if d.HasError() {
+		return
+	}
+	d = append(d, ConfigureTracing(c.(*ProviderContext), rd)...)
+	if d.HasError() {
+		return
+	}
+	ConfigureSecretFiles(c.(*ProviderContext), rd)
+	lt, ok := rd.GetOk("build_lock_timeout")
+	if ok {
+		c.(*ProviderContext).LockTimeout, _ = time.ParseDuration(lt.(string))
+	}
 	return c, d
 }
+
+// Lock a build_path against use by other resources and processes
+func LockBuildPath(
+	ctx context.Context,
+	i interface{},
+	p string,
+) (*faillock.Unlocker, diag.Diagnostics) {
+	pc := i.(*ProviderContext)
+	ctx, span := tracing.Start(
+		ctx,
+		"lock_build_path",
+		tracing.String("packernix.path", p),
+	)
+	defer span.End()
+	ul, d := pc.FL.Lock(ctx, p, pc.LockTimeout)
+	span.SetError(dschema.DiagsToErr(d))
+	return ul, d
+}
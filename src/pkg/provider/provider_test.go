@@ -5,15 +5,22 @@
 package provider_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"text/template"
 
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
 
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/audit"
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/patches"
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/provider"
 )
@@ -73,3 +80,26 @@ func FlakeSkipFunc(ctx context.Context, t *testing.T) func() (bool, error) {
 		return
 	}
 }
+
+// Check that the file at p contains an audit log entry of a command with args
+func testCheckAuditLog(p string, args ...string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			e := &audit.Entry{}
+			err = json.Unmarshal(scanner.Bytes(), e)
+			if err != nil {
+				return err
+			}
+			if reflect.DeepEqual(e.Args, args) && e.ExitCode == 0 {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s has no entry with args %#v", p, args)
+	}
+}
@@ -0,0 +1,272 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/logwriter"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/tools"
+)
+
+func NixOSQueryDSchema() dschema.DSchema {
+	return dschema.StringMapDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type:     schema.TypeMap,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+				Optional: true,
+				ValidateDiagFunc: func(
+					i interface{},
+					p cty.Path,
+				) (d diag.Diagnostics) {
+					for k, v := range i.(map[string]interface{}) {
+						_, err := ParseOptionPath(v.(string))
+						if err != nil {
+							d = append(d, diag.Diagnostic{
+								Severity:      diag.Error,
+								AttributePath: p.IndexString(k),
+								Summary:       err.Error(),
+							})
+						}
+					}
+					return
+				},
+				Description: "Map of names to NixOS option paths to evaluate",
+			}
+		},
+	)
+}
+
+// Split an option path like `services.nginx.virtualHosts."example.com"` into
+// attribute names. Names containing dots must be quoted. Quotes must surround
+// a whole name.
+func ParseOptionPath(s string) (p []string, err error) {
+	var b strings.Builder
+	quoted := false
+	escaped := false
+	started := false
+	// A quoted name just ended, so only a dot may follow
+	closed := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			b.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case quoted && r == '"':
+			quoted = false
+			closed = true
+		case quoted:
+			b.WriteRune(r)
+		case r == '.':
+			if !started {
+				return nil, fmt.Errorf("empty attribute name in %#v", s)
+			}
+			p = append(p, b.String())
+			b.Reset()
+			started = false
+			closed = false
+		case closed:
+			return nil, fmt.Errorf(
+				"unexpected %#v after a quoted attribute name in %#v",
+				string(r),
+				s,
+			)
+		case r == '"':
+			if started {
+				return nil, fmt.Errorf(
+					"quote inside an attribute name in %#v",
+					s,
+				)
+			}
+			quoted = true
+			started = true
+		default:
+			b.WriteRune(r)
+			started = true
+		}
+	}
+	if quoted || escaped {
+		return nil, fmt.Errorf("unterminated quote in %#v", s)
+	}
+	if !started {
+		return nil, fmt.Errorf("empty attribute name in %#v", s)
+	}
+	p = append(p, b.String())
+	return
+}
+
+// Write the parsed query for the generated Nix files
+func GenTFPNQuery(
+	ctx context.Context,
+	dg dschema.DataGetter,
+	buildPath string,
+) (d diag.Diagnostics) {
+	qi, d := dg.Get(ctx, "query")
+	if d.HasError() {
+		return
+	}
+	query := map[string][]string{}
+	for k, v := range qi.(map[string]string) {
+		p, err := ParseOptionPath(v)
+		if err != nil {
+			d = append(d, diag.Diagnostic{
+				Severity:      diag.Error,
+				AttributePath: cty.GetAttrPath("query").IndexString(k),
+				Summary:       err.Error(),
+			})
+			return
+		}
+		query[k] = p
+	}
+	b, err := json.Marshal(query)
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+		return
+	}
+	err = ioutil.WriteFile(
+		filepath.Join(buildPath, "tfpn-query.json"),
+		b,
+		0600,
+	)
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+	}
+	return
+}
+
+// Results of evaluating tfpnEval in the generated Nix files
+type NixOSEval struct {
+	// Query results, JSON encoded
+	Query            map[string]string
+	FailedAssertions []string
+	Warnings         []string
+}
+
+// Diagnostics for the assertions and warnings of the configuration
+func (e *NixOSEval) Diagnostics() (d diag.Diagnostics) {
+	for _, w := range e.Warnings {
+		d = append(d, diag.Diagnostic{
+			Severity: diag.Warning,
+			Summary:  "NixOS warning",
+			Detail:   w,
+		})
+	}
+	for _, a := range e.FailedAssertions {
+		d = append(d, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  "NixOS assertion failed",
+			Detail:   a,
+		})
+	}
+	return
+}
+
+// Evaluate an attribute of the generated Nix files as JSON. cmdSlice holds the
+// options shared with the build.
+func evalNixOSAttr(
+	ctx context.Context,
+	t *tools.Tools,
+	buildPath string,
+	cmdSlice []string,
+	flake bool,
+	wd string,
+	env []string,
+	attr string,
+) (out []byte, d diag.Diagnostics) {
+	var exe string
+	cs := []string{}
+	if flake {
+		exe = t.Nix()
+		cs = append(cs, "eval", "--json")
+		cs = append(cs, cmdSlice...)
+		cs = append(cs, buildPath+"#"+attr)
+	} else {
+		exe = t.NixInstantiate()
+		cs = append(cs, "--eval", "--strict", "--json")
+		cs = append(cs, cmdSlice...)
+		cs = append(cs, buildPath, "--attr", attr)
+	}
+
+	log.Printf("[DEBUG] %#v %#v", exe, cs)
+	cmd := exec.CommandContext(ctx, exe, cs...)
+	outb := &bytes.Buffer{}
+	cmd.Stdout = outb
+	cmd.Stderr = logwriter.New(fmt.Sprintf("[INFO] [os %s]", attr), nil)
+	cmd.Dir = wd
+	cmd.Env = env
+	c := newCommand(ctx, cmd)
+	defer c.Close()
+	err := c.Run(cmd.Run)
+	d = exeFail(ctx, d, exe, cs, err)
+	out = outb.Bytes()
+	return
+}
+
+// Evaluate the tfpnEval attribute of the generated Nix files. cmdSlice holds
+// the options shared with the build.
+func RunNixOSEval(
+	ctx context.Context,
+	t *tools.Tools,
+	buildPath string,
+	cmdSlice []string,
+	flake bool,
+	wd string,
+	env []string,
+) (e NixOSEval, d diag.Diagnostics) {
+	out, d := evalNixOSAttr(
+		ctx,
+		t,
+		buildPath,
+		cmdSlice,
+		flake,
+		wd,
+		env,
+		"tfpnEval",
+	)
+	if d.HasError() {
+		return
+	}
+
+	raw := struct {
+		Query            map[string]json.RawMessage `json:"query"`
+		FailedAssertions []string                   `json:"failedAssertions"`
+		Warnings         []string                   `json:"warnings"`
+	}{}
+	err := json.Unmarshal(out, &raw)
+	if err != nil {
+		d = append(d, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  "could not parse the evaluated NixOS configuration",
+			Detail:   err.Error(),
+		})
+		return
+	}
+	e = NixOSEval{
+		Query:            map[string]string{},
+		FailedAssertions: raw.FailedAssertions,
+		Warnings:         raw.Warnings,
+	}
+	for k, v := range raw.Query {
+		e.Query[k] = string(v)
+	}
+	return
+}
@@ -0,0 +1,87 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/provider"
+)
+
+func TestParseOptionPath(t *testing.T) {
+	ts := []struct {
+		in       string
+		expected []string
+	}{
+		{
+			in:       "networking.hostName",
+			expected: []string{"networking", "hostName"},
+		},
+		{
+			in: `services.nginx.virtualHosts."example.com".root`,
+			expected: []string{
+				"services",
+				"nginx",
+				"virtualHosts",
+				"example.com",
+				"root",
+			},
+		},
+		{
+			in:       `users.users."a\"b".name`,
+			expected: []string{"users", "users", `a"b`, "name"},
+		},
+		{
+			in:       `a.""`,
+			expected: []string{"a", ""},
+		},
+		{in: ""},
+		{in: "a..b"},
+		{in: "a."},
+		{in: `a."b`},
+		{in: `foo"bar".baz`},
+		{in: `"foo"bar.baz`},
+		{in: `a."b""c"`},
+	}
+	for _, tt := range ts {
+		p, err := ParseOptionPath(tt.in)
+		if tt.expected == nil {
+			if err == nil {
+				t.Errorf("%#v: expected an error, got %#v", tt.in, p)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%#v: %s", tt.in, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(p, tt.expected) {
+			t.Errorf("%#v: expected %#v, got %#v", tt.in, tt.expected, p)
+		}
+	}
+}
+
+func TestNixOSEvalDiagnostics(t *testing.T) {
+	e := NixOSEval{
+		FailedAssertions: []string{"a"},
+		Warnings:         []string{"w"},
+	}
+	d := e.Diagnostics()
+	if len(d) != 2 {
+		t.Fatalf("expected 2 diagnostics, got %#v", d)
+	}
+	if d[0].Severity != diag.Warning || d[0].Detail != "w" {
+		t.Errorf("unexpected warning %#v", d[0])
+	}
+	if d[1].Severity != diag.Error || d[1].Detail != "a" {
+		t.Errorf("unexpected error %#v", d[1])
+	}
+	if (&NixOSEval{}).Diagnostics().HasError() {
+		t.Errorf("empty evaluation has errors")
+	}
+}
@@ -0,0 +1,768 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/cmdlog"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/logwriter"
+)
+
+// Exit code of the deploy script signaling that a failed activation was
+// rolled back
+const deployRolledBackExitCode = 3
+
+var storePathRegexp = regexp.MustCompile(`^/[^\s'"]+$`)
+
+// Switch the system profile of a NixOS host, like nixos_infect.sh. Run with
+// sh -s. The arguments are the operation (deploy, rollback or status), the
+// system store path, the switch-to-configuration action, the generation to
+// roll back to, and the root directory of a local target, if any. All output
+// goes to stderr, except for the results of the operation.
+const deployScript = `set -u
+op="$1"
+system="$2"
+action="$3"
+gen="$4"
+root="${5:-}"
+profile=/nix/var/nix/profiles/system
+exec 3>&1 1>&2
+
+# https://github.com/NixOS/nixpkgs/issues/38991
+export LOCALE_ARCHIVE="$system/sw/lib/locale/locale-archive"
+
+generation() {
+  l=$(readlink "$root$profile" 2>/dev/null) || { echo 0; return; }
+  l="${l#system-}"
+  echo "${l%-link}"
+}
+
+generation_system() {
+  readlink "$root$profile-$1-link" 2>/dev/null || echo -
+}
+
+set_profile() {
+  if [ -n "$root" ]; then
+    "$system/sw/bin/nix-env" --store "$root" -p "$root$profile" "$@"
+  else
+    "$system/sw/bin/nix-env" -p "$profile" "$@"
+  fi
+}
+
+activate() {
+  if [ -n "$root" ]; then
+    mkdir -m 0755 -p "$root/etc"
+    touch "$root/etc/NIXOS"
+    NIXOS_INSTALL_BOOTLOADER=1 "$system/sw/bin/nixos-enter" --root "$root" -- \
+      "$1/bin/switch-to-configuration" "$action"
+  else
+    "$1/bin/switch-to-configuration" "$action"
+  fi
+}
+
+case "$op" in
+status)
+  gen=$(generation)
+  current=-
+  if [ -z "$root" ]; then
+    current=$(readlink /run/current-system 2>/dev/null || echo -)
+  fi
+  echo "$gen $(generation_system "$gen") $current" >&3
+  ;;
+deploy)
+  prev=$(generation)
+  if [ "$action" != test ]; then
+    set_profile --set "$system" || exit 1
+  fi
+  if ! activate "$system"; then
+    [ "$prev" = 0 ] && exit 1
+    echo "activation failed, rolling back to generation $prev"
+    if [ "$action" != test ]; then
+      set_profile --switch-generation "$prev" || exit 1
+    fi
+    activate "$(generation_system "$prev")" || exit 1
+    exit 3
+  fi
+  echo "$prev $(generation)" >&3
+  ;;
+rollback)
+  if [ "$action" != test ]; then
+    set_profile --switch-generation "$gen" || exit 1
+  fi
+  activate "$(generation_system "$gen")" || exit 1
+  ;;
+*)
+  echo "unknown operation $op"
+  exit 1
+  ;;
+esac
+`
+
+func ResourceDeploy() *schema.Resource {
+	r := &schema.Resource{
+		Schema:        SchemaDeploy(),
+		CreateContext: instrumentCRUD("packernix_deploy", "create", CreateDeploy),
+		ReadContext:   instrumentCRUD("packernix_deploy", "read", ReadDeploy),
+		UpdateContext: instrumentCRUD("packernix_deploy", "update", UpdateDeploy),
+		DeleteContext: instrumentCRUD("packernix_deploy", "delete", DeleteDeploy),
+		CustomizeDiff: instrumentDiff("packernix_deploy", CustomizeDiffDeploy),
+		Description:   "A NixOS system deployed to a running host",
+	}
+	r.SchemaVersion = dschema.SchemaVersion(DeployDSchema)
+	r.StateUpgraders = dschema.StateUpgraders(
+		DeployDSchema,
+		r.CoreConfigSchema().ImpliedType(),
+	)
+	return r
+}
+
+var DeployDSchema = map[string]dschema.DSchema{
+	"system": dschema.StringDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ValidateFunc: validation.StringMatch(
+					storePathRegexp,
+					"must be a Nix store path",
+				),
+				Description: "Nix store path of the NixOS configuration",
+			}
+		},
+	),
+	"action": dschema.StringDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "switch",
+				ValidateFunc: validation.StringInSlice(
+					[]string{"switch", "boot", "test"},
+					false,
+				),
+				Description: "Action passed to switch-to-configuration",
+			}
+		},
+	),
+	"host": dschema.StringDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				ExactlyOneOf: []string{"host", "root"},
+				Description:  "Host to deploy to over SSH",
+			}
+		},
+	),
+	"user": dschema.StringDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Default:     "root",
+				Description: "SSH user",
+			}
+		},
+	),
+	"port": dschema.IntDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ForceNew:     true,
+				Default:      22,
+				ValidateFunc: validation.IsPortNumber,
+				Description:  "SSH port",
+			}
+		},
+	),
+	"private_key": dschema.StringDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				Sensitive:   true,
+				Description: "Content of the SSH private key",
+			}
+		},
+	),
+	"ssh_options": dschema.StringSliceDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type: schema.TypeList,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+					// Nix splits NIX_SSHOPTS on whitespace
+					ValidateFunc: validation.StringDoesNotMatch(
+						regexp.MustCompile(`\s`),
+						"must not contain whitespace, since it is passed "+
+							"to Nix in NIX_SSHOPTS",
+					),
+				},
+				Optional: true,
+				DefaultFunc: func() (interface{}, error) {
+					return []interface{}{}, nil
+				},
+				Description: "Extra arguments passed to ssh, without " +
+					"whitespace",
+			}
+		},
+	),
+	"root": &dschema.PathDSchema{
+		Optional:      true,
+		ForceNew:      true,
+		SkipHashCheck: true,
+		ExactlyOneOf:  []string{"host", "root"},
+		Description: "Local directory to deploy to instead of a host, " +
+			"such as a mounted disk",
+	},
+	"env":         &dschema.EnvDSchema{},
+	"log_path":    LogPathDSchema(),
+	"nix_bin_dir": NixBinDirDSchema(),
+	"working_dir": &dschema.WDDSchema{},
+}
+
+func SchemaDeploy() (m map[string]*schema.Schema) {
+	m = map[string]*schema.Schema{
+		"substitute_on_destination": {
+			Type:     schema.TypeBool,
+			Optional: true,
+			Description: "Let the target download store paths from its " +
+				"substituters instead of copying them",
+		},
+		"rollback_on_destroy": {
+			Type:     schema.TypeBool,
+			Optional: true,
+			Default:  true,
+			Description: "Switch back to the generation before the first " +
+				"deploy when destroyed",
+		},
+		"generation": {
+			Type:        schema.TypeInt,
+			Computed:    true,
+			Description: "Generation of the system profile deployed",
+		},
+		"previous_generation": {
+			Type:     schema.TypeInt,
+			Computed: true,
+			Description: "Generation of the system profile before the " +
+				"first deploy. 0 if there was none",
+		},
+	}
+	dschema.AddSchema(DeployDSchema, m)
+	AddLogFileSchema(m)
+	return
+}
+
+// Where a system is deployed to
+type DeployTarget struct {
+	Host       string
+	User       string
+	Port       int
+	KeyFile    string
+	SSHOptions []string
+	// Set for local targets
+	Root string
+}
+
+// Get the target of a resource. If a private key is set, it is written to a
+// temporary file, which cleanup removes.
+func GetDeployTarget(
+	ctx context.Context,
+	dg dschema.DataGetter,
+) (dt *DeployTarget, cleanup func(), d diag.Diagnostics) {
+	cleanup = func() {}
+	vs := map[string]interface{}{}
+	for _, k := range []string{
+		"host",
+		"user",
+		"port",
+		"private_key",
+		"ssh_options",
+		"root",
+	} {
+		v, d0 := dg.Get(ctx, k)
+		d = append(d, d0...)
+		if d.HasError() {
+			return
+		}
+		vs[k] = v
+	}
+	dt = &DeployTarget{
+		Host:       vs["host"].(string),
+		User:       vs["user"].(string),
+		Port:       vs["port"].(int),
+		SSHOptions: vs["ssh_options"].([]string),
+		Root:       vs["root"].(string),
+	}
+	key := vs["private_key"].(string)
+	if key == "" || dt.Root != "" {
+		return
+	}
+	kd, err := ioutil.TempDir("", "terraform-provider-packernix-ssh")
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+		return
+	}
+	cleanup = func() { os.RemoveAll(kd) }
+	dt.KeyFile = filepath.Join(kd, "id")
+	if strings.ContainsAny(dt.KeyFile, " \t\n") {
+		d = append(d, diag.Diagnostic{
+			Severity:      diag.Error,
+			AttributePath: cty.GetAttrPath("private_key"),
+			Summary: "the temporary key file path contains whitespace, " +
+				"which Nix cannot read from NIX_SSHOPTS",
+			Detail: fmt.Sprintf(
+				"Set TMPDIR to a directory without whitespace instead of %s",
+				filepath.Dir(kd),
+			),
+		})
+		return
+	}
+	// ssh rejects keys without a trailing newline
+	if !strings.HasSuffix(key, "\n") {
+		key += "\n"
+	}
+	err = ioutil.WriteFile(dt.KeyFile, []byte(key), 0600)
+	if err != nil {
+		d = append(d, diag.Diagnostic{
+			Severity:      diag.Error,
+			AttributePath: cty.GetAttrPath("private_key"),
+			Summary:       err.Error(),
+		})
+	}
+	return
+}
+
+// ID of the target
+func (dt *DeployTarget) String() string {
+	if dt.Root != "" {
+		return dt.Root
+	}
+	return fmt.Sprintf("%s@%s:%d", dt.User, dt.Host, dt.Port)
+}
+
+// Options passed to ssh, and to Nix in NIX_SSHOPTS. Nix splits NIX_SSHOPTS on
+// whitespace, so none of them may contain any.
+func (dt *DeployTarget) SSHArgs() []string {
+	args := []string{
+		"-o", "BatchMode=yes",
+		"-p", strconv.Itoa(dt.Port),
+	}
+	if dt.KeyFile != "" {
+		args = append(args, "-i", dt.KeyFile)
+	}
+	return append(args, dt.SSHOptions...)
+}
+
+// Command running the deploy script on the target with args. sh and ssh are
+// looked up in the PATH of the provider.
+func (dt *DeployTarget) ScriptCommand(
+	ctx context.Context,
+	args ...string,
+) *exec.Cmd {
+	var cmd *exec.Cmd
+	if dt.Root != "" {
+		cs := append([]string{"-s", "--"}, args...)
+		cs = append(cs, dt.Root)
+		cmd = exec.CommandContext(ctx, "sh", cs...)
+	} else {
+		// ssh joins its arguments into a remote shell command
+		cs := append(dt.SSHArgs(), dt.User+"@"+dt.Host, "sh", "-s", "--")
+		for _, a := range args {
+			cs = append(cs, shellQuote(a))
+		}
+		cmd = exec.CommandContext(ctx, "ssh", cs...)
+	}
+	cmd.Stdin = strings.NewReader(deployScript)
+	return cmd
+}
+
+// Run the deploy script on the target. Returns the fields of its output.
+func runDeployScript(
+	ctx context.Context,
+	dt *DeployTarget,
+	env []string,
+	args ...string,
+) (fs []string, err error) {
+	cmd := dt.ScriptCommand(ctx, args...)
+	outb := &bytes.Buffer{}
+	cmd.Stdout = outb
+	cmd.Stderr = logwriter.New(fmt.Sprintf("[INFO] [deploy %s]", args[0]), nil)
+	cmd.Env = env
+	log.Printf("[DEBUG] %#v %#v", cmd.Path, cmd.Args[1:])
+	c := newCommand(ctx, cmd)
+	defer c.Close()
+	c.IDs = []string{dt.String()}
+	err = c.Run(cmd.Run)
+	fs = strings.Fields(outb.String())
+	for i, f := range fs {
+		if f == "-" {
+			fs[i] = ""
+		}
+	}
+	return
+}
+
+// Diagnose a failed run of the deploy script
+func deployScriptFail(
+	ctx context.Context,
+	d diag.Diagnostics,
+	op string,
+	err error,
+) diag.Diagnostics {
+	if err == nil {
+		return d
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.ExitCode() == deployRolledBackExitCode {
+		err = errors.New("activation failed, rolled back to the previous " +
+			"generation")
+	}
+	detail := "Set TF_LOG=DEBUG to see command output"
+	if lf := cmdlog.FromContext(ctx); lf != "" {
+		detail = fmt.Sprintf("Command output is logged to %s", lf)
+	}
+	return append(d, diag.Diagnostic{
+		Severity: diag.Error,
+		Summary:  fmt.Sprintf("%s failed: %s", op, err.Error()),
+		Detail:   detail,
+	})
+}
+
+// Copy the closure of system to the target
+func CopyClosure(
+	ctx context.Context,
+	dg dschema.DataGetter,
+	i interface{},
+	dt *DeployTarget,
+	env []string,
+	system string,
+	substitute bool,
+) (d diag.Diagnostics) {
+	t, d := NixTools(ctx, dg, i)
+	if d.HasError() {
+		return
+	}
+	exe := t.Nix()
+	cs := []string{
+		"copy",
+		"--option", "extra-experimental-features", "nix-command",
+	}
+	if dt.Root != "" {
+		// As nixos-install does
+		cs = append(cs, "--to", dt.Root, "--no-check-sigs")
+	} else {
+		cs = append(cs, "--to", "ssh://"+dt.User+"@"+dt.Host)
+		env = append(env, "NIX_SSHOPTS="+strings.Join(dt.SSHArgs(), " "))
+	}
+	if substitute {
+		cs = append(cs, "--substitute-on-destination")
+	}
+	cs = append(cs, system)
+
+	log.Printf("[DEBUG] %#v %#v", exe, cs)
+	cmd := exec.CommandContext(ctx, exe, cs...)
+	cmd.Stdout = logwriter.New("[INFO] [deploy copy]", nil)
+	cmd.Stderr = logwriter.New("[INFO] [deploy copy]", nil)
+	cmd.Env = env
+	c := newCommand(ctx, cmd)
+	defer c.Close()
+	c.IDs = []string{system}
+	err := c.Run(cmd.Run)
+	return exeFail(ctx, d, exe, cs, err)
+}
+
+// Copy the system of a resource to its target and activate it. Returns the
+// generations of the system profile before and after.
+func RunDeploy(
+	ctx context.Context,
+	dg dschema.DataGetter,
+	rd interface{ Get(string) interface{} },
+	i interface{},
+) (dt *DeployTarget, prev int, gen int, d diag.Diagnostics) {
+	dt, cleanup, d := GetDeployTarget(ctx, dg)
+	defer cleanup()
+	if d.HasError() {
+		return
+	}
+	vs := map[string]interface{}{}
+	for _, k := range []string{"system", "action", "env"} {
+		v, d0 := dg.Get(ctx, k)
+		d = append(d, d0...)
+		if d.HasError() {
+			return
+		}
+		vs[k] = v
+	}
+	system := vs["system"].(string)
+	env := vs["env"].([]string)
+
+	d = append(d, CopyClosure(
+		ctx,
+		dg,
+		i,
+		dt,
+		env,
+		system,
+		rd.Get("substitute_on_destination").(bool),
+	)...)
+	if d.HasError() {
+		return
+	}
+
+	fs, err := runDeployScript(
+		ctx,
+		dt,
+		env,
+		"deploy",
+		system,
+		vs["action"].(string),
+		"0",
+	)
+	d = deployScriptFail(ctx, d, "deploy", err)
+	if d.HasError() {
+		return
+	}
+	prev, gen, err = ParseDeployGenerations(fs)
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+	}
+	return
+}
+
+// Parse the output of the deploy operation of the deploy script
+func ParseDeployGenerations(fs []string) (prev int, gen int, err error) {
+	if len(fs) != 2 {
+		err = fmt.Errorf("unexpected deploy script output %#v", fs)
+		return
+	}
+	prev, err = strconv.Atoi(fs[0])
+	if err == nil {
+		gen, err = strconv.Atoi(fs[1])
+	}
+	return
+}
+
+func CreateDeploy(
+	ctx context.Context,
+	rd *schema.ResourceData,
+	i interface{},
+) (d diag.Diagnostics) {
+	cg := &dschema.ConfigGetter{
+		Ds: DeployDSchema,
+		Rd: rd,
+		Pd: i.(*ProviderContext),
+	}
+	ctx = ResourceLogContext(ctx, rd)
+	dt, prev, gen, d := RunDeploy(ctx, cg, rd, i)
+	if d.HasError() {
+		return
+	}
+	d = append(d, cg.SetAll(ctx)...)
+	if d.HasError() {
+		return
+	}
+	err := rd.Set("previous_generation", prev)
+	if err == nil {
+		err = rd.Set("generation", gen)
+	}
+	if err != nil {
+		return append(d, diag.FromErr(err)...)
+	}
+	rd.SetId(dt.String())
+	return
+}
+
+func ReadDeploy(
+	ctx context.Context,
+	rd *schema.ResourceData,
+	i interface{},
+) (d diag.Diagnostics) {
+	sg := &dschema.StateGetter{
+		Ds: DeployDSchema,
+		Rd: rd,
+		Pd: i.(*ProviderContext),
+	}
+	ctx = ResourceLogContext(ctx, rd)
+	dt, cleanup, d := GetDeployTarget(ctx, sg)
+	defer cleanup()
+	if d.HasError() {
+		return
+	}
+	env, d0 := sg.Get(ctx, "env")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	fs, err := runDeployScript(
+		ctx,
+		dt,
+		env.([]string),
+		"status",
+		rd.Get("system").(string),
+		rd.Get("action").(string),
+		"0",
+	)
+	d = deployScriptFail(ctx, d, "status", err)
+	if d.HasError() {
+		return
+	}
+	if len(fs) != 3 {
+		return append(d, diag.Errorf("unexpected deploy script output %#v", fs)...)
+	}
+	gen, err := strconv.Atoi(fs[0])
+	if err != nil {
+		return append(d, diag.FromErr(err)...)
+	}
+	// The profile was removed
+	if gen == 0 || fs[1] == "" {
+		rd.SetId("")
+		return
+	}
+	// test does not change the profile, only the running system
+	system := fs[1]
+	if rd.Get("action").(string) == "test" && fs[2] != "" {
+		system = fs[2]
+	}
+	err = rd.Set("system", system)
+	if err == nil {
+		err = rd.Set("generation", gen)
+	}
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+	}
+	return
+}
+
+func CustomizeDiffDeploy(
+	ctx context.Context,
+	rd *schema.ResourceDiff,
+	i interface{},
+) (err error) {
+	cg := &dschema.ConfigGetter{
+		Ds: DeployDSchema,
+		Rd: dschema.ResourceDiffAdapter(rd),
+		Pd: i.(*ProviderContext),
+	}
+	d := cg.SetAll(ctx)
+	if d.HasError() {
+		return dschema.DiagsToErr(d)
+	}
+	_, d0 := PlanLogFile(ctx, cg, rd, "packernix_deploy")
+	d = append(d, d0...)
+	if d.HasError() {
+		return dschema.DiagsToErr(d)
+	}
+	// A system that is not running can only be activated on the next boot
+	if rd.Get("root").(string) != "" && rd.Get("action").(string) != "boot" {
+		return errors.New("action must be \"boot\" when root is set")
+	}
+	if rd.Id() != "" && (rd.HasChange("system") || rd.HasChange("action")) {
+		err = rd.SetNewComputed("generation")
+	}
+	return
+}
+
+func UpdateDeploy(
+	ctx context.Context,
+	rd *schema.ResourceData,
+	i interface{},
+) (d diag.Diagnostics) {
+	cg := &dschema.ConfigGetter{
+		Ds: DeployDSchema,
+		Rd: rd,
+		Pd: i.(*ProviderContext),
+	}
+	ctx = ResourceLogContext(ctx, rd)
+	if rd.HasChange("system") || rd.HasChange("action") {
+		_, _, gen, d0 := RunDeploy(ctx, cg, rd, i)
+		d = append(d, d0...)
+		if d.HasError() {
+			// The previous system is still deployed
+			rd.Partial(true)
+			return
+		}
+		err := rd.Set("generation", gen)
+		if err != nil {
+			return append(d, diag.FromErr(err)...)
+		}
+	}
+	return append(d, cg.SetAll(ctx)...)
+}
+
+func DeleteDeploy(
+	ctx context.Context,
+	rd *schema.ResourceData,
+	i interface{},
+) (d diag.Diagnostics) {
+	if !rd.Get("rollback_on_destroy").(bool) {
+		return
+	}
+	prev := rd.Get("previous_generation").(int)
+	if prev == 0 {
+		return append(d, diag.Diagnostic{
+			Severity: diag.Warning,
+			Summary: fmt.Sprintf(
+				"No generation to roll back %s to. The system is left "+
+					"deployed.",
+				rd.Id(),
+			),
+		})
+	}
+	sg := &dschema.StateGetter{
+		Ds: DeployDSchema,
+		Rd: rd,
+		Pd: i.(*ProviderContext),
+	}
+	ctx = ResourceLogContext(ctx, rd)
+	dt, cleanup, d := GetDeployTarget(ctx, sg)
+	defer cleanup()
+	if d.HasError() {
+		return
+	}
+	env, d0 := sg.Get(ctx, "env")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	_, err := runDeployScript(
+		ctx,
+		dt,
+		env.([]string),
+		"rollback",
+		rd.Get("system").(string),
+		rd.Get("action").(string),
+		strconv.Itoa(prev),
+	)
+	return deployScriptFail(ctx, d, "rollback", err)
+}
@@ -0,0 +1,244 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/provider"
+)
+
+// Stand-ins for the executables of a NixOS system used by the deploy script
+var fakeSystemFiles = map[string]string{
+	"sw/bin/nix-env": `#!/bin/sh
+while [ $# -gt 0 ]; do
+  case "$1" in
+  --store) shift ;;
+  -p) p="$2"; shift ;;
+  --set) s="$2"; op=set; shift ;;
+  --switch-generation) n="$2"; shift ;;
+  esac
+  shift
+done
+if [ "${op:-}" = set ]; then
+  n=1
+  while [ -L "$p-$n-link" ]; do n=$((n+1)); done
+  ln -s "$s" "$p-$n-link"
+fi
+ln -sfn "$(basename "$p")-$n-link" "$p"
+`,
+	"sw/bin/nixos-enter": `#!/bin/sh
+shift 3
+exec "$@"
+`,
+	"bin/switch-to-configuration": `#!/bin/sh
+system=$(dirname "$(dirname "$0")")
+echo "$system $1" >> "$(dirname "$system")/activations"
+[ ! -e "$system/fail" ]
+`,
+}
+
+func fakeSystem(t *testing.T, dir string, name string, fail bool) string {
+	t.Helper()
+	s := filepath.Join(dir, name)
+	for p, c := range fakeSystemFiles {
+		p = filepath.Join(s, p)
+		err := os.MkdirAll(filepath.Dir(p), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(p, []byte(c), 0755)
+		}
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if fail {
+		err := ioutil.WriteFile(filepath.Join(s, "fail"), nil, 0644)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	return s
+}
+
+func TestDeployScript(t *testing.T) {
+	ctx := context.Background()
+	td, err := ioutil.TempDir("", "resource_deploy_test")
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	defer os.RemoveAll(td)
+	root := filepath.Join(td, "root")
+	err = os.MkdirAll(filepath.Join(root, "nix/var/nix/profiles"), 0755)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	sys1 := fakeSystem(t, td, "sys1", false)
+	sys2 := fakeSystem(t, td, "sys2", false)
+	sys3 := fakeSystem(t, td, "sys3", true)
+	dt := &DeployTarget{Root: root}
+
+	run := func(args ...string) (string, error) {
+		cmd := dt.ScriptCommand(ctx, args...)
+		outb := &bytes.Buffer{}
+		cmd.Stdout = outb
+		err := cmd.Run()
+		return strings.TrimSpace(outb.String()), err
+	}
+	expectProfile := func(expected string) {
+		t.Helper()
+		p, err := os.Readlink(filepath.Join(root, "nix/var/nix/profiles/system"))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if p != expected {
+			t.Errorf("expected profile %#v, got %#v", expected, p)
+		}
+	}
+
+	ts := []struct {
+		args     []string
+		out      string
+		exitCode int
+		profile  string
+	}{
+		{
+			args:    []string{"deploy", sys1, "boot", "0"},
+			out:     "0 1",
+			profile: "system-1-link",
+		},
+		{
+			args:    []string{"deploy", sys2, "boot", "0"},
+			out:     "1 2",
+			profile: "system-2-link",
+		},
+		{
+			args:     []string{"deploy", sys3, "boot", "0"},
+			exitCode: 3,
+			profile:  "system-2-link",
+		},
+		{
+			args:    []string{"status", sys2, "boot", "0"},
+			out:     "2 " + sys2 + " -",
+			profile: "system-2-link",
+		},
+		{
+			args:    []string{"rollback", sys2, "boot", "1"},
+			profile: "system-1-link",
+		},
+	}
+	for _, tt := range ts {
+		out, err := run(tt.args...)
+		var ee *exec.ExitError
+		switch {
+		case tt.exitCode == 0 && err != nil:
+			t.Errorf("%v failed: %s", tt.args, err.Error())
+		case tt.exitCode != 0 &&
+			!(errors.As(err, &ee) && ee.ExitCode() == tt.exitCode):
+			t.Errorf("%v: expected exit code %d, got %v", tt.args, tt.exitCode, err)
+		case out != tt.out:
+			t.Errorf("%v: expected output %#v, got %#v", tt.args, tt.out, out)
+		}
+		expectProfile(tt.profile)
+	}
+
+	activations, err := ioutil.ReadFile(filepath.Join(td, "activations"))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := strings.Join([]string{
+		sys1 + " boot",
+		sys2 + " boot",
+		sys3 + " boot",
+		sys2 + " boot",
+		sys1 + " boot",
+		"",
+	}, "\n")
+	if string(activations) != expected {
+		t.Errorf("expected activations %#v, got %#v", expected, string(activations))
+	}
+}
+
+func TestParseDeployGenerations(t *testing.T) {
+	prev, gen, err := ParseDeployGenerations([]string{"3", "4"})
+	if err != nil || prev != 3 || gen != 4 {
+		t.Errorf("expected 3 4, got %d %d %v", prev, gen, err)
+	}
+	_, _, err = ParseDeployGenerations([]string{"3"})
+	if err == nil {
+		t.Errorf("expected an error for truncated output")
+	}
+}
+
+func TestDeploySSHOptionsValidate(t *testing.T) {
+	elem := SchemaDeploy()["ssh_options"].Elem.(*schema.Schema)
+	_, errs := elem.ValidateFunc("StrictHostKeyChecking=accept-new", "")
+	if len(errs) != 0 {
+		t.Errorf("option without whitespace rejected: %v", errs)
+	}
+	_, errs = elem.ValidateFunc("ProxyCommand=ssh -W %h:%p bastion", "")
+	if len(errs) == 0 {
+		t.Errorf("option with whitespace accepted")
+	}
+}
+
+// Deploy to the SSH host in PACKERNIX_TEST_DEPLOY_HOST. It is switched to a
+// container configuration, so it should be a disposable NixOS machine or
+// container.
+func TestAccResourceDeploy(t *testing.T) {
+	host := os.Getenv("PACKERNIX_TEST_DEPLOY_HOST")
+	tmplS := struct {
+		Host string
+		Port string
+		Key  string
+	}{
+		Host: host,
+		Port: os.Getenv("PACKERNIX_TEST_DEPLOY_PORT"),
+		Key:  os.Getenv("PACKERNIX_TEST_DEPLOY_KEY"),
+	}
+	if tmplS.Port == "" {
+		tmplS.Port = "22"
+	}
+	resource.Test(t, resource.TestCase{
+		ProviderFactories: ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: ReadConfig(
+					t,
+					filepath.Join("deploy", "deploy.hcl"),
+					tmplS,
+				),
+				SkipFunc: func() (bool, error) {
+					if host == "" {
+						t.Log("PACKERNIX_TEST_DEPLOY_HOST not set")
+					}
+					return host == "", nil
+				},
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttrPair(
+						"packernix_deploy.deploy",
+						"system",
+						"data.packernix_os.container",
+						"out_path",
+					),
+					resource.TestCheckResourceAttrSet(
+						"packernix_deploy.deploy",
+						"generation",
+					),
+				),
+			},
+		},
+	})
+}
@@ -5,27 +5,42 @@
 package provider
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/cmdlog"
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
 )
 
 func ResourceExternal() *schema.Resource {
-	return &schema.Resource{
+	r := &schema.Resource{
 		Schema:        SchemaExternal(),
-		CreateContext: CreateExternal,
-		ReadContext:   ReadExternal,
-		UpdateContext: UpdateExternal,
-		DeleteContext: DeleteExternal,
-		CustomizeDiff: CustomizeDiffExternal,
+		CreateContext: instrumentCRUD("packernix_external", "create", CreateExternal),
+		ReadContext:   instrumentCRUD("packernix_external", "read", ReadExternal),
+		UpdateContext: instrumentCRUD("packernix_external", "update", UpdateExternal),
+		DeleteContext: instrumentCRUD("packernix_external", "delete", DeleteExternal),
+		CustomizeDiff: instrumentDiff("packernix_external", CustomizeDiffExternal),
 		Description:   "Use a external programs as a resource",
 		Importer: &schema.ResourceImporter{
-			StateContext: schema.ImportStatePassthroughContext,
+			StateContext: instrumentImport("packernix_external", ImportExternal),
 		},
 	}
+	r.SchemaVersion = dschema.SchemaVersion(ExternalDSchema)
+	r.StateUpgraders = dschema.StateUpgraders(
+		ExternalDSchema,
+		r.CoreConfigSchema().ImpliedType(),
+	)
+	return r
 }
 
 func CreateExternal(
@@ -38,22 +53,23 @@ func CreateExternal(
 		Rd: rd,
 		Pd: i.(*ProviderContext),
 	}
-	id, d := RunExternal(ctx, cg, "read", "")
+	ctx = ResourceLogContext(ctx, rd)
+	res, d := RunExternal(ctx, cg, "read", ExternalResult{})
 	if d.HasError() {
 		return
 	}
-	if id != "" {
+	if res.Id != "" {
 		return append(d, diag.Diagnostic{
 			Severity: diag.Error,
 			Summary:  "Resource matching configuration already exists.",
 		})
 	}
 
-	id, d = RunExternal(ctx, cg, "create", "")
+	res, d = RunExternal(ctx, cg, "create", ExternalResult{})
 	if d.HasError() {
 		return
 	}
-	if id == "" {
+	if res.Id == "" {
 		return append(d, diag.Diagnostic{
 			Severity: diag.Error,
 			Summary:  "Program output empty string but no error.",
@@ -61,12 +77,129 @@ func CreateExternal(
 	}
 	d = append(d, cg.SetAll(ctx)...)
 	if d.HasError() {
-		id = ""
+		res.Id = ""
 	}
-	SetState(rd, id)
+	SetState(rd, res)
 	return
 }
 
+// Prefix of JSON import IDs
+const ExternalImportJSONPrefix = "json:"
+
+// The parsed form of an import ID
+type ExternalImportId struct {
+	Path       string            `json:"path"`
+	Id         string            `json:"id"`
+	Options    []string          `json:"options"`
+	Env        map[string]string `json:"env"`
+	Input      map[string]string `json:"input"`
+	Protocol   string            `json:"protocol"`
+	WorkingDir string            `json:"working_dir"`
+}
+
+// Parse an import ID of the form "json:<object>", or "<path>|<id>" where
+// exists reports that path exists. The ID is split at the first "|" that
+// follows an existing path. Returns nil for plain IDs.
+func ParseExternalImportId(
+	s string,
+	exists func(string) bool,
+) (*ExternalImportId, error) {
+	if strings.HasPrefix(s, ExternalImportJSONPrefix) {
+		ii := &ExternalImportId{}
+		err := json.Unmarshal(
+			[]byte(strings.TrimPrefix(s, ExternalImportJSONPrefix)),
+			ii,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON import ID: %w", err)
+		}
+		if ii.Path == "" || ii.Id == "" {
+			return nil, errors.New(`JSON import ID requires "path" and "id"`)
+		}
+		return ii, nil
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '|' || i == 0 || i == len(s)-1 {
+			continue
+		}
+		if exists(s[:i]) {
+			return &ExternalImportId{Path: s[:i], Id: s[i+1:]}, nil
+		}
+	}
+	return nil, nil
+}
+
+// Import with an ID of the form "<path>|<id>" or "json:<object>". The
+// resource is read to confirm it exists, and internal attributes are filled
+// in. Plain IDs are imported as is.
+func ImportExternal(
+	ctx context.Context,
+	rd *schema.ResourceData,
+	i interface{},
+) ([]*schema.ResourceData, error) {
+	// Relative paths are resolved like in a configuration without working_dir
+	wd, _ := i.(*ProviderContext).DMap["working_dir"].(string)
+	ii, err := ParseExternalImportId(rd.Id(), func(p string) bool {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(wd, p)
+		}
+		_, err := os.Stat(p)
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ii == nil {
+		return []*schema.ResourceData{rd}, nil
+	}
+	if ii.Options == nil {
+		ii.Options = []string{}
+	}
+	if ii.Env == nil {
+		ii.Env = map[string]string{}
+	}
+	vals := map[string]interface{}{
+		"path":     dschema.NormalizePath(ii.Path),
+		"options":  ii.Options,
+		"env":      ii.Env,
+		"input":    ii.Input,
+		"protocol": ii.Protocol,
+	}
+	if ii.WorkingDir != "" {
+		vals["working_dir"] = dschema.NormalizePath(ii.WorkingDir)
+	}
+	for k, v := range vals {
+		err = rd.Set(k, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The import ID takes the place of the configuration
+	cg := &dschema.ConfigGetter{
+		Ds: ExternalDSchema,
+		Rd: rd,
+		Pd: i.(*ProviderContext),
+	}
+	ctx, d := NewLogContext(ctx, cg, rd, "packernix_external")
+	if d.HasError() {
+		return nil, dschema.DiagsToErr(d)
+	}
+	res, d := RunExternal(ctx, cg, "read", ExternalResult{Id: ii.Id})
+	if d.HasError() {
+		return nil, dschema.DiagsToErr(d)
+	}
+	if res.Id == "" {
+		return nil, fmt.Errorf("resource %#v not found", ii.Id)
+	}
+	d = cg.SetAll(ctx)
+	if d.HasError() {
+		return nil, dschema.DiagsToErr(d)
+	}
+	SetState(rd, res)
+	return []*schema.ResourceData{rd}, nil
+}
+
 func ReadExternal(
 	ctx context.Context,
 	rd *schema.ResourceData,
@@ -82,11 +215,177 @@ func ReadExternal(
 		Rd: rd,
 		Pd: i.(*ProviderContext),
 	}
-	id, d := RunExternal(ctx, sg, "read", rd.Id())
+	ctx = ResourceLogContext(ctx, rd)
+	res, d := RunExternal(ctx, sg, "read", StateExternalResult(rd))
 	if d.HasError() {
 		return
 	}
-	SetState(rd, id)
+	SetState(rd, res)
+	return
+}
+
+// Common methods of schema.ResourceData and schema.ResourceDiff
+type changeGetter interface {
+	Id() string
+	GetChange(string) (interface{}, interface{})
+	HasChange(string) bool
+}
+
+func toStringMap(i interface{}) map[string]string {
+	m := map[string]string{}
+	im, _ := i.(map[string]interface{})
+	for k, v := range im {
+		m[k], _ = v.(string)
+	}
+	return m
+}
+
+// The resource recorded in the state
+func StateExternalResult(rd changeGetter) ExternalResult {
+	om, _ := rd.GetChange("outputs")
+	return ExternalResult{
+		Id:      rd.Id(),
+		Outputs: toStringMap(om),
+	}
+}
+
+// Exit code of bin/update and bin/check-update signaling that the resource
+// must be replaced
+const ExternalReplaceExitCode = 3
+
+// Arguments passed to bin/update
+type externalUpdateArgs struct {
+	Options []string          `json:"options"`
+	Env     map[string]string `json:"env"`
+	Input   map[string]string `json:"input"`
+}
+
+// Document passed over stdin to bin/update and bin/check-update
+type externalUpdateRequest struct {
+	Operation string             `json:"operation"`
+	Id        string             `json:"id"`
+	Old       externalUpdateArgs `json:"old"`
+	New       externalUpdateArgs `json:"new"`
+	Outputs   map[string]string  `json:"outputs"`
+}
+
+func getExternalUpdateArgs(
+	ctx context.Context,
+	dg dschema.DataGetter,
+	env interface{},
+) (a externalUpdateArgs, d diag.Diagnostics) {
+	opts, d := dg.Get(ctx, "options")
+	if d.HasError() {
+		return
+	}
+	input, d0 := dg.Get(ctx, "input")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	a = externalUpdateArgs{
+		Options: opts.([]string),
+		Env:     toStringMap(env),
+		Input:   input.(map[string]string),
+	}
+	return
+}
+
+// Arguments that bin/update can change in place
+func externalUpdatable(k string) bool {
+	return k != "path" && k != "protocol"
+}
+
+// Report if the resource has the program bin/<op>
+func HasExternalExe(
+	ctx context.Context,
+	cg dschema.DataGetter,
+	op string,
+) (bool, diag.Diagnostics) {
+	exe, d := ExternalExe(ctx, cg, op)
+	if d.HasError() {
+		return false, d
+	}
+	_, err := os.Stat(exe)
+	if os.IsNotExist(err) {
+		return false, d
+	}
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+		return false, d
+	}
+	return true, d
+}
+
+// Run bin/<op>, either "update" or "check-update", with the new arguments
+// from cg, and the old arguments from sg. bin/check-update only reports if
+// the resource can be updated in place, so its output is ignored. replace is
+// true if the program exited with ExternalReplaceExitCode.
+func RunExternalUpdate(
+	ctx context.Context,
+	cg dschema.DataGetter,
+	sg dschema.DataGetter,
+	rd changeGetter,
+	op string,
+) (res ExternalResult, replace bool, d diag.Diagnostics) {
+	prev := StateExternalResult(rd)
+	res = prev
+
+	cmd, opts, d := externalCmd(ctx, cg, op)
+	if d.HasError() {
+		return
+	}
+	useJSON, d0 := externalUsesJSON(ctx, cg)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+
+	oe, ne := rd.GetChange("env")
+	req := externalUpdateRequest{
+		Operation: op,
+		Id:        prev.Id,
+		Outputs:   prev.Outputs,
+	}
+	req.Old, d0 = getExternalUpdateArgs(ctx, sg, oe)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	req.New, d0 = getExternalUpdateArgs(ctx, cg, ne)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+		return
+	}
+
+	outb := &bytes.Buffer{}
+	cmd.Stdin = bytes.NewBuffer(b)
+	cmd.Stdout = outb
+	c := newCommand(ctx, cmd)
+	defer c.Close()
+	err = c.Run(cmd.Run)
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.ExitCode() == ExternalReplaceExitCode {
+		replace = true
+		return
+	}
+	d = exeFail(ctx, d, cmd.Path, opts, err)
+	if d.HasError() || op != "update" {
+		return
+	}
+
+	res, d0 = parseExternalOutput(cmd.Path, outb.Bytes(), useJSON)
+	d = append(d, d0...)
+	// An empty ID keeps the current one
+	if res.Id == "" {
+		res.Id = prev.Id
+	}
+	c.IDs = []string{res.Id}
 	return
 }
 
@@ -104,38 +403,150 @@ func CustomizeDiffExternal(
 	if d.HasError() {
 		return dschema.DiagsToErr(d)
 	}
-	id, d0 := RunExternal(ctx, cg, "read", "")
+	changed, d0 := dschema.PathChangeDiff(
+		ctx,
+		rd,
+		ExternalDSchema,
+		i.(*ProviderContext),
+	)
+	d = append(d, d0...)
+	if d.HasError() {
+		return dschema.DiagsToErr(d)
+	}
+	lf, d0 := PlanLogFile(ctx, cg, rd, "packernix_external")
 	d = append(d, d0...)
 	if d.HasError() {
 		return dschema.DiagsToErr(d)
 	}
-	if id == rd.Id() {
-		err = rd.SetNew("state", id)
+	ctx = cmdlog.NewContext(ctx, lf)
+	res, d0 := RunExternal(ctx, cg, "read", ExternalResult{})
+	d = append(d, d0...)
+	if d.HasError() {
+		return dschema.DiagsToErr(d)
+	}
+	if res.Id == rd.Id() && len(changed) == 0 {
+		err = rd.SetNew("state", res.Id)
 		return
 	}
-	for k := range ExternalDSchema {
-		if rd.HasChange(k) {
-			err = rd.ForceNew(k)
-			if err != nil {
-				return
+	// Contents of a hashed path changed
+	if len(changed) > 0 {
+		err = rd.ForceNew("path_hashes")
+		if err != nil {
+			return
+		}
+	}
+
+	// Plan an update in place if bin/update exists. bin/update changes the
+	// resource, so it is never run here, but bin/check-update may veto the
+	// update.
+	replace := true
+	if rd.Id() != "" && len(changed) == 0 && externalHasUpdatableChange(rd) {
+		hasUpdate, d0 := HasExternalExe(ctx, cg, "update")
+		d = append(d, d0...)
+		if d.HasError() {
+			return dschema.DiagsToErr(d)
+		}
+		replace = !hasUpdate
+		hasCheck := false
+		if hasUpdate {
+			hasCheck, d0 = HasExternalExe(ctx, cg, "check-update")
+			d = append(d, d0...)
+			if d.HasError() {
+				return dschema.DiagsToErr(d)
+			}
+		}
+		if hasCheck {
+			sg := &dschema.StateGetter{
+				Ds: ExternalDSchema,
+				Rd: dschema.ResourceDiffAdapter(rd),
+				Pd: i.(*ProviderContext),
+			}
+			_, replace, d0 = RunExternalUpdate(ctx, cg, sg, rd, "check-update")
+			d = append(d, d0...)
+			if d.HasError() {
+				return dschema.DiagsToErr(d)
+			}
+		}
+	}
+
+	if replace {
+		for k := range ExternalDSchema {
+			if rd.HasChange(k) && !logOnly(k) {
+				err = rd.ForceNew(k)
+				if err != nil {
+					return
+				}
 			}
 		}
 	}
 	err = rd.SetNewComputed("state")
+	if err != nil {
+		return
+	}
+	err = rd.SetNewComputed("outputs")
 	return
 }
 
+// Report if only arguments that bin/update can handle changed
+func externalHasUpdatableChange(rd changeGetter) bool {
+	updatable := false
+	for k := range ExternalDSchema {
+		if !rd.HasChange(k) || logOnly(k) {
+			continue
+		}
+		if !externalUpdatable(k) {
+			return false
+		}
+		updatable = true
+	}
+	return updatable
+}
+
 func UpdateExternal(
 	ctx context.Context,
 	rd *schema.ResourceData,
 	i interface{},
-) diag.Diagnostics {
+) (d diag.Diagnostics) {
 	cg := &dschema.ConfigGetter{
 		Ds: ExternalDSchema,
 		Rd: rd,
 		Pd: i.(*ProviderContext),
 	}
-	return cg.SetAll(ctx)
+	ctx = ResourceLogContext(ctx, rd)
+	// state is only unknown if CustomizeDiffExternal planned an update, and
+	// not when "read" found the current resource matches the configuration.
+	if externalHasUpdatableChange(rd) && rd.HasChange("state") {
+		hasUpdate, d0 := HasExternalExe(ctx, cg, "update")
+		d = append(d, d0...)
+		if d.HasError() {
+			return
+		}
+		if hasUpdate {
+			sg := &dschema.StateGetter{
+				Ds: ExternalDSchema,
+				Rd: rd,
+				Pd: i.(*ProviderContext),
+			}
+			res, replace, d0 := RunExternalUpdate(ctx, cg, sg, rd, "update")
+			d = append(d, d0...)
+			if d.HasError() {
+				return
+			}
+			if replace {
+				return append(d, diag.Diagnostic{
+					Severity: diag.Error,
+					Summary:  "update requires replacement",
+					Detail: "bin/update cannot update the resource in " +
+						"place. Replace it with \"terraform apply " +
+						"-replace=<address>\" or \"terraform taint " +
+						"<address>\". Add bin/check-update to detect this " +
+						"while planning.",
+				})
+			}
+			SetState(rd, res)
+		}
+	}
+	return append(d, cg.SetAll(ctx)...)
 }
 
 func DeleteExternal(
@@ -148,7 +559,8 @@ func DeleteExternal(
 		Rd: rd,
 		Pd: i.(*ProviderContext),
 	}
-	_, d = RunExternal(ctx, sg, "delete", rd.Id())
+	ctx = ResourceLogContext(ctx, rd)
+	_, d = RunExternal(ctx, sg, "delete", StateExternalResult(rd))
 	if d.HasError() {
 		return
 	}
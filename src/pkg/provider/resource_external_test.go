@@ -0,0 +1,78 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"reflect"
+	"testing"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/provider"
+)
+
+func TestParseExternalImportId(t *testing.T) {
+	exists := func(p string) bool {
+		return p == "./prog" || p == "./a|b"
+	}
+	ts := []struct {
+		in       string
+		expected *ExternalImportId
+		err      bool
+	}{
+		{
+			in:       "./prog|uuid",
+			expected: &ExternalImportId{Path: "./prog", Id: "uuid"},
+		},
+		{
+			in:       "./prog|x|y",
+			expected: &ExternalImportId{Path: "./prog", Id: "x|y"},
+		},
+		{
+			in:       "./a|b|uuid",
+			expected: &ExternalImportId{Path: "./a|b", Id: "uuid"},
+		},
+		{
+			in: "host|port",
+		},
+		{
+			in: "{not json}",
+		},
+		{
+			in: "plain",
+		},
+		{
+			in: `json:{"path":"./prog","id":"uuid","protocol":"raw"}`,
+			expected: &ExternalImportId{
+				Path:     "./prog",
+				Id:       "uuid",
+				Protocol: "raw",
+			},
+		},
+		{
+			in:  `json:{"path":"./prog",`,
+			err: true,
+		},
+		{
+			in:  `json:{"path":"./prog"}`,
+			err: true,
+		},
+	}
+	for _, tt := range ts {
+		t.Run(tt.in, func(t *testing.T) {
+			ii, err := ParseExternalImportId(tt.in, exists)
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected an error, but got %#v", ii)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if !reflect.DeepEqual(ii, tt.expected) {
+				t.Errorf("expected %#v, but got %#v", tt.expected, ii)
+			}
+		})
+	}
+}
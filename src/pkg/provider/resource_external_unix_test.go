@@ -59,6 +59,142 @@ func TestAccResourceExternal(t *testing.T) {
 				},
 			},
 		},
+		"json": {
+			IsUnitTest:        true,
+			ProviderFactories: ProviderFactories(),
+			Steps: []resource.TestStep{
+				{
+					Config: fmt.Sprintf(`
+					provider packernix{}
+					resource packernix_external json {
+						path = "./testdata/external/json"
+						options = [ "%s/json.txt" ]
+						protocol = "json"
+						input = {
+							"key" = "value"
+						}
+					}
+					`, td),
+					Check: resource.ComposeAggregateTestCheckFunc(
+						resource.TestCheckResourceAttr(
+							"packernix_external.json",
+							"state",
+							fmt.Sprintf("%s/json.txt", td),
+						),
+						resource.TestMatchResourceAttr(
+							"packernix_external.json",
+							"outputs.request",
+							regexp.MustCompile(regexp.QuoteMeta(
+								fmt.Sprintf(
+									`"operation":"read","id":"%s/json.txt",`,
+									td,
+								),
+							)),
+						),
+					),
+				},
+			},
+		},
+		"update": {
+			IsUnitTest:        true,
+			ProviderFactories: ProviderFactories(),
+			Steps: []resource.TestStep{
+				{
+					Config: fmt.Sprintf(`
+					provider packernix{}
+					resource packernix_external update {
+						path = "./testdata/external/update"
+						options = [ "%s/update.txt", "first" ]
+					}
+					`, td),
+					Check: CheckContents(
+						filepath.Join(td, "update.txt"),
+						"first",
+					),
+				},
+				{
+					Config: fmt.Sprintf(`
+					provider packernix{}
+					resource packernix_external update {
+						path = "./testdata/external/update"
+						options = [ "%s/update.txt", "second" ]
+					}
+					`, td),
+					Check: resource.ComposeAggregateTestCheckFunc(
+						resource.TestCheckResourceAttr(
+							"packernix_external.update",
+							"state",
+							fmt.Sprintf("%s/update.txt", td),
+						),
+						CheckContents(
+							filepath.Join(td, "update.txt"),
+							"second",
+						),
+						CheckContents(
+							filepath.Join(td, "update.txt.updates"),
+							"updated",
+						),
+					),
+				},
+				{
+					Config: fmt.Sprintf(`
+					provider packernix{}
+					resource packernix_external update {
+						path = "./testdata/external/update"
+						options = [ "%s/renamed.txt", "second" ]
+					}
+					`, td),
+					Check: resource.ComposeAggregateTestCheckFunc(
+						resource.TestCheckResourceAttr(
+							"packernix_external.update",
+							"state",
+							fmt.Sprintf("%s/renamed.txt", td),
+						),
+						CheckContents(
+							filepath.Join(td, "renamed.txt"),
+							"second",
+						),
+						func(*terraform.State) error {
+							p := filepath.Join(td, "update.txt")
+							_, err := os.Stat(p)
+							if !os.IsNotExist(err) {
+								return fmt.Errorf("%s not deleted", p)
+							}
+							return nil
+						},
+					),
+				},
+			},
+		},
+		"update-replace": {
+			IsUnitTest:        true,
+			ProviderFactories: ProviderFactories(),
+			Steps: []resource.TestStep{
+				{
+					Config: fmt.Sprintf(`
+					provider packernix{}
+					resource packernix_external update {
+						path = "./testdata/external/update_nocheck"
+						options = [ "%s/update-nocheck.txt", "first" ]
+					}
+					`, td),
+				},
+				// Without bin/check-update, the rename is planned as an
+				// update, which bin/update refuses
+				{
+					Config: fmt.Sprintf(`
+					provider packernix{}
+					resource packernix_external update {
+						path = "./testdata/external/update_nocheck"
+						options = [ "%s/renamed-nocheck.txt", "first" ]
+					}
+					`, td),
+					ExpectError: regexp.MustCompile(
+						"update requires replacement",
+					),
+				},
+			},
+		},
 		"file": {
 			IsUnitTest:        true,
 			ProviderFactories: ProviderFactories(),
@@ -117,6 +253,17 @@ func TestAccResourceExternal(t *testing.T) {
 					ResourceName: "packernix_external.file",
 					ImportState:  true,
 				},
+				{
+					ResourceName: "packernix_external.file",
+					ImportState:  true,
+					ImportStateId: fmt.Sprintf(
+						`json:{"path":"./testdata/external/file",`+
+							`"id":"%[1]s/file.txt:new content",`+
+							`"options":["%[1]s/file.txt","new content"]}`,
+						td,
+					),
+					ImportStateVerify: true,
+				},
 				{
 					Config: "provider packernix{}",
 					Check: func(tfs *terraform.State) error {
@@ -197,6 +344,20 @@ func TestAccResourceExternal(t *testing.T) {
 					Config: fmt.Sprintf(`
 					provider packernix{
 						working_dir = "./testdata/external/namedfile_bad_hash"
+						on_path_change = "ignore"
+					}
+					resource packernix_external hash {
+						path = "."
+						options = [ "%s/hash.txt", "hash test file content" ]
+					}
+`, td),
+					PlanOnly: true,
+				},
+				{
+					Config: fmt.Sprintf(`
+					provider packernix{
+						working_dir = "./testdata/external/namedfile_bad_hash"
+						on_path_change = "error"
 					}
 					resource packernix_external hash {
 						path = "."
@@ -8,32 +8,37 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/go-cty/cty"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/cmdlog"
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/logwriter"
 	"github.com/leocp1/terraform-provider-packernix/src/pkg/packerout"
-	"github.com/leocp1/terraform-provider-packernix/src/pkg/patches"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/retry"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/scheduler"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/tracing"
 )
 
 func ResourceImage() *schema.Resource {
-	return &schema.Resource{
+	r := &schema.Resource{
 		Schema:        SchemaImage(),
-		CreateContext: CreateImage,
-		ReadContext:   ReadImage,
-		UpdateContext: UpdateImage,
-		DeleteContext: DeleteImage,
-		CustomizeDiff: CustomizeDiffImage,
+		CreateContext: instrumentCRUD("packernix_image", "create", CreateImage),
+		ReadContext:   instrumentCRUD("packernix_image", "read", ReadImage),
+		UpdateContext: instrumentCRUD("packernix_image", "update", UpdateImage),
+		DeleteContext: instrumentCRUD("packernix_image", "delete", DeleteImage),
+		CustomizeDiff: instrumentDiff("packernix_image", CustomizeDiffImage),
 		Timeouts: &schema.ResourceTimeout{
 			// Image creation can be slow and timing can depend on the cloud
 			// provider.
@@ -43,6 +48,12 @@ func ResourceImage() *schema.Resource {
 		},
 		Description: "A Packer machine image.",
 	}
+	r.SchemaVersion = dschema.SchemaVersion(ImageDSchema)
+	r.StateUpgraders = dschema.StateUpgraders(
+		ImageDSchema,
+		r.CoreConfigSchema().ImpliedType(),
+	)
+	return r
 }
 
 var ImageDSchema = map[string]dschema.DSchema{
@@ -68,9 +79,15 @@ var ImageDSchema = map[string]dschema.DSchema{
 			}
 		},
 	),
-	"build_path":  BuildPathDSchema(),
-	"env":         &dschema.EnvDSchema{},
-	"working_dir": &dschema.WDDSchema{},
+	"build_path":                 BuildPathDSchema(),
+	"env":                        &dschema.EnvDSchema{},
+	"log_path":                   LogPathDSchema(),
+	"packer_bin":                 PackerBinDSchema(),
+	"retry":                      RetryDSchema(),
+	"scheduler_weight":           SchedulerWeightDSchema(),
+	"secret_files":               SecretFilesDSchema(),
+	"secret_files_hash_variable": SecretFilesHashVariableDSchema(),
+	"working_dir":                &dschema.WDDSchema{},
 }
 
 func SchemaImage() (m map[string]*schema.Schema) {
@@ -87,6 +104,8 @@ func SchemaImage() (m map[string]*schema.Schema) {
 		},
 	}
 	dschema.AddSchema(ImageDSchema, m)
+	AddClosureDiffSchema(m)
+	AddLogFileSchema(m)
 	return
 }
 
@@ -128,12 +147,16 @@ func ValidatePackerTemplate(tmpl interface{}) (d diag.Diagnostics) {
 	return
 }
 
+// Write the Packer template for op to tfpath. cleanup removes the files staged
+// for the template, and must be called once Packer exits.
 func MakePackerTemplate(
 	ctx context.Context,
 	rd dschema.DataGetter,
+	i interface{},
 	tfpath string,
 	op string,
-) (btype string, d diag.Diagnostics) {
+) (btype string, cleanup func(), d diag.Diagnostics) {
+	cleanup = func() {}
 	tmplStr, d0 := rd.Get(ctx, "template")
 	d = append(d, d0...)
 	if d.HasError() {
@@ -166,6 +189,17 @@ func MakePackerTemplate(
 			tmpli.(map[string]interface{})["variables"] = vs
 		}
 	}
+	cleanup, d0 = AddSecretFiles(
+		ctx,
+		rd,
+		i,
+		tmpli.(map[string]interface{}),
+		op,
+	)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
 
 	tmplF, err := os.OpenFile(
 		tfpath,
@@ -186,12 +220,52 @@ func MakePackerTemplate(
 	return
 }
 
+// Run Packer for op, retrying failures according to the retry policy. Before
+// a create is retried, read is run, and its image is used if found.
 func RunPacker(
 	ctx context.Context,
 	rd dschema.DataGetter,
 	i interface{},
 	op string,
 ) (pout *packerout.PackerOut, d diag.Diagnostics) {
+	policy, d := RetryPolicy(ctx, rd)
+	if d.HasError() {
+		return
+	}
+	var d0 diag.Diagnostics
+	err := retry.Do(ctx, policy, "packer "+op, func(attempt int) bool {
+		// A failed create may have left an image behind
+		if attempt > 1 && op == "create" {
+			rpout, rd0, _ := runPacker(ctx, rd, i, "read", nil)
+			if !rd0.HasError() && PackerOutId(rpout) != "" {
+				log.Printf(
+					"[INFO] [retry] using image %s left by failed create",
+					PackerOutId(rpout),
+				)
+				pout, d0 = rpout, rd0
+				return false
+			}
+		}
+		var again bool
+		pout, d0, again = runPacker(ctx, rd, i, op, policy)
+		return again
+	})
+	d = append(d, d0...)
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+	}
+	return
+}
+
+// Run Packer once. again is true if the build failed, and the policy allows
+// retrying the failure.
+func runPacker(
+	ctx context.Context,
+	rd dschema.DataGetter,
+	i interface{},
+	op string,
+	policy *retry.Policy,
+) (pout *packerout.PackerOut, d diag.Diagnostics, again bool) {
 
 	var err error
 
@@ -218,6 +292,14 @@ func RunPacker(
 			return
 		}
 		defer os.RemoveAll(bd)
+	} else {
+		// Lock build path, since generated files are written to it
+		bdUL, d0 := LockBuildPath(ctx, i, bd)
+		d = append(d, d0...)
+		if d.HasError() {
+			return
+		}
+		defer bdUL.Unlock()
 	}
 	err = os.MkdirAll(bd, 0700)
 	if err != nil {
@@ -230,23 +312,22 @@ func RunPacker(
 	if d.HasError() {
 		return
 	}
-	// Lock generated file
-	tfUL, d0 := i.(*ProviderContext).FL.TryLock(tfpath)
+	// Modify template
+	btype, cleanup, d0 := MakePackerTemplate(ctx, rd, i, tfpath, op)
+	defer cleanup()
 	d = append(d, d0...)
 	if d.HasError() {
 		return
 	}
-	defer tfUL.Unlock()
 
-	// Modify template
-	btype, d0 := MakePackerTemplate(ctx, rd, tfpath, op)
+	t, d0 := PackerTools(ctx, rd, i)
 	d = append(d, d0...)
 	if d.HasError() {
 		return
 	}
 
 	// validate
-	exe := patches.Packer()
+	exe := t.Packer()
 	cmdSlice := []string{
 		"validate",
 		tfpath,
@@ -257,13 +338,21 @@ func RunPacker(
 	cmd.Env = env.([]string)
 	cmd.Stdout = logwriter.New(fmt.Sprintf("[INFO] [%s] ", exe), nil)
 	cmd.Stderr = logwriter.New(fmt.Sprintf("[INFO] [%s] ", exe), nil)
-	err = cmd.Run()
-	d = exeFail(d, exe, cmdSlice, err)
+	vc := newCommand(ctx, cmd)
+	defer vc.Close()
+	err = vc.Run(cmd.Run)
+	d = exeFail(ctx, d, exe, cmdSlice, err)
 	if d.HasError() {
 		return
 	}
 
 	// build
+	release, d0 := Schedule(ctx, rd, i, scheduler.PackerBuild, op)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	defer release()
 	cmdSlice = []string{
 		"-machine-readable",
 		"build",
@@ -273,11 +362,40 @@ func RunPacker(
 	cmd = exec.CommandContext(ctx, exe, cmdSlice...)
 	cmd.Dir = wd.(string)
 	cmd.Env = env.([]string)
-	err = pout.RunPacker(nil, cmd, btype)
-	d = exeFail(d, exe, cmdSlice, err)
+	stderr := retry.NewTail(retryTailLines)
+	cmd.Stderr = io.MultiWriter(
+		logwriter.New(fmt.Sprintf("[INFO] [%s] ", exe), nil),
+		stderr,
+	)
+	bc := newCommand(ctx, cmd)
+	defer bc.Close()
+	bc.Attrs = []tracing.Attribute{
+		tracing.String(
+			"packernix.builder_type",
+			strings.TrimPrefix(btype, op+"-"),
+		),
+		tracing.String("packernix.packer_operation", op),
+	}
+	tracing.SpanFromContext(ctx).SetAttributes(bc.Attrs[0])
+	pout.OnUI = func(kind string, msg string) {
+		bc.Span().AddEvent(
+			"packer.ui",
+			tracing.String("packer.ui.type", kind),
+			tracing.String("message", msg),
+		)
+	}
+	err = bc.Run(func() error {
+		return pout.RunPacker(nil, cmd, btype)
+	})
+	d = exeFail(ctx, d, exe, cmdSlice, err)
 	if d.HasError() {
+		again = ctx.Err() == nil &&
+			policy.Retryable(err, append(pout.Errors, stderr.Lines()...))
 		return
 	}
+	if id := PackerOutId(pout); id != "" {
+		bc.IDs = []string{id}
+	}
 
 	return
 }
@@ -339,11 +457,57 @@ func CheckPreexist(
 	return true
 }
 
+// Plan the closure_diff between the NixOS configurations of the old and new
+// template. Only set when the template changes. Failing to compute the diff,
+// say because the old configuration was garbage collected, is not an error.
+func PlanImageClosureDiff(
+	ctx context.Context,
+	rd *schema.ResourceDiff,
+	dg dschema.DataGetter,
+	i interface{},
+) error {
+	if !rd.HasChange("template") {
+		return nil
+	}
+	wd, d := dg.Get(ctx, "working_dir")
+	if d.HasError() {
+		return dschema.DiagsToErr(d)
+	}
+	env, d := dg.Get(ctx, "env")
+	if d.HasError() {
+		return dschema.DiagsToErr(d)
+	}
+	o, n := rd.GetChange("template")
+	cd, err := ClosureDiff(
+		ctx,
+		i.(*ProviderContext).Tools,
+		wd.(string),
+		env.([]string),
+		TemplateNixOS(o.(string)),
+		TemplateNixOS(n.(string)),
+	)
+	if err != nil {
+		log.Printf("[WARN] could not compute the closure diff: %s", err)
+	} else if cd != "" {
+		log.Printf("[WARN] closure diff of the NixOS configuration:\n%s", cd)
+	}
+	return rd.SetNew("closure_diff", cd)
+}
+
 func CreateImage(
 	ctx context.Context,
 	rd *schema.ResourceData,
 	i interface{},
 ) (d diag.Diagnostics) {
+	// CustomizeDiff cannot return warnings, so the planned closure_diff
+	// attribute is what shows in the plan. Repeat it here for the apply output.
+	if cd := rd.Get("closure_diff").(string); cd != "" {
+		d = append(d, diag.Diagnostic{
+			Severity: diag.Warning,
+			Summary:  "NixOS configuration changed",
+			Detail:   cd,
+		})
+	}
 	if CheckPreexist(rd) {
 		d = append(d, diag.Diagnostic{
 			Severity: diag.Warning,
@@ -360,6 +524,7 @@ func CreateImage(
 		Rd: rd,
 		Pd: i.(*ProviderContext),
 	}
+	ctx = ResourceLogContext(ctx, rd)
 	pout, d0 := RunPacker(ctx, cg, i, "create")
 	d = append(d, d0...)
 	if d.HasError() {
@@ -384,6 +549,7 @@ func ReadImage(
 		Rd: rd,
 		Pd: i.(*ProviderContext),
 	}
+	ctx = ResourceLogContext(ctx, rd)
 	pout, d := RunPacker(ctx, sg, i, "read")
 	if d.HasError() {
 		return
@@ -423,6 +589,16 @@ func CustomizeDiffImage(
 	if d.HasError() {
 		return dschema.DiagsToErr(d)
 	}
+	lf, d0 := PlanLogFile(ctx, cg, rd, "packernix_image")
+	d = append(d, d0...)
+	if d.HasError() {
+		return dschema.DiagsToErr(d)
+	}
+	ctx = cmdlog.NewContext(ctx, lf)
+	err = PlanImageClosureDiff(ctx, rd, cg, i)
+	if err != nil {
+		return
+	}
 	pout, d0 := RunPacker(ctx, cg, i, "read")
 	d = append(d, d0...)
 	if d.HasError() {
@@ -446,7 +622,7 @@ func CustomizeDiffImage(
 	}
 
 	for k := range ImageDSchema {
-		if rd.HasChange(k) {
+		if rd.HasChange(k) && !logOnly(k) {
 			err = rd.ForceNew(k)
 			if err != nil {
 				return
@@ -485,6 +661,7 @@ func DeleteImage(
 		Rd: rd,
 		Pd: i.(*ProviderContext),
 	}
+	ctx = ResourceLogContext(ctx, rd)
 	_, d = RunPacker(ctx, sg, i, "delete")
 	if d.HasError() {
 		return
@@ -0,0 +1,545 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/logwriter"
+)
+
+// Directory of the system profile, relative to the root
+const profilesDir = "nix/var/nix/profiles"
+
+var generationLinkRegexp = regexp.MustCompile(`^system-([0-9]+)-link$`)
+
+func ResourceInstall() *schema.Resource {
+	r := &schema.Resource{
+		Schema:        SchemaInstall(),
+		CreateContext: instrumentCRUD("packernix_install", "create", CreateInstall),
+		ReadContext:   instrumentCRUD("packernix_install", "read", ReadInstall),
+		UpdateContext: instrumentCRUD("packernix_install", "update", UpdateInstall),
+		DeleteContext: instrumentCRUD("packernix_install", "delete", DeleteInstall),
+		CustomizeDiff: instrumentDiff("packernix_install", CustomizeDiffInstall),
+		Description:   "A NixOS system installed to a local directory",
+	}
+	r.SchemaVersion = dschema.SchemaVersion(InstallDSchema)
+	r.StateUpgraders = dschema.StateUpgraders(
+		InstallDSchema,
+		r.CoreConfigSchema().ImpliedType(),
+	)
+	return r
+}
+
+var InstallDSchema = map[string]dschema.DSchema{
+	"system": dschema.StringDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type:     schema.TypeString,
+				Required: true,
+				ValidateFunc: validation.StringMatch(
+					storePathRegexp,
+					"must be a Nix store path",
+				),
+				Description: "Nix store path of the NixOS configuration",
+			}
+		},
+	),
+	"root": &dschema.PathDSchema{
+		Required:      true,
+		ForceNew:      true,
+		SkipHashCheck: true,
+		Description: "Directory to install to, such as a mounted disk " +
+			"image",
+	},
+	"lustrate_keep": dschema.StringSliceDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type: schema.TypeList,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+					ValidateFunc: validation.StringMatch(
+						regexp.MustCompile(`^/[^\n]*$`),
+						"must be an absolute path",
+					),
+				},
+				Optional: true,
+				DefaultFunc: func() (interface{}, error) {
+					return []interface{}{}, nil
+				},
+				Description: "Paths of another distribution in root to keep " +
+					"on the first boot, listed in /etc/NIXOS_LUSTRATE",
+			}
+		},
+	),
+	"env":         &dschema.EnvDSchema{},
+	"log_path":    LogPathDSchema(),
+	"nix_bin_dir": NixBinDirDSchema(),
+	"working_dir": &dschema.WDDSchema{},
+}
+
+func SchemaInstall() (m map[string]*schema.Schema) {
+	m = map[string]*schema.Schema{
+		"install_bootloader": {
+			Type:     schema.TypeBool,
+			Optional: true,
+			Description: "Install the bootloader of the system with " +
+				"nixos-enter. Requires running as root",
+		},
+		"generation": {
+			Type:        schema.TypeInt,
+			Computed:    true,
+			Description: "Generation of the system profile installed",
+		},
+		"lustrated": {
+			Type:     schema.TypeBool,
+			Computed: true,
+			Description: "Whether root held another distribution, which " +
+				"is moved to /old-root on the first boot",
+		},
+	}
+	dschema.AddSchema(InstallDSchema, m)
+	AddLogFileSchema(m)
+	return
+}
+
+// Read the system profile under root. Returns generation 0 if there is none.
+func ReadSystemProfile(root string) (system string, gen int, err error) {
+	dir := filepath.Join(root, profilesDir)
+	l, err := os.Readlink(filepath.Join(dir, "system"))
+	if os.IsNotExist(err) {
+		return "", 0, nil
+	}
+	if err != nil {
+		return
+	}
+	m := generationLinkRegexp.FindStringSubmatch(l)
+	if m == nil {
+		err = fmt.Errorf("system profile links to %s, not a generation", l)
+		return
+	}
+	gen, _ = strconv.Atoi(m[1])
+	system, err = os.Readlink(filepath.Join(dir, l))
+	return
+}
+
+// Point the system profile under root to a new generation of system, as
+// nix-env --set does. The current generation is kept if it is already
+// system.
+func SetSystemProfile(root string, system string) (gen int, err error) {
+	cur, gen, err := ReadSystemProfile(root)
+	if err != nil || (cur == system && gen != 0) {
+		return
+	}
+	dir := filepath.Join(root, profilesDir)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range fis {
+		m := generationLinkRegexp.FindStringSubmatch(fi.Name())
+		if m == nil {
+			continue
+		}
+		if g, _ := strconv.Atoi(m[1]); g > gen {
+			gen = g
+		}
+	}
+	gen++
+	link := fmt.Sprintf("system-%d-link", gen)
+	err = os.Symlink(system, filepath.Join(dir, link))
+	if err != nil {
+		return
+	}
+	// Replace the profile atomically
+	tmp := filepath.Join(dir, "system.tmp")
+	os.Remove(tmp)
+	err = os.Symlink(link, tmp)
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, "system"))
+	}
+	return
+}
+
+// Mark root as a NixOS root with /etc/NIXOS. If it holds another
+// distribution, /etc/NIXOS_LUSTRATE is also written, so that the files of the
+// distribution are moved to /old-root on the first boot, except for keep.
+// Roots that are already marked are left alone.
+func PrepareNixOSRoot(root string, keep []string) (lustrated bool, err error) {
+	etc := filepath.Join(root, "etc")
+	_, err = os.Stat(filepath.Join(etc, "NIXOS"))
+	if err == nil {
+		_, err = os.Stat(filepath.Join(etc, "NIXOS_LUSTRATE"))
+		return err == nil, nil
+	}
+	if !os.IsNotExist(err) {
+		return
+	}
+	fis, err := ioutil.ReadDir(etc)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	lustrated = len(fis) != 0
+
+	err = os.MkdirAll(etc, 0755)
+	if err != nil {
+		return
+	}
+	if lustrated {
+		err = writeNixOSLustrate(root, keep)
+		if err != nil {
+			return
+		}
+	}
+	err = ioutil.WriteFile(filepath.Join(etc, "NIXOS"), nil, 0644)
+	return
+}
+
+// Write the paths to keep to /etc/NIXOS_LUSTRATE under root
+func writeNixOSLustrate(root string, keep []string) error {
+	b := &strings.Builder{}
+	for _, k := range keep {
+		fmt.Fprintln(b, k)
+	}
+	return ioutil.WriteFile(
+		filepath.Join(root, "etc", "NIXOS_LUSTRATE"),
+		[]byte(b.String()),
+		0644,
+	)
+}
+
+// Replace the paths to keep of a root that has not been lustrated yet.
+// Returns false, without writing anything, if root has no
+// /etc/NIXOS_LUSTRATE, either because it did not hold another distribution,
+// or because it already booted.
+func UpdateNixOSLustrate(root string, keep []string) (bool, error) {
+	_, err := os.Stat(filepath.Join(root, "etc", "NIXOS_LUSTRATE"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, writeNixOSLustrate(root, keep)
+}
+
+// Install the bootloader of the system profile under root, as nixos-install
+// does
+func InstallBootloader(
+	ctx context.Context,
+	root string,
+	system string,
+	env []string,
+) (d diag.Diagnostics) {
+	mtab := filepath.Join(root, "etc", "mtab")
+	os.Remove(mtab)
+	err := os.Symlink("/proc/mounts", mtab)
+	if err != nil {
+		return append(d, diag.FromErr(err)...)
+	}
+	exe := filepath.Join(system, "sw", "bin", "nixos-enter")
+	cs := []string{
+		"--root", root,
+		"--",
+		"/" + profilesDir + "/system/bin/switch-to-configuration",
+		"boot",
+	}
+	log.Printf("[DEBUG] %#v %#v", exe, cs)
+	cmd := exec.CommandContext(ctx, exe, cs...)
+	cmd.Stdout = logwriter.New("[INFO] [install bootloader]", nil)
+	cmd.Stderr = logwriter.New("[INFO] [install bootloader]", nil)
+	cmd.Env = append(
+		env,
+		"NIXOS_INSTALL_BOOTLOADER=1",
+		// https://github.com/NixOS/nixpkgs/issues/38991
+		"LOCALE_ARCHIVE="+filepath.Join(
+			system,
+			"sw", "lib", "locale", "locale-archive",
+		),
+	)
+	c := newCommand(ctx, cmd)
+	defer c.Close()
+	c.IDs = []string{system}
+	err = c.Run(cmd.Run)
+	return exeFail(ctx, d, exe, cs, err)
+}
+
+// Install the system of a resource to its root. Returns the generation of the
+// system profile, and if the root was lustrated.
+func RunInstall(
+	ctx context.Context,
+	dg dschema.DataGetter,
+	rd interface{ Get(string) interface{} },
+	i interface{},
+) (gen int, lustrated bool, d diag.Diagnostics) {
+	vs := map[string]interface{}{}
+	for _, k := range []string{"system", "root", "lustrate_keep", "env"} {
+		v, d0 := dg.Get(ctx, k)
+		d = append(d, d0...)
+		if d.HasError() {
+			return
+		}
+		vs[k] = v
+	}
+	system := vs["system"].(string)
+	root := vs["root"].(string)
+	env := vs["env"].([]string)
+	pathDiag := func(k string, err error) diag.Diagnostics {
+		return append(d, diag.Diagnostic{
+			Severity:      diag.Error,
+			AttributePath: cty.GetAttrPath(k),
+			Summary:       err.Error(),
+		})
+	}
+
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		d = pathDiag("root", err)
+		return
+	}
+	d = append(d, CopyClosure(
+		ctx,
+		dg,
+		i,
+		&DeployTarget{Root: root},
+		env,
+		system,
+		false,
+	)...)
+	if d.HasError() {
+		return
+	}
+	gen, err = SetSystemProfile(root, system)
+	if err != nil {
+		d = pathDiag("root", err)
+		return
+	}
+	lustrated, err = PrepareNixOSRoot(root, vs["lustrate_keep"].([]string))
+	if err != nil {
+		d = pathDiag("root", err)
+		return
+	}
+	if rd.Get("install_bootloader").(bool) {
+		d = append(d, InstallBootloader(ctx, root, system, env)...)
+	}
+	return
+}
+
+func CreateInstall(
+	ctx context.Context,
+	rd *schema.ResourceData,
+	i interface{},
+) (d diag.Diagnostics) {
+	cg := &dschema.ConfigGetter{
+		Ds: InstallDSchema,
+		Rd: rd,
+		Pd: i.(*ProviderContext),
+	}
+	ctx = ResourceLogContext(ctx, rd)
+	gen, lustrated, d := RunInstall(ctx, cg, rd, i)
+	if d.HasError() {
+		return
+	}
+	d = append(d, cg.SetAll(ctx)...)
+	if d.HasError() {
+		return
+	}
+	err := rd.Set("generation", gen)
+	if err == nil {
+		err = rd.Set("lustrated", lustrated)
+	}
+	if err != nil {
+		return append(d, diag.FromErr(err)...)
+	}
+	root, d0 := cg.Get(ctx, "root")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	rd.SetId(root.(string))
+	return
+}
+
+func ReadInstall(
+	ctx context.Context,
+	rd *schema.ResourceData,
+	i interface{},
+) (d diag.Diagnostics) {
+	sg := &dschema.StateGetter{
+		Ds: InstallDSchema,
+		Rd: rd,
+		Pd: i.(*ProviderContext),
+	}
+	root, d := sg.Get(ctx, "root")
+	if d.HasError() {
+		return
+	}
+	system, gen, err := ReadSystemProfile(root.(string))
+	if err != nil {
+		return append(d, diag.FromErr(err)...)
+	}
+	// The root or its profile was removed
+	if gen == 0 {
+		rd.SetId("")
+		return
+	}
+	err = rd.Set("system", system)
+	if err == nil {
+		err = rd.Set("generation", gen)
+	}
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+	}
+	return
+}
+
+func CustomizeDiffInstall(
+	ctx context.Context,
+	rd *schema.ResourceDiff,
+	i interface{},
+) (err error) {
+	cg := &dschema.ConfigGetter{
+		Ds: InstallDSchema,
+		Rd: dschema.ResourceDiffAdapter(rd),
+		Pd: i.(*ProviderContext),
+	}
+	d := cg.SetAll(ctx)
+	if d.HasError() {
+		return dschema.DiagsToErr(d)
+	}
+	_, d0 := PlanLogFile(ctx, cg, rd, "packernix_install")
+	d = append(d, d0...)
+	if d.HasError() {
+		return dschema.DiagsToErr(d)
+	}
+	if rd.Id() != "" && rd.HasChange("system") {
+		err = rd.SetNewComputed("generation")
+	}
+	return
+}
+
+func UpdateInstall(
+	ctx context.Context,
+	rd *schema.ResourceData,
+	i interface{},
+) (d diag.Diagnostics) {
+	cg := &dschema.ConfigGetter{
+		Ds: InstallDSchema,
+		Rd: rd,
+		Pd: i.(*ProviderContext),
+	}
+	ctx = ResourceLogContext(ctx, rd)
+	if rd.HasChange("system") {
+		gen, _, d0 := RunInstall(ctx, cg, rd, i)
+		d = append(d, d0...)
+		if d.HasError() {
+			rd.Partial(true)
+			return
+		}
+		err := rd.Set("generation", gen)
+		if err != nil {
+			return append(d, diag.FromErr(err)...)
+		}
+	} else if o, n := rd.GetChange("install_bootloader"); !o.(bool) && n.(bool) {
+		// RunInstall installs the bootloader along with a new system
+		vs := map[string]interface{}{}
+		for _, k := range []string{"system", "root", "env"} {
+			v, d0 := cg.Get(ctx, k)
+			d = append(d, d0...)
+			if d.HasError() {
+				return
+			}
+			vs[k] = v
+		}
+		d = append(d, InstallBootloader(
+			ctx,
+			vs["root"].(string),
+			vs["system"].(string),
+			vs["env"].([]string),
+		)...)
+		if d.HasError() {
+			rd.Partial(true)
+			return
+		}
+	}
+	if rd.HasChange("lustrate_keep") {
+		d = append(d, updateInstallLustrate(ctx, cg)...)
+		if d.HasError() {
+			rd.Partial(true)
+			return
+		}
+	}
+	return append(d, cg.SetAll(ctx)...)
+}
+
+// Rewrite /etc/NIXOS_LUSTRATE with the lustrate_keep of a resource. Only warns
+// if the root is not waiting to be lustrated, since the paths then have no
+// effect.
+func updateInstallLustrate(
+	ctx context.Context,
+	dg dschema.DataGetter,
+) (d diag.Diagnostics) {
+	root, d := dg.Get(ctx, "root")
+	if d.HasError() {
+		return
+	}
+	keep, d0 := dg.Get(ctx, "lustrate_keep")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	pending, err := UpdateNixOSLustrate(root.(string), keep.([]string))
+	if err != nil {
+		return append(d, diag.Diagnostic{
+			Severity:      diag.Error,
+			AttributePath: cty.GetAttrPath("root"),
+			Summary:       err.Error(),
+		})
+	}
+	if !pending {
+		d = append(d, diag.Diagnostic{
+			Severity:      diag.Warning,
+			AttributePath: cty.GetAttrPath("lustrate_keep"),
+			Summary:       "lustrate_keep has no effect",
+			Detail: fmt.Sprintf(
+				"%s has no /etc/NIXOS_LUSTRATE, since it did not hold "+
+					"another distribution or was already lustrated on its "+
+					"first boot",
+				root.(string),
+			),
+		})
+	}
+	return
+}
+
+// The installed files are left in root, since they are usually the point
+func DeleteInstall(
+	ctx context.Context,
+	rd *schema.ResourceData,
+	i interface{},
+) (d diag.Diagnostics) {
+	return
+}
@@ -0,0 +1,197 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/provider"
+)
+
+func TestSetSystemProfile(t *testing.T) {
+	root, err := ioutil.TempDir("", "resource_install_test")
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	defer os.RemoveAll(root)
+
+	ts := []struct {
+		system string
+		gen    int
+	}{
+		{system: "/nix/store/00000000000000000000000000000000-sys1", gen: 1},
+		{system: "/nix/store/00000000000000000000000000000000-sys1", gen: 1},
+		{system: "/nix/store/11111111111111111111111111111111-sys2", gen: 2},
+		{system: "/nix/store/00000000000000000000000000000000-sys1", gen: 3},
+	}
+	for _, tt := range ts {
+		gen, err := SetSystemProfile(root, tt.system)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		system, rgen, err := ReadSystemProfile(root)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if gen != tt.gen || rgen != tt.gen || system != tt.system {
+			t.Errorf(
+				"expected %#v %d, got %#v %d (set %d)",
+				tt.system,
+				tt.gen,
+				system,
+				rgen,
+				gen,
+			)
+		}
+	}
+}
+
+func TestPrepareNixOSRoot(t *testing.T) {
+	td, err := ioutil.TempDir("", "resource_install_test")
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	defer os.RemoveAll(td)
+
+	// An empty root is not lustrated
+	empty := filepath.Join(td, "empty")
+	lustrated, err := PrepareNixOSRoot(empty, []string{"/root"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if lustrated {
+		t.Errorf("empty root lustrated")
+	}
+	if _, err := os.Stat(filepath.Join(empty, "etc", "NIXOS")); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	// A root with another distribution is
+	other := filepath.Join(td, "other")
+	err = os.MkdirAll(filepath.Join(other, "etc"), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(
+			filepath.Join(other, "etc", "os-release"),
+			[]byte("ID=debian\n"),
+			0644,
+		)
+	}
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	keep := []string{"/root/.ssh/authorized_keys", "/srv"}
+	for i := 0; i < 2; i++ {
+		lustrated, err = PrepareNixOSRoot(other, keep)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if !lustrated {
+			t.Errorf("root with another distribution not lustrated")
+		}
+	}
+	b, err := ioutil.ReadFile(filepath.Join(other, "etc", "NIXOS_LUSTRATE"))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := "/root/.ssh/authorized_keys\n/srv\n"
+	if string(b) != expected {
+		t.Errorf("expected %#v, got %#v", expected, string(b))
+	}
+
+	// The kept paths can change until the root is lustrated
+	pending, err := UpdateNixOSLustrate(other, []string{"/srv"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !pending {
+		t.Errorf("lustration of the root not pending")
+	}
+	b, err = ioutil.ReadFile(filepath.Join(other, "etc", "NIXOS_LUSTRATE"))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if string(b) != "/srv\n" {
+		t.Errorf("expected %#v, got %#v", "/srv\n", string(b))
+	}
+	pending, err = UpdateNixOSLustrate(empty, []string{"/srv"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if pending {
+		t.Errorf("lustration of the empty root pending")
+	}
+	_, err = os.Stat(filepath.Join(empty, "etc", "NIXOS_LUSTRATE"))
+	if !os.IsNotExist(err) {
+		t.Errorf("NIXOS_LUSTRATE written to the empty root")
+	}
+}
+
+func CheckInstalled(root string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		rs, ok := s.RootModule().Resources["packernix_install.install"]
+		if !ok {
+			return fmt.Errorf("packernix_install.install not found")
+		}
+		system, _, err := ReadSystemProfile(root)
+		if err != nil {
+			return err
+		}
+		if system != rs.Primary.Attributes["system"] {
+			return fmt.Errorf(
+				"system profile is %#v but %#v was expected",
+				system,
+				rs.Primary.Attributes["system"],
+			)
+		}
+		_, err = os.Stat(filepath.Join(root, system, "init"))
+		if err != nil {
+			return err
+		}
+		_, err = os.Stat(filepath.Join(root, "etc", "NIXOS"))
+		return err
+	}
+}
+
+func TestAccResourceInstall(t *testing.T) {
+	// Since this function exits before the tests necessarily run, we just leave
+	// the temporary directory undeleted
+	td, err := ioutil.TempDir("", "resource_install_test")
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	tmplS := struct{ TempDir string }{TempDir: td}
+	resource.Test(t, resource.TestCase{
+		ProviderFactories: ProviderFactories(),
+		Steps: []resource.TestStep{
+			{
+				Config: ReadConfig(
+					t,
+					filepath.Join("install", "install.hcl"),
+					tmplS,
+				),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					CheckInstalled(filepath.Join(td, "root")),
+					resource.TestCheckResourceAttr(
+						"packernix_install.install",
+						"generation",
+						"1",
+					),
+					resource.TestCheckResourceAttr(
+						"packernix_install.install",
+						"lustrated",
+						"false",
+					),
+				),
+			},
+		},
+	})
+}
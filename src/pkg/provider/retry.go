@@ -0,0 +1,127 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/retry"
+)
+
+// Number of stderr lines matched against retryable_errors
+const retryTailLines = 100
+
+func validateDuration(i interface{}, p cty.Path) diag.Diagnostics {
+	_, err := time.ParseDuration(i.(string))
+	return diag.FromErr(err)
+}
+
+func RetryDSchema() dschema.DSchema {
+	return dschema.ListDSchema(
+		true,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"max_attempts": {
+							Type:         schema.TypeInt,
+							Optional:     true,
+							Default:      3,
+							ValidateFunc: validation.IntAtLeast(1),
+							Description:  "Total number of attempts",
+						},
+						"backoff": {
+							Type:             schema.TypeString,
+							Optional:         true,
+							Default:          "30s",
+							ValidateDiagFunc: validateDuration,
+							Description: "Delay before the first retry. " +
+								"Doubles after each retry",
+						},
+						"max_backoff": {
+							Type:             schema.TypeString,
+							Optional:         true,
+							Default:          "10m",
+							ValidateDiagFunc: validateDuration,
+							Description:      "Upper bound of the delay",
+						},
+						"jitter": {
+							Type:         schema.TypeFloat,
+							Optional:     true,
+							Default:      0.1,
+							ValidateFunc: validation.FloatBetween(0, 1),
+							Description: "Fraction of the delay that is " +
+								"randomized",
+						},
+						"retryable_exit_codes": {
+							Type:     schema.TypeList,
+							Optional: true,
+							Elem: &schema.Schema{
+								Type: schema.TypeInt,
+							},
+							Description: "Exit codes of retryable failures",
+						},
+						"retryable_errors": {
+							Type:     schema.TypeList,
+							Optional: true,
+							Elem: &schema.Schema{
+								Type:         schema.TypeString,
+								ValidateFunc: validation.StringIsValidRegExp,
+							},
+							Description: "Regular expressions matching " +
+								"output of retryable failures",
+						},
+					},
+				},
+				Description: "When to retry failed operations",
+			}
+		},
+	)
+}
+
+// Get the retry policy of a resource. Returns nil if retries are disabled.
+func RetryPolicy(
+	ctx context.Context,
+	dg dschema.DataGetter,
+) (p *retry.Policy, d diag.Diagnostics) {
+	ri, d := dg.Get(ctx, "retry")
+	if d.HasError() {
+		return
+	}
+	rl := ri.([]interface{})
+	if len(rl) == 0 || rl[0] == nil {
+		return
+	}
+	rm := rl[0].(map[string]interface{})
+	p = &retry.Policy{
+		MaxAttempts: rm["max_attempts"].(int),
+		Jitter:      rm["jitter"].(float64),
+	}
+	p.Backoff, _ = time.ParseDuration(rm["backoff"].(string))
+	p.MaxBackoff, _ = time.ParseDuration(rm["max_backoff"].(string))
+	for _, c := range rm["retryable_exit_codes"].([]interface{}) {
+		p.ExitCodes = append(p.ExitCodes, c.(int))
+	}
+	for _, s := range rm["retryable_errors"].([]interface{}) {
+		re, err := regexp.Compile(s.(string))
+		if err != nil {
+			d = append(d, diag.FromErr(err)...)
+			return
+		}
+		p.Patterns = append(p.Patterns, re)
+	}
+	return
+}
@@ -0,0 +1,97 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/scheduler"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/tracing"
+)
+
+// Provider arguments limiting each class of operation
+var schedulerLimits = map[string]string{
+	"max_parallel_evals":         scheduler.Eval,
+	"max_parallel_nix_builds":    scheduler.NixBuild,
+	"max_parallel_packer_builds": scheduler.PackerBuild,
+}
+
+func AddSchedulerPSchema(m map[string]*schema.Schema) {
+	m["max_parallel_evals"] = &schema.Schema{
+		Type:        schema.TypeInt,
+		Optional:    true,
+		Description: "Maximum total weight of concurrent Nix evaluations",
+	}
+	m["max_parallel_nix_builds"] = &schema.Schema{
+		Type:        schema.TypeInt,
+		Optional:    true,
+		Description: "Maximum total weight of concurrent Nix builds",
+	}
+	m["max_parallel_packer_builds"] = &schema.Schema{
+		Type:        schema.TypeInt,
+		Optional:    true,
+		Description: "Maximum total weight of concurrent Packer builds",
+	}
+}
+
+// Create the provider scheduler from the provider configuration
+func ConfigureScheduler(
+	pc *ProviderContext,
+	rd *schema.ResourceData,
+) (d diag.Diagnostics) {
+	limits := map[string]int{}
+	for k, c := range schedulerLimits {
+		limits[c] = rd.Get(k).(int)
+	}
+	pc.Sched = scheduler.New(limits)
+	return
+}
+
+func SchedulerWeightDSchema() dschema.DSchema {
+	return dschema.IntDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  1,
+				Description: "Weight of this resource's operations against " +
+					"the provider max_parallel_* limits",
+			}
+		},
+	)
+}
+
+// Wait for the provider scheduler to allow an operation to run
+func Schedule(
+	ctx context.Context,
+	dg dschema.DataGetter,
+	i interface{},
+	class string,
+	name string,
+) (release func(), d diag.Diagnostics) {
+	release = func() {}
+	w, d := dg.Get(ctx, "scheduler_weight")
+	if d.HasError() {
+		return
+	}
+	_, span := tracing.Start(
+		ctx,
+		"schedule",
+		tracing.String("packernix.class", class),
+		tracing.Int("packernix.weight", w.(int)),
+	)
+	release, err := i.(*ProviderContext).Sched.Acquire(ctx, class, name, w.(int))
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+	}
+	return
+}
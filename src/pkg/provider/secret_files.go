@@ -0,0 +1,457 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
+)
+
+// Directory on the remote that secret files are uploaded to before they are
+// installed
+const remoteSecretDir = "/tmp/packernix-secrets"
+
+var (
+	secretOwnerRegexp = regexp.MustCompile(
+		`^[A-Za-z0-9_][A-Za-z0-9_.-]*(:[A-Za-z0-9_][A-Za-z0-9_.-]*)?$`,
+	)
+	secretModeRegexp     = regexp.MustCompile(`^[0-7]{3,4}$`)
+	packerVariableRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+func SecretFilesDSchema() dschema.DSchema {
+	return dschema.ListDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"destination": {
+							Type:     schema.TypeString,
+							Required: true,
+							ValidateFunc: validation.All(
+								validation.StringMatch(
+									regexp.MustCompile(`^/`),
+									"must be an absolute path",
+								),
+								validation.StringDoesNotContainAny("{}"),
+							),
+							Description: "Absolute path of the file on the " +
+								"image",
+						},
+						"content": {
+							Type:        schema.TypeString,
+							Optional:    true,
+							Sensitive:   true,
+							Description: "Content of the file",
+						},
+						"source": {
+							Type:     schema.TypeString,
+							Optional: true,
+							Description: "Path of a local file to read the " +
+								"content from instead. Respects working_dir",
+						},
+						"owner": {
+							Type:     schema.TypeString,
+							Optional: true,
+							Default:  "root",
+							ValidateFunc: validation.StringMatch(
+								secretOwnerRegexp,
+								"must be a user, or a user and group "+
+									"separated by a colon",
+							),
+							Description: "Owner of the file, as passed to " +
+								"chown",
+						},
+						"mode": {
+							Type:     schema.TypeString,
+							Optional: true,
+							Default:  "0400",
+							ValidateFunc: validation.StringMatch(
+								secretModeRegexp,
+								"must be an octal mode, such as \"0400\"",
+							),
+							Description: "Octal mode of the file",
+						},
+					},
+				},
+				Description: "Files uploaded to the image after the NixOS " +
+					"closure, without passing through the Nix store",
+			}
+		},
+	)
+}
+
+func SecretFilesHashVariableDSchema() dschema.DSchema {
+	return dschema.StringDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				ValidateFunc: validation.StringMatch(
+					packerVariableRegexp,
+					"must be a Packer variable name",
+				),
+				Description: "Packer user variable set to an HMAC of " +
+					"secret_files, keyed with the provider " +
+					"secret_files_hmac_key",
+			}
+		},
+	)
+}
+
+type SecretFile struct {
+	Destination string
+	// Exactly one of Content and Source is set
+	Content string
+	Source  string
+	Owner   string
+	Mode    string
+}
+
+// Content of the file
+func (sf *SecretFile) Read() ([]byte, error) {
+	if sf.Source != "" {
+		return ioutil.ReadFile(sf.Source)
+	}
+	return []byte(sf.Content), nil
+}
+
+// Get the secret_files of a resource, with sources resolved against its
+// working_dir
+func GetSecretFiles(
+	ctx context.Context,
+	dg dschema.DataGetter,
+) (fs []SecretFile, d diag.Diagnostics) {
+	sfi, d := dg.Get(ctx, "secret_files")
+	if d.HasError() {
+		return
+	}
+	sfl := sfi.([]interface{})
+	if len(sfl) == 0 {
+		return
+	}
+	wd, d0 := dg.Get(ctx, "working_dir")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	for i, sfmi := range sfl {
+		sfm, _ := sfmi.(map[string]interface{})
+		sf := SecretFile{
+			Destination: sfm["destination"].(string),
+			Content:     sfm["content"].(string),
+			Source:      sfm["source"].(string),
+			Owner:       sfm["owner"].(string),
+			Mode:        sfm["mode"].(string),
+		}
+		if (sf.Content == "") == (sf.Source == "") {
+			d = append(d, diag.Diagnostic{
+				Severity:      diag.Error,
+				AttributePath: cty.GetAttrPath("secret_files").IndexInt(i),
+				Summary:       "exactly one of content or source must be set",
+			})
+			return
+		}
+		if sf.Source != "" && !filepath.IsAbs(sf.Source) {
+			sf.Source = filepath.Join(wd.(string), sf.Source)
+		}
+		fs = append(fs, sf)
+	}
+	return
+}
+
+// Add the secret_files_hmac_key provider argument
+func AddSecretFilesPSchema(m map[string]*schema.Schema) {
+	m["secret_files_hmac_key"] = &schema.Schema{
+		Type:         schema.TypeString,
+		Optional:     true,
+		Sensitive:    true,
+		ValidateFunc: validation.StringLenBetween(16, 1024),
+		Description: "Key of the HMAC set in the " +
+			"secret_files_hash_variable of images",
+	}
+}
+
+// Read the secret_files_hmac_key provider argument
+func ConfigureSecretFiles(pc *ProviderContext, rd *schema.ResourceData) {
+	pc.SecretFilesKey = []byte(rd.Get("secret_files_hmac_key").(string))
+}
+
+// HMAC-SHA256 of the destinations, owners, modes and contents of fs keyed
+// with key, as a hex string. Unlike a plain hash, it does not allow guessing
+// low entropy contents from the Terraform state or the image.
+func SecretFilesHash(key []byte, fs []SecretFile) (string, error) {
+	h := hmac.New(sha256.New, key)
+	for _, sf := range fs {
+		b, err := sf.Read()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(
+			h,
+			"%s\x00%s\x00%s\x00%d\x00",
+			sf.Destination,
+			sf.Owner,
+			sf.Mode,
+			len(b),
+		)
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Write the contents of fs to files named by their index in dir
+func StageSecretFiles(fs []SecretFile, dir string) error {
+	for i, sf := range fs {
+		b, err := sf.Read()
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(
+			filepath.Join(dir, strconv.Itoa(i)),
+			b,
+			0600,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Quote a string for the remote shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// The NIXOS_ROOT set in the environment_vars of the provisioners in ps, as for
+// the nixos_infect.sh script of the bundled templates. Defaults to "/".
+func nixOSRoot(ps []interface{}) string {
+	root := "/"
+	for _, p := range ps {
+		pm, _ := p.(map[string]interface{})
+		evs, _ := pm["environment_vars"].([]interface{})
+		for _, ev := range evs {
+			s, _ := ev.(string)
+			if strings.HasPrefix(s, "NIXOS_ROOT=") {
+				root = strings.TrimPrefix(s, "NIXOS_ROOT=")
+			}
+		}
+	}
+	return root
+}
+
+// The execute_command of the last shell provisioner in ps setting one, such as
+// a sudo wrapper for a communicator that does not log in as root, or "" if
+// there is none
+func shellExecuteCommand(ps []interface{}) string {
+	for i := len(ps) - 1; i >= 0; i-- {
+		pm, _ := ps[i].(map[string]interface{})
+		if pm["type"] != "shell" {
+			continue
+		}
+		if ec, _ := pm["execute_command"].(string); ec != "" {
+			return ec
+		}
+	}
+	return ""
+}
+
+// Report if a provisioner copies the NixOS closure
+func copiesClosure(p interface{}) bool {
+	pm, ok := p.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	switch inline := pm["inline"].(type) {
+	case string:
+		return strings.Contains(inline, "nix-copy-closure")
+	case []interface{}:
+		for _, l := range inline {
+			s, _ := l.(string)
+			if strings.Contains(s, "nix-copy-closure") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Add provisioners uploading the files of fs, staged in stageDir, to a Packer
+// template. They are added after the last provisioner running
+// nix-copy-closure, or at the end if there is none. The files are installed
+// under the NIXOS_ROOT of the template, and kept by NixOS lustration: their
+// destinations are added to /etc/NIXOS_LUSTRATE unless the root is already
+// NixOS and not being lustrated. The files are uploaded as the communicator
+// user, and installed with the execute_command of the template's shell
+// provisioners, if any, which must run them as root.
+func InjectSecretFiles(
+	tmpl map[string]interface{},
+	fs []SecretFile,
+	stageDir string,
+) error {
+	if len(fs) == 0 {
+		return nil
+	}
+	ps, ok := tmpl["provisioners"].([]interface{})
+	if !ok && tmpl["provisioners"] != nil {
+		return fmt.Errorf("provisioners is not a list")
+	}
+
+	sps := []interface{}{
+		map[string]interface{}{
+			"type": "shell",
+			"inline": []interface{}{
+				"umask 077",
+				"rm -rf " + remoteSecretDir,
+				"mkdir " + remoteSecretDir,
+			},
+		},
+	}
+	install := []interface{}{}
+	keep := []string{}
+	for i, sf := range fs {
+		remote := path.Join(remoteSecretDir, strconv.Itoa(i))
+		sps = append(sps, map[string]interface{}{
+			"type":        "file",
+			"source":      filepath.Join(stageDir, strconv.Itoa(i)),
+			"destination": remote,
+		})
+		dst := `"${NIXOS_ROOT%/}"` + shellQuote(sf.Destination)
+		install = append(
+			install,
+			fmt.Sprintf("install -D -m %s %s %s", sf.Mode, remote, dst),
+			fmt.Sprintf("chown %s %s", sf.Owner, dst),
+		)
+		keep = append(keep, shellQuote(sf.Destination))
+	}
+	install = append(
+		install,
+		`if [ ! -e "${NIXOS_ROOT%/}/etc/NIXOS" ] || `+
+			`[ -e "${NIXOS_ROOT%/}/etc/NIXOS_LUSTRATE" ]; then`,
+		`  mkdir -m 0755 -p "${NIXOS_ROOT%/}/etc"`,
+		`  printf '%s\n' `+strings.Join(keep, " ")+
+			` >> "${NIXOS_ROOT%/}/etc/NIXOS_LUSTRATE"`,
+		"fi",
+		"rm -rf "+remoteSecretDir,
+	)
+	ip := map[string]interface{}{
+		"type":             "shell",
+		"environment_vars": []interface{}{"NIXOS_ROOT=" + nixOSRoot(ps)},
+		"inline":           install,
+	}
+	if ec := shellExecuteCommand(ps); ec != "" {
+		ip["execute_command"] = ec
+	}
+	sps = append(sps, ip)
+
+	at := len(ps)
+	for i := len(ps) - 1; i >= 0; i-- {
+		if copiesClosure(ps[i]) {
+			at = i + 1
+			break
+		}
+	}
+	nps := make([]interface{}, 0, len(ps)+len(sps))
+	nps = append(nps, ps[:at]...)
+	nps = append(nps, sps...)
+	nps = append(nps, ps[at:]...)
+	tmpl["provisioners"] = nps
+	return nil
+}
+
+// Add the secret_files of a resource to the Packer template for op. The
+// secret_files_hash_variable is set for every op, but files are only uploaded
+// on create. cleanup removes the staged files, and must be called once Packer
+// exits.
+func AddSecretFiles(
+	ctx context.Context,
+	dg dschema.DataGetter,
+	i interface{},
+	tmpl map[string]interface{},
+	op string,
+) (cleanup func(), d diag.Diagnostics) {
+	cleanup = func() {}
+	fs, d := GetSecretFiles(ctx, dg)
+	if d.HasError() {
+		return
+	}
+
+	hvi, d0 := dg.Get(ctx, "secret_files_hash_variable")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	if hv := hvi.(string); hv != "" {
+		key := i.(*ProviderContext).SecretFilesKey
+		if len(key) == 0 {
+			d = append(d, diag.Diagnostic{
+				Severity:      diag.Error,
+				AttributePath: cty.GetAttrPath("secret_files_hash_variable"),
+				Summary: "secret_files_hmac_key must be set in the " +
+					"provider configuration",
+			})
+			return
+		}
+		hash, err := SecretFilesHash(key, fs)
+		if err != nil {
+			d = append(d, diag.Diagnostic{
+				Severity:      diag.Error,
+				AttributePath: cty.GetAttrPath("secret_files"),
+				Summary:       err.Error(),
+			})
+			return
+		}
+		vs, ok := tmpl["variables"].(map[string]interface{})
+		if !ok {
+			vs = map[string]interface{}{}
+			tmpl["variables"] = vs
+		}
+		vs[hv] = hash
+	}
+
+	if op != "create" || len(fs) == 0 {
+		return
+	}
+	stageDir, err := ioutil.TempDir("", "terraform-provider-packernix-secrets")
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+		return
+	}
+	cleanup = func() { os.RemoveAll(stageDir) }
+	err = StageSecretFiles(fs, stageDir)
+	if err == nil {
+		err = InjectSecretFiles(tmpl, fs, stageDir)
+	}
+	if err != nil {
+		d = append(d, diag.Diagnostic{
+			Severity:      diag.Error,
+			AttributePath: cty.GetAttrPath("secret_files"),
+			Summary:       err.Error(),
+		})
+	}
+	return
+}
@@ -0,0 +1,127 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/provider"
+)
+
+func TestInjectSecretFiles(t *testing.T) {
+	var tmpl map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+	  "builders": [{"type": "null"}],
+	  "provisioners": [
+	    {"type": "shell", "script": "install.sh"},
+	    {"type": "shell-local", "inline": ["nix-copy-closure --to remote /nix/store/a"]},
+	    {"type": "shell", "script": "infect.sh", "environment_vars": ["NIXOS_ROOT=/mnt"], "execute_command": "sudo -E sh -c '{{ .Vars }} {{ .Path }}'"}
+	  ]
+	}`), &tmpl)
+	if err != nil {
+		t.Fatalf("could not parse template: %s", err.Error())
+	}
+	fs := []SecretFile{
+		{
+			Destination: "/etc/ssh/it's a key",
+			Content:     "secret",
+			Owner:       "root:keys",
+			Mode:        "0440",
+		},
+	}
+	err = InjectSecretFiles(tmpl, fs, "/stage")
+	if err != nil {
+		t.Fatalf("InjectSecretFiles failed: %s", err.Error())
+	}
+
+	var types []string
+	for _, p := range tmpl["provisioners"].([]interface{}) {
+		types = append(types, p.(map[string]interface{})["type"].(string))
+	}
+	expected := []string{"shell", "shell-local", "shell", "file", "shell", "shell"}
+	if !reflect.DeepEqual(types, expected) {
+		t.Fatalf("expected provisioners %#v, but got %#v", expected, types)
+	}
+	ps := tmpl["provisioners"].([]interface{})
+	upload := ps[3].(map[string]interface{})
+	if upload["source"] != "/stage/0" {
+		t.Errorf("uploaded %#v instead of the staged file", upload["source"])
+	}
+	install := ps[4].(map[string]interface{})
+	expectedEnv := []interface{}{"NIXOS_ROOT=/mnt"}
+	if !reflect.DeepEqual(install["environment_vars"], expectedEnv) {
+		t.Errorf(
+			"expected environment %#v, but got %#v",
+			expectedEnv,
+			install["environment_vars"],
+		)
+	}
+	expectedEC := "sudo -E sh -c '{{ .Vars }} {{ .Path }}'"
+	if install["execute_command"] != expectedEC {
+		t.Errorf(
+			"expected execute_command %#v, but got %#v",
+			expectedEC,
+			install["execute_command"],
+		)
+	}
+	if _, ok := ps[2].(map[string]interface{})["execute_command"]; ok {
+		t.Errorf("the upload directory was created with the execute_command")
+	}
+	expectedInstall := []interface{}{
+		`install -D -m 0440 /tmp/packernix-secrets/0 ` +
+			`"${NIXOS_ROOT%/}"'/etc/ssh/it'\''s a key'`,
+		`chown root:keys "${NIXOS_ROOT%/}"'/etc/ssh/it'\''s a key'`,
+		`if [ ! -e "${NIXOS_ROOT%/}/etc/NIXOS" ] || ` +
+			`[ -e "${NIXOS_ROOT%/}/etc/NIXOS_LUSTRATE" ]; then`,
+		`  mkdir -m 0755 -p "${NIXOS_ROOT%/}/etc"`,
+		`  printf '%s\n' '/etc/ssh/it'\''s a key' ` +
+			`>> "${NIXOS_ROOT%/}/etc/NIXOS_LUSTRATE"`,
+		"fi",
+		"rm -rf /tmp/packernix-secrets",
+	}
+	if !reflect.DeepEqual(install["inline"], expectedInstall) {
+		t.Errorf("expected %#v, but got %#v", expectedInstall, install["inline"])
+	}
+	// The closure switch lustrates the root, keeping the files listed above
+	if ps[5].(map[string]interface{})["script"] != "infect.sh" {
+		t.Errorf("secret files were not added before the closure switch")
+	}
+}
+
+func TestSecretFilesHash(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	f := SecretFile{Destination: "/a", Content: "b", Owner: "root", Mode: "0400"}
+	h, err := SecretFilesHash(key, []SecretFile{f})
+	if err != nil {
+		t.Fatalf("SecretFilesHash failed: %s", err.Error())
+	}
+	g := f
+	g.Mode = "0440"
+	gh, err := SecretFilesHash(key, []SecretFile{g})
+	if err != nil {
+		t.Fatalf("SecretFilesHash failed: %s", err.Error())
+	}
+	if h == gh {
+		t.Errorf("changing the mode did not change the hash")
+	}
+	g = f
+	g.Content = "c"
+	gh, err = SecretFilesHash(key, []SecretFile{g})
+	if err != nil {
+		t.Fatalf("SecretFilesHash failed: %s", err.Error())
+	}
+	if h == gh {
+		t.Errorf("changing the content did not change the hash")
+	}
+	gh, err = SecretFilesHash([]byte("fedcba9876543210"), []SecretFile{f})
+	if err != nil {
+		t.Fatalf("SecretFilesHash failed: %s", err.Error())
+	}
+	if h == gh {
+		t.Errorf("changing the key did not change the hash")
+	}
+}
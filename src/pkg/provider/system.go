@@ -0,0 +1,160 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/tools"
+)
+
+// Nix system doubles (x86_64-linux) and triples (aarch64-unknown-linux-gnu).
+// Values are written into generated Nix files, so nothing else is allowed.
+var systemRegexp = regexp.MustCompile(`^[A-Za-z0-9_.]+(-[A-Za-z0-9_.]+)+$`)
+
+func systemDSchema(description string) dschema.DSchema {
+	return dschema.StringDSchema(
+		false,
+		func() *schema.Schema {
+			return &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+				ValidateFunc: validation.StringMatch(
+					systemRegexp,
+					`must be a Nix system, such as "aarch64-linux"`,
+				),
+				Description: description,
+			}
+		},
+	)
+}
+
+func SystemDSchema() dschema.DSchema {
+	return systemDSchema(`The Nix system packages are built on, such as ` +
+		`"aarch64-linux". Defaults to the system of the machine running Nix`)
+}
+
+func CrossSystemDSchema() dschema.DSchema {
+	return systemDSchema(`The Nix system to cross-compile the configuration ` +
+		`for. Packages are built on system`)
+}
+
+// Nix expressions for the nixpkgs.localSystem and nixpkgs.crossSystem NixOS
+// options. local is empty if system is unset, so that the configuration can
+// set nixpkgs.system or nixpkgs.localSystem. An unset cross system defaults to
+// null.
+func NixOSSystems(
+	ctx context.Context,
+	dg dschema.DataGetter,
+) (local string, cross string, d diag.Diagnostics) {
+	s, d := dg.Get(ctx, "system")
+	if d.HasError() {
+		return
+	}
+	if s.(string) != "" {
+		local = fmt.Sprintf(`{ system = "%s"; }`, s.(string))
+	}
+
+	cs, d0 := dg.Get(ctx, "cross_system")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	if cs.(string) == "" {
+		cross = "lib.mkDefault null"
+	} else {
+		cross = fmt.Sprintf(`{ system = "%s"; }`, cs.(string))
+	}
+	return
+}
+
+// Check that Nix has a builder for system, if set. Nix is run in wd with the
+// environment env.
+func CheckBuildSystem(
+	ctx context.Context,
+	dg dschema.DataGetter,
+	t *tools.Tools,
+	wd string,
+	env []string,
+) (d diag.Diagnostics) {
+	s, d := dg.Get(ctx, "system")
+	if d.HasError() {
+		return
+	}
+	system := s.(string)
+	if system == "" {
+		return
+	}
+
+	nixOpts, d0 := dg.Get(ctx, "nix_options")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	var opts map[string]string
+	if nixOpts != nil {
+		opts = nixOpts.(map[string]string)
+	}
+	cfg, err := t.NixConfig(ctx, opts, wd, env)
+	if err != nil {
+		d = append(d, diag.Diagnostic{
+			Severity: diag.Error,
+			Summary:  "could not read the Nix configuration",
+			Detail:   err.Error(),
+		})
+		return
+	}
+	systems, err := tools.BuildSystems(cfg)
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+		return
+	}
+	for _, bs := range systems {
+		if bs == system {
+			return
+		}
+	}
+	d = append(d, diag.Diagnostic{
+		Severity:      diag.Error,
+		AttributePath: cty.GetAttrPath("system"),
+		Summary:       fmt.Sprintf("no Nix builder for %s", system),
+		Detail: fmt.Sprintf(
+			"Nix can only build for %s. Add a remote builder for %s with "+
+				"the \"builders\" Nix option, or add %s to "+
+				"\"extra-platforms\" if this machine can emulate it. To build "+
+				"packages here instead, set cross_system.",
+			strings.Join(systems, ", "),
+			system,
+			system,
+		),
+	})
+	return
+}
+
+// Read the system of a built NixOS configuration
+func OutSystem(outpath string) (system string, d diag.Diagnostics) {
+	b, err := ioutil.ReadFile(filepath.Join(outpath, "system"))
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		d = append(d, diag.FromErr(err)...)
+		return
+	}
+	system = strings.TrimSpace(string(b))
+	return
+}
@@ -0,0 +1,8 @@
+{ config, baseModules, ... }:
+{
+  imports = baseModules;
+  boot.isContainer = true;
+  networking.hostName = config.tfpn.hostName;
+  services.openssh.enable = true;
+  users.users.root.openssh.authorizedKeys.keys = config.tfpn.authorizedKeys;
+}
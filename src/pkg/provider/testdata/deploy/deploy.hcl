@@ -0,0 +1,32 @@
+provider packernix {}
+
+data "packernix_eval" "nixpkgs" {
+  inline = file("./testdata/os/nixpkgs-20.03.nix")
+  nix_options = {
+    "allowed-uris" = "https://github.com"
+    "restrict-eval" = "true"
+  }
+}
+
+data "packernix_os" "container" {
+  file = "./testdata/deploy/container.nix"
+  clear_env = true
+  env = {
+    "HOME" = "/homeless-shelter"
+    "NIX_PATH" = "."
+  }
+  config = jsonencode({
+	"hostName" = "tfpnhost"
+	"authorizedKeys" = [file("{{.Key}}.pub")]
+  })
+  nixpkgs = jsondecode(data.packernix_eval.nixpkgs.out)
+}
+
+resource "packernix_deploy" "deploy" {
+  system = data.packernix_os.container.out_path
+  host = "{{.Host}}"
+  port = {{.Port}}
+  private_key = file("{{.Key}}")
+  ssh_options = ["-o", "StrictHostKeyChecking=no"]
+  action = "test"
+}
@@ -0,0 +1,9 @@
+provider packernix {
+  audit_log    = "{{.AuditLog}}"
+  audit_redact = ["es"]
+}
+
+data "packernix_external" "echo" {
+  path = "./testdata/external/echo"
+  options = ["test"]
+}
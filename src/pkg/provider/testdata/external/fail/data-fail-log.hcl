@@ -0,0 +1,6 @@
+provider packernix {}
+
+data "packernix_external" "fail" {
+  path     = "./testdata/external/fail"
+  log_path = "{{.LogPath}}"
+}
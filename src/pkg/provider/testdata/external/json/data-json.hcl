@@ -0,0 +1,10 @@
+provider packernix {}
+
+data "packernix_external" "json" {
+  path = "./testdata/external/json"
+  options = ["./testdata/external/json/data-json.hcl"]
+  protocol = "json"
+  input = {
+    "key" = "value"
+  }
+}
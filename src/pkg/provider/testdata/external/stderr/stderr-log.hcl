@@ -0,0 +1,7 @@
+provider packernix {
+  log_path = "{{.LogPath}}"
+}
+
+data "packernix_external" "stderr" {
+  path = "./testdata/external/stderr"
+}
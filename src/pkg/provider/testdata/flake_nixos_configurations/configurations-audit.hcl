@@ -0,0 +1,7 @@
+provider packernix {
+  audit_log = "{{.AuditLog}}"
+}
+
+data "packernix_flake_nixos_configurations" "default" {
+  flake_path = "./testdata/flake_nixos_configurations"
+}
@@ -0,0 +1,15 @@
+provider packernix {}
+
+data "packernix_flake_nixos_configurations" "default" {
+  flake_path = "./testdata/flake_nixos_configurations"
+}
+
+data "packernix_flake_nixos_configurations" "hosts" {
+  flake_path = "./testdata/flake_nixos_configurations"
+  attrset = "hosts"
+}
+
+data "packernix_eval" "each" {
+  for_each = data.packernix_flake_nixos_configurations.default.systems
+  inline = jsonencode("${each.key} ${each.value}")
+}
@@ -0,0 +1,23 @@
+{
+  outputs = { self, ... }: {
+    nixosConfigurations = {
+      # Shaped like the result of nixpkgs.lib.nixosSystem
+      arm = {
+        options = { };
+        config = {
+          nixpkgs.localSystem.system = "aarch64-linux";
+          _module.args.modules = [ ];
+        };
+      };
+      # Fails to evaluate, without failing the other configurations
+      broken = {
+        options = { };
+        config = throw "broken configuration";
+      };
+      "web.example" = { config, ... }: { };
+    };
+    hosts = {
+      db = { config, ... }: { };
+    };
+  };
+}
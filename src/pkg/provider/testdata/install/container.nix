@@ -0,0 +1,6 @@
+{ config, baseModules, ... }:
+{
+  imports = baseModules;
+  boot.isContainer = true;
+  networking.hostName = config.tfpn.hostName;
+}
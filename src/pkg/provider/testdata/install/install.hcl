@@ -0,0 +1,27 @@
+provider packernix {}
+
+data "packernix_eval" "nixpkgs" {
+  inline = file("./testdata/os/nixpkgs-20.03.nix")
+  nix_options = {
+    "allowed-uris" = "https://github.com"
+    "restrict-eval" = "true"
+  }
+}
+
+data "packernix_os" "container" {
+  file = "./testdata/install/container.nix"
+  clear_env = true
+  env = {
+    "HOME" = "/homeless-shelter"
+    "NIX_PATH" = "."
+  }
+  config = jsonencode({
+	"hostName" = "tfpnhost"
+  })
+  nixpkgs = jsondecode(data.packernix_eval.nixpkgs.out)
+}
+
+resource "packernix_install" "install" {
+  system = data.packernix_os.container.out_path
+  root = "{{.TempDir}}/root"
+}
@@ -0,0 +1,11 @@
+{ config, tfpnModulesPath, baseModules, ... }:
+{
+  imports = baseModules ++ [
+    "${tfpnModulesPath}/vultr-config.nix"
+  ];
+  warnings = [ "tfpn test warning" ];
+  assertions = [
+    { assertion = true; message = "tfpn passing assertion"; }
+    { assertion = false; message = "tfpn failing assertion"; }
+  ];
+}
@@ -0,0 +1,37 @@
+provider packernix {}
+
+data "packernix_eval" "nixpkgs" {
+  inline = file("./testdata/os/nixpkgs-20.03.nix")
+  nix_options = {
+    "allowed-uris" = "https://github.com"
+    "restrict-eval" = "true"
+  }
+}
+
+data "packernix_os" "base" {
+  file = "./testdata/os/configuration.nix"
+  clear_env = true
+  env = {
+    "HOME" = "/homeless-shelter"
+    "NIX_PATH" = "."
+  }
+  config = jsonencode({
+	"hostName" = "tfpnhost"
+  })
+  nixpkgs = jsondecode(data.packernix_eval.nixpkgs.out)
+  out_link = "{{.TempDir}}/result-closure-diff-base"
+}
+
+data "packernix_os" "closure_diff" {
+  file = "./testdata/os/configuration.nix"
+  clear_env = true
+  env = {
+    "HOME" = "/homeless-shelter"
+    "NIX_PATH" = "."
+  }
+  config = jsonencode({
+	"hostName" = "otherhost"
+  })
+  nixpkgs = jsondecode(data.packernix_eval.nixpkgs.out)
+  closure_diff_base = data.packernix_os.base.out_path
+}
@@ -0,0 +1,27 @@
+provider packernix {}
+
+data "packernix_eval" "nixpkgs" {
+  inline = file("./testdata/os/nixpkgs-20.03.nix")
+  nix_options = {
+    "allowed-uris" = "https://github.com"
+    "restrict-eval" = "true"
+  }
+}
+
+data "packernix_os" "eval_only" {
+  file = "./testdata/os/configuration.nix"
+  clear_env = true
+  env = {
+    "HOME" = "/homeless-shelter"
+    "NIX_PATH" = "."
+  }
+  config = jsonencode({
+	"hostName" = "tfpnhost"
+  })
+  nixpkgs = jsondecode(data.packernix_eval.nixpkgs.out)
+  eval_only = true
+  query = {
+    "hostname" = "networking.hostName"
+    "ports" = "networking.firewall.allowedTCPPorts"
+  }
+}
@@ -19,5 +19,6 @@ data "packernix_os" "file" {
 	"hostName" = "tfpnhost"
   })
   nixpkgs = jsondecode(data.packernix_eval.nixpkgs.out)
+  build_attrs = ["etc"]
   out_link = "{{.TempDir}}/result-file"
 }
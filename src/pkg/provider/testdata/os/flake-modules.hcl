@@ -0,0 +1,33 @@
+provider packernix {}
+
+data "packernix_eval" "nixpkgs" {
+  inline = file("./testdata/os/nixpkgs-20.03.nix")
+  nix_options = {
+    "allowed-uris" = "https://github.com"
+    "restrict-eval" = "true"
+  }
+}
+
+data "packernix_os" "flake_modules" {
+  installable = "#nixosConfiguration"
+  flake_path = "./testdata/os"
+  clear_env = true
+  env = {
+    "NIX_PATH" = "."
+  }
+  config = jsonencode({
+	"hostName" = "tfpnhost"
+  })
+  nixpkgs = jsondecode(data.packernix_eval.nixpkgs.out)
+  eval_only = true
+  modules = ["./testdata/os/module.nix", "./testdata/os/sibling/module.nix"]
+  special_args_json = jsonencode({
+	"motd" = "hello"
+  })
+  overlays = ["./testdata/os/overlay.nix"]
+  query = {
+    "motd" = "users.motd"
+    "overlay" = "environment.etc.tfpn-overlay.text"
+    "sibling" = "environment.etc.tfpn-greeting.text"
+  }
+}
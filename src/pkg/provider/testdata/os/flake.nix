@@ -1,5 +1,13 @@
 {
   outputs = { self, ... }: {
     nixosConfiguration = import ./configuration.nix;
+    # Shaped like the result of nixpkgs.lib.nixosSystem with specialArgs
+    specialArgsConfiguration = {
+      options = { };
+      config._module = {
+        args.modules = [ ./configuration.nix ./special-args.nix ];
+        specialArgs = { greeting = "from specialArgs"; };
+      };
+    };
   };
 }
@@ -0,0 +1,5 @@
+{ pkgs, motd, ... }:
+{
+  users.motd = motd;
+  environment.etc.tfpn-overlay.text = pkgs.tfpnOverlay;
+}
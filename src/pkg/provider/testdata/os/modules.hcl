@@ -0,0 +1,38 @@
+provider packernix {}
+
+data "packernix_eval" "nixpkgs" {
+  inline = file("./testdata/os/nixpkgs-20.03.nix")
+  nix_options = {
+    "allowed-uris" = "https://github.com"
+    "restrict-eval" = "true"
+  }
+}
+
+data "packernix_os" "modules" {
+  file = "./testdata/os/configuration.nix"
+  clear_env = true
+  env = {
+    "HOME" = "/homeless-shelter"
+    "NIX_PATH" = "."
+  }
+  config = jsonencode({
+	"hostName" = "tfpnhost"
+  })
+  nixpkgs = jsondecode(data.packernix_eval.nixpkgs.out)
+  eval_only = true
+  modules = ["./testdata/os/module.nix"]
+  inline_module = "{ networking.domain = \"example.com\"; }"
+  special_args_json = jsonencode({
+	"motd" = "hello"
+  })
+  nixpkgs_config_json = jsonencode({
+	"allowUnfree" = true
+  })
+  overlays = ["./testdata/os/overlay.nix"]
+  query = {
+    "motd" = "users.motd"
+    "domain" = "networking.domain"
+    "unfree" = "nixpkgs.config.allowUnfree"
+    "overlay" = "environment.etc.tfpn-overlay.text"
+  }
+}
@@ -0,0 +1,11 @@
+provider packernix {}
+
+data "packernix_os" "no_builder" {
+  file = "./testdata/os/configuration.nix"
+  system = "mmix-mmixware"
+  nix_options = {
+    "builders" = ""
+    "extra-platforms" = ""
+  }
+  out_link = "{{.TempDir}}/result-no-builder"
+}
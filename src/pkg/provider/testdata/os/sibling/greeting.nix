@@ -0,0 +1,3 @@
+{
+  environment.etc.tfpn-greeting.text = builtins.readFile ./greeting.txt;
+}
@@ -0,0 +1,3 @@
+{
+  imports = [ ./greeting.nix ];
+}
@@ -0,0 +1,26 @@
+provider packernix {}
+
+data "packernix_eval" "nixpkgs" {
+  inline = file("./testdata/os/nixpkgs-20.03.nix")
+  nix_options = {
+    "allowed-uris" = "https://github.com"
+    "restrict-eval" = "true"
+  }
+}
+
+data "packernix_os" "special_args" {
+  installable = "#specialArgsConfiguration"
+  flake_path = "./testdata/os"
+  clear_env = true
+  env = {
+    "NIX_PATH" = "."
+  }
+  config = jsonencode({
+	"hostName" = "tfpnhost"
+  })
+  nixpkgs = jsondecode(data.packernix_eval.nixpkgs.out)
+  eval_only = true
+  query = {
+    "motd" = "users.motd"
+  }
+}
@@ -0,0 +1,7 @@
+{ config, baseModules, ... }:
+{
+  imports = baseModules;
+  nixpkgs.system = "aarch64-linux";
+  boot.isContainer = true;
+  networking.hostName = config.tfpn.hostName;
+}
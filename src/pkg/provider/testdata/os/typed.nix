@@ -0,0 +1,12 @@
+{ config, lib, tfpnModulesPath, baseModules, ... }:
+{
+  imports = baseModules ++ [
+    "${tfpnModulesPath}/vultr-config.nix"
+  ];
+  options.tfpn = lib.mkOption {
+    type = lib.types.submodule {
+      options.hostName = lib.mkOption { type = lib.types.str; };
+    };
+  };
+  config.networking.hostName = config.tfpn.hostName;
+}
@@ -0,0 +1,108 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"context"
+	"os/exec"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/dschema"
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/tools"
+)
+
+func NixBinDirDSchema() dschema.DSchema {
+	return &dschema.PathDSchema{
+		Optional:           true,
+		HasProviderDefault: true,
+		SkipHashCheck:      true,
+		Description:        "A directory containing the Nix executables",
+	}
+}
+
+func PackerBinDSchema() dschema.DSchema {
+	return &dschema.PathDSchema{
+		Optional:           true,
+		HasProviderDefault: true,
+		SkipHashCheck:      true,
+		Description:        "The Packer executable",
+	}
+}
+
+// Run a command of tools.Tools like the other commands of a resource
+func runToolCommand(ctx context.Context, cmd *exec.Cmd) error {
+	c := newCommand(ctx, cmd)
+	defer c.Close()
+	return c.Run(cmd.Run)
+}
+
+// Create a new tools.Tools whose commands are logged and audited
+func newTools(
+	nixBinDir string,
+	packerBin string,
+) (*tools.Tools, diag.Diagnostics) {
+	t, d := tools.New(nixBinDir, packerBin)
+	t.Run = runToolCommand
+	return t, d
+}
+
+// Resolve the executables set in the provider configuration
+func ConfigureTools(pc *ProviderContext) (d diag.Diagnostics) {
+	nbd, d := dschema.ProviderPath(pc, "nix_bin_dir")
+	if d.HasError() {
+		return
+	}
+	pb, d0 := dschema.ProviderPath(pc, "packer_bin")
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	t, d0 := newTools(nbd, pb)
+	d = append(d, d0...)
+	if d.HasError() {
+		return
+	}
+	pc.Tools = t
+	return
+}
+
+// Resolve the Nix executables for a resource with a nix_bin_dir argument
+func NixTools(
+	ctx context.Context,
+	dg dschema.DataGetter,
+	i interface{},
+) (t *tools.Tools, d diag.Diagnostics) {
+	pt := i.(*ProviderContext).Tools
+	nbd, d := dg.Get(ctx, "nix_bin_dir")
+	if d.HasError() {
+		return
+	}
+	if nbd.(string) == pt.NixBinDir {
+		return pt, d
+	}
+	t, d0 := newTools(nbd.(string), pt.PackerBin)
+	d = append(d, d0...)
+	return
+}
+
+// Resolve the Packer executable for a resource with a packer_bin argument
+func PackerTools(
+	ctx context.Context,
+	dg dschema.DataGetter,
+	i interface{},
+) (t *tools.Tools, d diag.Diagnostics) {
+	pt := i.(*ProviderContext).Tools
+	pb, d := dg.Get(ctx, "packer_bin")
+	if d.HasError() {
+		return
+	}
+	if pb.(string) == pt.PackerBin {
+		return pt, d
+	}
+	t, d0 := newTools(pt.NixBinDir, pb.(string))
+	d = append(d, d0...)
+	return
+}
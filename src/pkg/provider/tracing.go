@@ -0,0 +1,61 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package provider
+
+import (
+	"os"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/tracing"
+)
+
+// Default service.name of traces
+const traceServiceName = "terraform-provider-packernix"
+
+// Instrumentation scope of spans
+const traceScope = "github.com/leocp1/terraform-provider-packernix"
+
+func AddTracingPSchema(m map[string]*schema.Schema) {
+	m["trace_file"] = &schema.Schema{
+		Type:     schema.TypeString,
+		Optional: true,
+		Description: "A file to append OpenTelemetry traces to, as OTLP " +
+			"JSON lines",
+	}
+}
+
+// Create the tracer from trace_file and the OTEL_EXPORTER_OTLP_*
+// environment variables. Tracing stays disabled if neither is set.
+func ConfigureTracing(
+	pc *ProviderContext,
+	rd *schema.ResourceData,
+) (d diag.Diagnostics) {
+	exporters := []tracing.Exporter{}
+	if p, ok := rd.GetOk("trace_file"); ok {
+		fe, err := tracing.NewFileExporter(p.(string))
+		if err != nil {
+			return append(d, diag.FromErr(err)...)
+		}
+		exporters = append(exporters, fe)
+	}
+	he, err := tracing.ExporterFromEnv(os.Getenv)
+	if err != nil {
+		return append(d, diag.FromErr(err)...)
+	}
+	if he != nil {
+		exporters = append(exporters, he)
+	}
+	if len(exporters) == 0 {
+		return
+	}
+	res, err := tracing.ResourceFromEnv(os.Getenv, traceServiceName)
+	if err != nil {
+		return append(d, diag.FromErr(err)...)
+	}
+	pc.Tracer = tracing.NewTracer(res, traceScope, exporters...)
+	return
+}
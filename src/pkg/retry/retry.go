@@ -0,0 +1,118 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Retries of failed commands with exponential backoff.
+package retry
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"os/exec"
+	"regexp"
+	"time"
+)
+
+// When and how often to retry
+type Policy struct {
+	// Total number of attempts. Values less than 2 disable retries.
+	MaxAttempts int
+	// Delay before the first retry. Doubles after each retry.
+	Backoff time.Duration
+	// Upper bound of the delay. Unbounded if 0.
+	MaxBackoff time.Duration
+	// Fraction of the delay that is randomized, between 0 and 1
+	Jitter float64
+	// Exit codes of retryable failures
+	ExitCodes []int
+	// Patterns matching output lines of retryable failures
+	Patterns []*regexp.Regexp
+}
+
+// Report if a command that failed with err and printed lines should be
+// retried. If neither ExitCodes nor Patterns are set, every failed command is
+// retryable. Commands that could not be started are never retryable.
+func (p *Policy) Retryable(err error, lines []string) bool {
+	if p == nil || err == nil {
+		return false
+	}
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return false
+	}
+	if len(p.ExitCodes) == 0 && len(p.Patterns) == 0 {
+		return true
+	}
+	for _, c := range p.ExitCodes {
+		if ee.ExitCode() == c {
+			return true
+		}
+	}
+	for _, re := range p.Patterns {
+		for _, l := range lines {
+			if re.MatchString(l) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Delay before retry number n, starting at 1
+func (p *Policy) Delay(n int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < n; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		j := p.Jitter
+		if j > 1 {
+			j = 1
+		}
+		d += time.Duration(float64(d) * j * (2*rand.Float64() - 1))
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// Call f until it reports it should not be retried, or the attempts run out.
+// f is passed the attempt number, starting at 1. A nil policy makes a single
+// attempt. Returns the context's error if it is done while waiting.
+func Do(
+	ctx context.Context,
+	p *Policy,
+	name string,
+	f func(attempt int) (again bool),
+) error {
+	for attempt := 1; ; attempt++ {
+		again := f(attempt)
+		if !again || p == nil || attempt >= p.MaxAttempts {
+			return nil
+		}
+		d := p.Delay(attempt)
+		log.Printf(
+			"[WARN] [retry] %s failed on attempt %d of %d. Retrying in %s",
+			name,
+			attempt,
+			p.MaxAttempts,
+			d,
+		)
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/retry"
+)
+
+func exitErr(t *testing.T, code string) error {
+	t.Helper()
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	return exec.Command(sh, "-c", "exit "+code).Run()
+}
+
+func TestRetryable(t *testing.T) {
+	err3 := exitErr(t, "3")
+	err4 := exitErr(t, "4")
+	p := &Policy{
+		ExitCodes: []int{3},
+		Patterns:  []*regexp.Regexp{regexp.MustCompile("RequestLimit")},
+	}
+	tests := []struct {
+		name     string
+		p        *Policy
+		err      error
+		lines    []string
+		expected bool
+	}{
+		{"nil policy", nil, err3, nil, false},
+		{"success", p, nil, nil, false},
+		{"not started", p, errors.New("not found"), nil, false},
+		{"exit code", p, err3, nil, true},
+		{"other exit code", p, err4, nil, false},
+		{"pattern", p, err4, []string{"a", "RequestLimitExceeded"}, true},
+		{"any failure", &Policy{}, err4, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.p.Retryable(tt.err, tt.lines)
+			if got != tt.expected {
+				t.Errorf("expected %#v, but got %#v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestDelay(t *testing.T) {
+	p := &Policy{
+		Backoff:    time.Second,
+		MaxBackoff: 5 * time.Second,
+	}
+	expected := []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		5 * time.Second,
+		5 * time.Second,
+	}
+	for i, e := range expected {
+		got := p.Delay(i + 1)
+		if got != e {
+			t.Errorf("retry %d: expected %s, but got %s", i+1, e, got)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		got := p.Delay(1)
+		if got < time.Second/2 || got > 3*time.Second/2 {
+			t.Errorf("jittered delay %s out of range", got)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	ctx := context.Background()
+	p := &Policy{MaxAttempts: 3, Backoff: time.Millisecond}
+
+	attempts := []int{}
+	err := Do(ctx, p, "test", func(a int) bool {
+		attempts = append(attempts, a)
+		return true
+	})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if !reflect.DeepEqual(attempts, []int{1, 2, 3}) {
+		t.Errorf("unexpected attempts %#v", attempts)
+	}
+
+	attempts = []int{}
+	err = Do(ctx, p, "test", func(a int) bool {
+		attempts = append(attempts, a)
+		return a < 2
+	})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	if !reflect.DeepEqual(attempts, []int{1, 2}) {
+		t.Errorf("unexpected attempts %#v", attempts)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = Do(cctx, &Policy{MaxAttempts: 2, Backoff: time.Hour}, "test",
+		func(a int) bool {
+			return true
+		},
+	)
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, but got %#v", err)
+	}
+}
+
+func TestTail(t *testing.T) {
+	tl := NewTail(2)
+	tl.Write([]byte("a\nb\r\nc"))
+	tl.Write([]byte("d\ne"))
+	expected := []string{"b", "cd", "e"}
+	got := tl.Lines()
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %#v, but got %#v", expected, got)
+	}
+}
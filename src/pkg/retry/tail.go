@@ -0,0 +1,57 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package retry
+
+import (
+	"bytes"
+	"sync"
+)
+
+// A writer that keeps the last lines written to it
+type Tail struct {
+	l       sync.Mutex
+	n       int
+	lines   []string
+	partial []byte
+}
+
+// Keep at most n lines
+func NewTail(n int) *Tail {
+	return &Tail{n: n}
+}
+
+func (t *Tail) add(l string) {
+	t.lines = append(t.lines, l)
+	if len(t.lines) > t.n {
+		t.lines = t.lines[len(t.lines)-t.n:]
+	}
+}
+
+func (t *Tail) Write(b []byte) (int, error) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	buf := append(t.partial, b...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		t.add(string(bytes.TrimSuffix(buf[:i], []byte("\r"))))
+		buf = buf[i+1:]
+	}
+	t.partial = append([]byte(nil), buf...)
+	return len(b), nil
+}
+
+// The kept lines, including an unterminated last line
+func (t *Tail) Lines() []string {
+	t.l.Lock()
+	defer t.l.Unlock()
+	ls := append([]string(nil), t.lines...)
+	if len(t.partial) > 0 {
+		ls = append(ls, string(t.partial))
+	}
+	return ls
+}
@@ -0,0 +1,170 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Limit the number of concurrent expensive operations run by the provider.
+//
+// Terraform runs resources in parallel, so without limits several Nix builds
+// or Packer builds may compete for cores, the Nix daemon, and cloud API quotas.
+// Each class of operation has an independent weighted limit.
+package scheduler
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Operation classes
+const (
+	NixBuild    = "nix_build"
+	Eval        = "eval"
+	PackerBuild = "packer_build"
+)
+
+type waiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+// A FIFO weighted semaphore
+type limiter struct {
+	size    int64
+	cur     int64
+	mu      sync.Mutex
+	waiters list.List
+}
+
+func (l *limiter) acquire(ctx context.Context, n int64) error {
+	l.mu.Lock()
+	if l.size-l.cur >= n && l.waiters.Len() == 0 {
+		l.cur += n
+		l.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	elem := l.waiters.PushBack(waiter{n: n, ready: ready})
+	l.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		l.mu.Lock()
+		select {
+		case <-ready:
+			// Acquired after cancellation. Pretend cancellation came first.
+			l.cur -= n
+			l.notify()
+		default:
+			isFront := l.waiters.Front() == elem
+			l.waiters.Remove(elem)
+			if isFront && l.size > l.cur {
+				l.notify()
+			}
+		}
+		l.mu.Unlock()
+		return ctx.Err()
+	case <-ready:
+		return nil
+	}
+}
+
+func (l *limiter) release(n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cur -= n
+	if l.cur < 0 {
+		panic("scheduler: released more than held")
+	}
+	l.notify()
+}
+
+// Wake waiters in order. Must hold l.mu
+func (l *limiter) notify() {
+	for {
+		next := l.waiters.Front()
+		if next == nil {
+			return
+		}
+		w := next.Value.(waiter)
+		if l.size-l.cur < w.n {
+			return
+		}
+		l.cur += w.n
+		l.waiters.Remove(next)
+		close(w.ready)
+	}
+}
+
+type Scheduler struct {
+	ls map[string]*limiter
+}
+
+// Create a scheduler from a map of operation class to limit.
+// Classes with a limit less than 1 are unlimited.
+func New(limits map[string]int) *Scheduler {
+	s := &Scheduler{
+		ls: map[string]*limiter{},
+	}
+	for k, v := range limits {
+		if v > 0 {
+			s.ls[k] = &limiter{size: int64(v)}
+		}
+	}
+	return s
+}
+
+// Wait until an operation of the given class and weight may run.
+// Returns a function that must be called once the operation completes.
+// Weights larger than the limit are clamped to the limit, so an operation can
+// always eventually run.
+func (s *Scheduler) Acquire(
+	ctx context.Context,
+	class string,
+	name string,
+	weight int,
+) (release func(), err error) {
+	release = func() {}
+	if s == nil {
+		return
+	}
+	l, ok := s.ls[class]
+	if !ok {
+		return
+	}
+	n := int64(weight)
+	if n < 1 {
+		n = 1
+	}
+	if n > l.size {
+		n = l.size
+	}
+	start := time.Now()
+	err = l.acquire(ctx, n)
+	if err != nil {
+		err = fmt.Errorf(
+			"waiting for %s slot for %s: %s",
+			class,
+			name,
+			err.Error(),
+		)
+		return
+	}
+	log.Printf(
+		"[INFO] [scheduler] [%s] %s waited %s in queue (weight %d of %d)",
+		class,
+		name,
+		time.Since(start),
+		n,
+		l.size,
+	)
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			l.release(n)
+		})
+	}
+	return
+}
@@ -0,0 +1,85 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package scheduler_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/scheduler"
+)
+
+func TestSchedulerLimit(t *testing.T) {
+	ctx := context.Background()
+	s := New(map[string]int{NixBuild: 3})
+
+	var cur, max int64
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rel, err := s.Acquire(ctx, NixBuild, "test", w)
+			if err != nil {
+				t.Errorf("Acquire failed: %s", err.Error())
+				return
+			}
+			defer rel()
+			c := atomic.AddInt64(&cur, int64(w))
+			for {
+				m := atomic.LoadInt64(&max)
+				if c <= m || atomic.CompareAndSwapInt64(&max, m, c) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt64(&cur, -int64(w))
+		}(i%2 + 1)
+	}
+	wg.Wait()
+	if max > 3 {
+		t.Errorf("limit exceeded: %d", max)
+	}
+}
+
+func TestSchedulerUnlimited(t *testing.T) {
+	ctx := context.Background()
+	s := New(map[string]int{Eval: 0})
+	for i := 0; i < 10; i++ {
+		_, err := s.Acquire(ctx, Eval, "test", 100)
+		if err != nil {
+			t.Fatalf("Acquire failed: %s", err.Error())
+		}
+	}
+}
+
+func TestSchedulerClampAndCancel(t *testing.T) {
+	s := New(map[string]int{PackerBuild: 1})
+	rel, err := s.Acquire(context.Background(), PackerBuild, "first", 5)
+	if err != nil {
+		t.Fatalf("Acquire of clamped weight failed: %s", err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		10*time.Millisecond,
+	)
+	defer cancel()
+	_, err = s.Acquire(ctx, PackerBuild, "second", 1)
+	if err == nil {
+		t.Fatalf("Acquire on full scheduler succeeded")
+	}
+
+	rel()
+	rel()
+	rel, err = s.Acquire(context.Background(), PackerBuild, "third", 1)
+	if err != nil {
+		t.Fatalf("Acquire after release failed: %s", err.Error())
+	}
+	rel()
+}
@@ -0,0 +1,69 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+)
+
+// Read the NAR sizes of the store paths in the closure of p. Nix is run in
+// the directory dir with the environment env, as in exec.Cmd.
+func (t *Tools) ClosureSizes(
+	ctx context.Context,
+	p string,
+	dir string,
+	env []string,
+) (map[string]int64, error) {
+	cmd := exec.CommandContext(
+		ctx,
+		t.Nix(),
+		"path-info",
+		"--option", "extra-experimental-features", "nix-command",
+		"--recursive",
+		"--json",
+		p,
+	)
+	cmd.Dir = dir
+	cmd.Env = env
+	out, err := t.output(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePathInfo(out)
+}
+
+type pathInfo struct {
+	Path    string `json:"path"`
+	NarSize int64  `json:"narSize"`
+}
+
+// Parse the output of nix path-info --json into a map of store paths to NAR
+// sizes. Older versions of Nix output a list of objects with a path attribute,
+// newer versions an object keyed by store path.
+func ParsePathInfo(out []byte) (map[string]int64, error) {
+	sizes := map[string]int64{}
+	var l []pathInfo
+	if err := json.Unmarshal(out, &l); err == nil {
+		for _, pi := range l {
+			sizes[pi.Path] = pi.NarSize
+		}
+		return sizes, nil
+	}
+	var m map[string]*pathInfo
+	if err := json.Unmarshal(out, &m); err != nil {
+		return nil, err
+	}
+	for p, pi := range m {
+		// Invalid paths are null
+		if pi == nil {
+			return nil, fmt.Errorf("%s is not a valid store path", p)
+		}
+		sizes[p] = pi.NarSize
+	}
+	return sizes, nil
+}
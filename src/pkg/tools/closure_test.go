@@ -0,0 +1,75 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package tools_test
+
+import (
+	"context"
+	"os/exec"
+	"reflect"
+	"testing"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/tools"
+)
+
+func TestParsePathInfo(t *testing.T) {
+	expected := map[string]int64{
+		"/nix/store/00000000000000000000000000000000-hello-2.10": 205464,
+		"/nix/store/11111111111111111111111111111111-glibc-2.31": 30524536,
+	}
+	ts := []struct {
+		name string
+		out  string
+	}{
+		{
+			name: "List",
+			out: `[{"path":"/nix/store/00000000000000000000000000000000-hello-2.10","narSize":205464},` +
+				`{"path":"/nix/store/11111111111111111111111111111111-glibc-2.31","narSize":30524536}]`,
+		},
+		{
+			name: "Object",
+			out: `{"/nix/store/00000000000000000000000000000000-hello-2.10":{"narSize":205464},` +
+				`"/nix/store/11111111111111111111111111111111-glibc-2.31":{"narSize":30524536}}`,
+		},
+	}
+	for _, tt := range ts {
+		t.Run(tt.name, func(t *testing.T) {
+			sizes, err := ParsePathInfo([]byte(tt.out))
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if !reflect.DeepEqual(sizes, expected) {
+				t.Errorf("expected %#v, got %#v", expected, sizes)
+			}
+		})
+	}
+
+	_, err := ParsePathInfo(
+		[]byte(`{"/nix/store/00000000000000000000000000000000-hello-2.10":null}`),
+	)
+	if err == nil {
+		t.Errorf("expected an error for an invalid path")
+	}
+}
+
+func TestClosureSizesCommand(t *testing.T) {
+	const p = "/nix/store/00000000000000000000000000000000-hello-2.10"
+	tl := &Tools{NixBinDir: "/nonexistent"}
+	var ran *exec.Cmd
+	tl.Run = func(ctx context.Context, cmd *exec.Cmd) error {
+		ran = cmd
+		_, err := cmd.Stdout.Write([]byte(`[{"path":"` + p + `","narSize":1}]`))
+		return err
+	}
+	sizes, err := tl.ClosureSizes(context.Background(), p, "/wd", []string{"A=b"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !reflect.DeepEqual(sizes, map[string]int64{p: 1}) {
+		t.Errorf("unexpected sizes %#v", sizes)
+	}
+	if ran.Dir != "/wd" || !reflect.DeepEqual(ran.Env, []string{"A=b"}) {
+		t.Errorf("command not run in the resource environment: %#v", ran)
+	}
+}
@@ -0,0 +1,122 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package tools
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// Read the Nix configuration, with options passed as --option flags. Nix is
+// run in the directory dir with the environment env, as in exec.Cmd.
+func (t *Tools) NixConfig(
+	ctx context.Context,
+	options map[string]string,
+	dir string,
+	env []string,
+) (map[string]string, error) {
+	// Older versions of Nix only warn about the unknown setting
+	args := []string{
+		"show-config",
+		"--option", "extra-experimental-features", "nix-command",
+	}
+	for k, v := range options {
+		args = append(args, "--option", k, v)
+	}
+	cmd := exec.CommandContext(ctx, t.Nix(), args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	out, err := t.output(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return ParseNixConfig(string(out)), nil
+}
+
+// Parse the "name = value" lines output by nix show-config
+func ParseNixConfig(out string) map[string]string {
+	cfg := map[string]string{}
+	for _, l := range strings.Split(out, "\n") {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		cfg[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return cfg
+}
+
+// Systems Nix can build derivations for with the configuration cfg: the local
+// system, extra-platforms, and the systems of the machines in builders.
+// Machine files that do not exist are skipped, as Nix does.
+func BuildSystems(cfg map[string]string) ([]string, error) {
+	local := cfg["system"]
+	sm := map[string]bool{}
+	if local != "" {
+		sm[local] = true
+	}
+	for _, s := range strings.Fields(cfg["extra-platforms"]) {
+		sm[s] = true
+	}
+
+	machines, err := builderMachines(cfg["builders"], true)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range machines {
+		fs := strings.Fields(m)
+		// Machines without systems build for the local system
+		if len(fs) < 2 || fs[1] == "-" {
+			continue
+		}
+		for _, s := range strings.Split(fs[1], ",") {
+			sm[s] = true
+		}
+	}
+
+	systems := make([]string, 0, len(sm))
+	for s := range sm {
+		systems = append(systems, s)
+	}
+	sort.Strings(systems)
+	return systems, nil
+}
+
+// Split a builders specification into machine lines. If expand is true,
+// @file references are replaced by the lines of the file.
+func builderMachines(spec string, expand bool) (ms []string, err error) {
+	for _, l := range strings.FieldsFunc(spec, func(r rune) bool {
+		return r == '\n' || r == ';'
+	}) {
+		if i := strings.Index(l, "#"); i >= 0 {
+			l = l[:i]
+		}
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		if !expand || !strings.HasPrefix(l, "@") {
+			ms = append(ms, l)
+			continue
+		}
+		b, err := ioutil.ReadFile(l[1:])
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		fms, err := builderMachines(string(b), false)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, fms...)
+	}
+	return
+}
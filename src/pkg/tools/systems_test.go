@@ -0,0 +1,100 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package tools_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/tools"
+)
+
+func TestParseNixConfig(t *testing.T) {
+	cfg := ParseNixConfig("builders = \nextra-platforms = i686-linux\n" +
+		"system = x86_64-linux\nwarning: not a setting\n")
+	expected := map[string]string{
+		"builders":        "",
+		"extra-platforms": "i686-linux",
+		"system":          "x86_64-linux",
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("expected %#v, got %#v", expected, cfg)
+	}
+}
+
+func TestBuildSystems(t *testing.T) {
+	td, err := ioutil.TempDir("", "systems_test")
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	defer os.RemoveAll(td)
+	machines := filepath.Join(td, "machines")
+	err = ioutil.WriteFile(
+		machines,
+		[]byte("# remote builders\n"+
+			"ssh://arm aarch64-linux,armv7l-linux /key 4\n"+
+			"ssh://local - /key\n"),
+		0600,
+	)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	ts := []struct {
+		name     string
+		cfg      map[string]string
+		expected []string
+	}{
+		{
+			name:     "Local",
+			cfg:      map[string]string{"system": "x86_64-linux"},
+			expected: []string{"x86_64-linux"},
+		},
+		{
+			name: "ExtraPlatforms",
+			cfg: map[string]string{
+				"system":          "x86_64-linux",
+				"extra-platforms": "i686-linux aarch64-linux",
+			},
+			expected: []string{"aarch64-linux", "i686-linux", "x86_64-linux"},
+		},
+		{
+			name: "Builders",
+			cfg: map[string]string{
+				"system":   "x86_64-linux",
+				"builders": "ssh://mac x86_64-darwin ; @" + machines,
+			},
+			expected: []string{
+				"aarch64-linux",
+				"armv7l-linux",
+				"x86_64-darwin",
+				"x86_64-linux",
+			},
+		},
+		{
+			name: "MissingMachinesFile",
+			cfg: map[string]string{
+				"system":   "x86_64-linux",
+				"builders": "@" + filepath.Join(td, "missing"),
+			},
+			expected: []string{"x86_64-linux"},
+		},
+	}
+	for _, tt := range ts {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			systems, err := BuildSystems(tt.cfg)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if !reflect.DeepEqual(systems, tt.expected) {
+				t.Errorf("expected %#v, got %#v", tt.expected, systems)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Resolve the external executables used by the provider.
+//
+// Executables can be set at runtime. If unset, the (possibly patched)
+// defaults from the patches package are used.
+package tools
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/hashicorp/go-cty/cty"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+
+	"github.com/leocp1/terraform-provider-packernix/src/pkg/patches"
+)
+
+// Executables expected in a Nix bin directory
+var NixExecutables = []string{
+	"nix",
+	"nix-build",
+	"nix-instantiate",
+	"nix-store",
+}
+
+type Tools struct {
+	// Directory containing the Nix executables. If empty, use the defaults
+	NixBinDir string
+	// The Packer executable. If empty, use the default
+	PackerBin string
+	// Runs the commands of the methods of Tools, e.g. to log them. If nil,
+	// they are run directly.
+	Run func(ctx context.Context, cmd *exec.Cmd) error
+}
+
+// Check that a path is an executable file
+func CheckExecutable(p string) error {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s is a directory", p)
+	}
+	if fi.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", p)
+	}
+	return nil
+}
+
+// Create a new Tools, checking that any set executables exist
+func New(
+	nixBinDir string,
+	packerBin string,
+) (t *Tools, d diag.Diagnostics) {
+	t = &Tools{
+		NixBinDir: nixBinDir,
+		PackerBin: packerBin,
+	}
+	if nixBinDir != "" {
+		for _, n := range NixExecutables {
+			err := CheckExecutable(filepath.Join(nixBinDir, n))
+			if err != nil {
+				d = append(d, diag.Diagnostic{
+					Severity:      diag.Error,
+					AttributePath: cty.GetAttrPath("nix_bin_dir"),
+					Summary:       err.Error(),
+				})
+			}
+		}
+	}
+	if packerBin != "" {
+		err := CheckExecutable(packerBin)
+		if err != nil {
+			d = append(d, diag.Diagnostic{
+				Severity:      diag.Error,
+				AttributePath: cty.GetAttrPath("packer_bin"),
+				Summary:       err.Error(),
+			})
+		}
+	}
+	return
+}
+
+func (t *Tools) nixTool(name string, def func() string) string {
+	if t.NixBinDir == "" {
+		return def()
+	}
+	return filepath.Join(t.NixBinDir, name)
+}
+
+func (t *Tools) Nix() string {
+	return t.nixTool("nix", patches.Nix)
+}
+
+func (t *Tools) NixBuild() string {
+	return t.nixTool("nix-build", patches.NixBuild)
+}
+
+func (t *Tools) NixInstantiate() string {
+	return t.nixTool("nix-instantiate", patches.NixInstantiate)
+}
+
+func (t *Tools) NixStore() string {
+	return t.nixTool("nix-store", patches.NixStore)
+}
+
+func (t *Tools) Packer() string {
+	if t.PackerBin == "" {
+		return patches.Packer()
+	}
+	return t.PackerBin
+}
+
+// Look up an executable in PATH if it is not already a path.
+// Returns the empty string if not found.
+func LookPath(exe string) string {
+	p, err := exec.LookPath(exe)
+	if err != nil {
+		return ""
+	}
+	p, err = filepath.Abs(p)
+	if err != nil {
+		return ""
+	}
+	return p
+}
+
+func (t *Tools) run(ctx context.Context, cmd *exec.Cmd) error {
+	if t.Run == nil {
+		return cmd.Run()
+	}
+	return t.Run(ctx, cmd)
+}
+
+// Run a command and return its output. Its standard error is included in the
+// error on failure.
+func (t *Tools) output(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	outb := &bytes.Buffer{}
+	errb := &bytes.Buffer{}
+	cmd.Stdout = outb
+	cmd.Stderr = errb
+	err := t.run(ctx, cmd)
+	if err != nil {
+		if errb.Len() != 0 {
+			return nil, fmt.Errorf("%s: %s", err.Error(), errb.Bytes())
+		}
+		return nil, err
+	}
+	return outb.Bytes(), nil
+}
+
+// Check for nix flake support
+func (t *Tools) SupportsNixFlake(ctx context.Context) bool {
+	cmd := exec.CommandContext(ctx, t.Nix(), "flake", "--help")
+	err := t.run(ctx, cmd)
+	if err != nil {
+		return false
+	}
+	return true
+}
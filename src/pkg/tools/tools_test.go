@@ -0,0 +1,112 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package tools_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/tools"
+)
+
+func writeExe(t *testing.T, p string, mode os.FileMode) {
+	t.Helper()
+	err := ioutil.WriteFile(p, []byte("#!/bin/sh\n"), mode)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+}
+
+func TestTools(t *testing.T) {
+	td, err := ioutil.TempDir("", "tools_test")
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	defer os.RemoveAll(td)
+
+	nbd := filepath.Join(td, "bin")
+	err = os.Mkdir(nbd, 0700)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, n := range NixExecutables {
+		writeExe(t, filepath.Join(nbd, n), 0700)
+	}
+	packer := filepath.Join(td, "packer")
+	writeExe(t, packer, 0700)
+	notExe := filepath.Join(td, "not-exe")
+	writeExe(t, notExe, 0600)
+
+	tl, d := New(nbd, packer)
+	if d.HasError() {
+		t.Fatalf("New failed: %#v", d)
+	}
+	if tl.NixBuild() != filepath.Join(nbd, "nix-build") {
+		t.Errorf("unexpected nix-build %#v", tl.NixBuild())
+	}
+	if tl.Packer() != packer {
+		t.Errorf("unexpected packer %#v", tl.Packer())
+	}
+
+	_, d = New("", notExe)
+	if !d.HasError() {
+		t.Errorf("non executable packer accepted")
+	}
+	_, d = New(td, "")
+	if !d.HasError() {
+		t.Errorf("directory without nix accepted")
+	}
+	_, d = New("", nbd)
+	if !d.HasError() {
+		t.Errorf("directory accepted as packer")
+	}
+
+	tl, d = New("", "")
+	if d.HasError() {
+		t.Fatalf("New with defaults failed: %#v", d)
+	}
+	if tl.Nix() == "" || tl.Packer() == "" {
+		t.Errorf("empty default executable")
+	}
+}
+
+func TestToolsRun(t *testing.T) {
+	ctx := context.Background()
+	tl := &Tools{NixBinDir: "/nonexistent"}
+	var args [][]string
+	tl.Run = func(ctx context.Context, cmd *exec.Cmd) error {
+		args = append(args, cmd.Args[1:])
+		if cmd.Stdout == nil {
+			return nil
+		}
+		_, err := cmd.Stdout.Write([]byte("system = x86_64-linux\n"))
+		return err
+	}
+	if !tl.SupportsNixFlake(ctx) {
+		t.Errorf("flake support not found")
+	}
+	cfg, err := tl.NixConfig(ctx, nil, "", nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if cfg["system"] != "x86_64-linux" {
+		t.Errorf("unexpected configuration %#v", cfg)
+	}
+	expected := [][]string{
+		{"flake", "--help"},
+		{
+			"show-config",
+			"--option", "extra-experimental-features", "nix-command",
+		},
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected commands %#v, but got %#v", expected, args)
+	}
+}
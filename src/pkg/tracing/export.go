@@ -0,0 +1,212 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Appends each export request as a line of JSON to a file, like the file
+// exporter of the OpenTelemetry Collector
+type FileExporter struct {
+	l sync.Mutex
+	f *os.File
+}
+
+// Open the file at p for appending, creating it and its directory if needed
+func NewFileExporter(p string) (*FileExporter, error) {
+	err := os.MkdirAll(filepath.Dir(p), 0700)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{f: f}, nil
+}
+
+func (fe *FileExporter) Export(ctx context.Context, req *ExportRequest) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	fe.l.Lock()
+	defer fe.l.Unlock()
+	_, err = fe.f.Write(b)
+	return err
+}
+
+// Sends export requests to an OTLP/HTTP endpoint with JSON encoding
+type HTTPExporter struct {
+	// Full URL, usually ending in /v1/traces
+	Endpoint string
+	Headers  map[string]string
+	Timeout  time.Duration
+	Client   *http.Client
+}
+
+func (he *HTTPExporter) Export(ctx context.Context, req *ExportRequest) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if he.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, he.Timeout)
+		defer cancel()
+	}
+	hreq, err := http.NewRequest(
+		http.MethodPost,
+		he.Endpoint,
+		bytes.NewBuffer(b),
+	)
+	if err != nil {
+		return err
+	}
+	hreq = hreq.WithContext(ctx)
+	hreq.Header.Set("Content-Type", "application/json")
+	for k, v := range he.Headers {
+		hreq.Header.Set(k, v)
+	}
+	c := he.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	resp, err := c.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf(
+			"%s returned %s: %s",
+			he.Endpoint,
+			resp.Status,
+			strings.TrimSpace(string(msg)),
+		)
+	}
+	return nil
+}
+
+// Parse a list of the form "key1=value1,key2=value2", with URL encoded values
+func parseList(s string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 {
+			return nil, fmt.Errorf("%#v is not of the form key=value", kv)
+		}
+		v, err := url.QueryUnescape(strings.TrimSpace(p[1]))
+		if err != nil {
+			return nil, err
+		}
+		m[strings.TrimSpace(p[0])] = v
+	}
+	return m, nil
+}
+
+// Get the trace specific variant of an OTEL_EXPORTER_OTLP_ variable if set
+func getOTLP(getenv func(string) string, name string) string {
+	v := getenv("OTEL_EXPORTER_OTLP_TRACES_" + name)
+	if v == "" {
+		v = getenv("OTEL_EXPORTER_OTLP_" + name)
+	}
+	return v
+}
+
+// Create an exporter from the standard OpenTelemetry environment variables:
+//	- OTEL_TRACES_EXPORTER: "none" disables exporting
+//	- OTEL_EXPORTER_OTLP_ENDPOINT: base URL. "/v1/traces" is appended.
+//	- OTEL_EXPORTER_OTLP_TRACES_ENDPOINT: full URL
+//	- OTEL_EXPORTER_OTLP_HEADERS, OTEL_EXPORTER_OTLP_TRACES_HEADERS
+//	- OTEL_EXPORTER_OTLP_TIMEOUT, OTEL_EXPORTER_OTLP_TRACES_TIMEOUT
+//	- OTEL_EXPORTER_OTLP_PROTOCOL, OTEL_EXPORTER_OTLP_TRACES_PROTOCOL: only
+//	  the HTTP protocols are supported. Requests are always JSON encoded.
+// Returns nil if no endpoint is set.
+func ExporterFromEnv(getenv func(string) string) (*HTTPExporter, error) {
+	if getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return nil, nil
+	}
+	ep := getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if ep == "" {
+		base := getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil, nil
+		}
+		ep = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	proto := getOTLP(getenv, "PROTOCOL")
+	if proto != "" && proto != "http/json" && proto != "http/protobuf" {
+		return nil, fmt.Errorf(
+			"unsupported OTLP protocol %#v. Use http/json",
+			proto,
+		)
+	}
+	headers, err := parseList(getOTLP(getenv, "HEADERS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP headers: %w", err)
+	}
+	he := &HTTPExporter{
+		Endpoint: ep,
+		Headers:  headers,
+		Timeout:  10 * time.Second,
+	}
+	if ts := getOTLP(getenv, "TIMEOUT"); ts != "" {
+		ms, err := strconv.Atoi(ts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTLP timeout: %w", err)
+		}
+		he.Timeout = time.Duration(ms) * time.Millisecond
+	}
+	return he, nil
+}
+
+// Resource attributes from OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES.
+// service.name defaults to defaultName.
+func ResourceFromEnv(
+	getenv func(string) string,
+	defaultName string,
+) ([]Attribute, error) {
+	ra, err := parseList(getenv("OTEL_RESOURCE_ATTRIBUTES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTEL_RESOURCE_ATTRIBUTES: %w", err)
+	}
+	if _, ok := ra["service.name"]; !ok {
+		ra["service.name"] = defaultName
+	}
+	if sn := getenv("OTEL_SERVICE_NAME"); sn != "" {
+		ra["service.name"] = sn
+	}
+	keys := make([]string, 0, len(ra))
+	for k := range ra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	attrs := []Attribute{}
+	for _, k := range keys {
+		attrs = append(attrs, String(k, ra[k]))
+	}
+	return attrs, nil
+}
@@ -0,0 +1,144 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package tracing
+
+import (
+	"strconv"
+	"time"
+)
+
+// The JSON encoding of an OTLP ExportTraceServiceRequest. See
+// https://github.com/open-telemetry/opentelemetry-proto
+type ExportRequest struct {
+	ResourceSpans []ResourceSpans `json:"resourceSpans"`
+}
+
+type ResourceSpans struct {
+	Resource   Resource     `json:"resource"`
+	ScopeSpans []ScopeSpans `json:"scopeSpans"`
+}
+
+type Resource struct {
+	Attributes []Attribute `json:"attributes"`
+}
+
+type ScopeSpans struct {
+	Scope Scope      `json:"scope"`
+	Spans []SpanData `json:"spans"`
+}
+
+type Scope struct {
+	Name string `json:"name"`
+}
+
+type SpanData struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []Attribute `json:"attributes"`
+	Events            []Event     `json:"events"`
+	Status            Status      `json:"status"`
+}
+
+type Event struct {
+	TimeUnixNano string      `json:"timeUnixNano"`
+	Name         string      `json:"name"`
+	Attributes   []Attribute `json:"attributes"`
+}
+
+type Status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type Attribute struct {
+	Key   string `json:"key"`
+	Value Value  `json:"value"`
+}
+
+type Value struct {
+	StringValue *string     `json:"stringValue,omitempty"`
+	BoolValue   *bool       `json:"boolValue,omitempty"`
+	IntValue    *string     `json:"intValue,omitempty"`
+	ArrayValue  *ArrayValue `json:"arrayValue,omitempty"`
+}
+
+type ArrayValue struct {
+	Values []Value `json:"values"`
+}
+
+func String(k string, v string) Attribute {
+	return Attribute{Key: k, Value: Value{StringValue: &v}}
+}
+
+func Bool(k string, v bool) Attribute {
+	return Attribute{Key: k, Value: Value{BoolValue: &v}}
+}
+
+// 64 bit integers are encoded as strings
+func Int(k string, v int) Attribute {
+	s := strconv.Itoa(v)
+	return Attribute{Key: k, Value: Value{IntValue: &s}}
+}
+
+func StringSlice(k string, v []string) Attribute {
+	a := &ArrayValue{Values: []Value{}}
+	for i := range v {
+		a.Values = append(a.Values, Value{StringValue: &v[i]})
+	}
+	return Attribute{Key: k, Value: Value{ArrayValue: a}}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func nonNil(a []Attribute) []Attribute {
+	if a == nil {
+		return []Attribute{}
+	}
+	return a
+}
+
+func (t *Tracer) request(spans []*Span) *ExportRequest {
+	sd := make([]SpanData, 0, len(spans))
+	for _, s := range spans {
+		s.l.Lock()
+		d := SpanData{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parent,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: unixNano(s.start),
+			EndTimeUnixNano:   unixNano(s.end),
+			Attributes:        nonNil(s.attrs),
+			Events:            []Event{},
+			Status:            Status{Code: s.status, Message: s.message},
+		}
+		for _, e := range s.events {
+			d.Events = append(d.Events, Event{
+				TimeUnixNano: unixNano(e.time),
+				Name:         e.name,
+				Attributes:   nonNil(e.attrs),
+			})
+		}
+		s.l.Unlock()
+		sd = append(sd, d)
+	}
+	return &ExportRequest{
+		ResourceSpans: []ResourceSpans{{
+			Resource: Resource{Attributes: nonNil(t.Resource)},
+			ScopeSpans: []ScopeSpans{{
+				Scope: Scope{Name: t.Scope},
+				Spans: sd,
+			}},
+		}},
+	}
+}
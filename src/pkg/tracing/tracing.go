@@ -0,0 +1,213 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Minimal OpenTelemetry tracing, exported as OTLP JSON.
+//
+// Spans are kept until the root span of their trace ends, and are then
+// exported together.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+// Receives finished traces
+type Exporter interface {
+	Export(ctx context.Context, req *ExportRequest) error
+}
+
+// Creates spans and exports them
+type Tracer struct {
+	// Attributes of the resource producing the spans, like service.name
+	Resource  []Attribute
+	Scope     string
+	Exporters []Exporter
+
+	l       sync.Mutex
+	pending map[string][]*Span
+}
+
+func NewTracer(
+	resource []Attribute,
+	scope string,
+	exporters ...Exporter,
+) *Tracer {
+	return &Tracer{
+		Resource:  resource,
+		Scope:     scope,
+		Exporters: exporters,
+		pending:   map[string][]*Span{},
+	}
+}
+
+// Span kinds
+const (
+	KindInternal = 1
+	KindClient   = 3
+)
+
+// Span status codes
+const (
+	StatusUnset = 0
+	StatusOK    = 1
+	StatusError = 2
+)
+
+// A timed operation. All methods are safe to call on a nil span, which is
+// returned when tracing is disabled.
+type Span struct {
+	t       *Tracer
+	l       sync.Mutex
+	traceID string
+	spanID  string
+	parent  string
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   []Attribute
+	events  []event
+	status  int
+	message string
+}
+
+type event struct {
+	time  time.Time
+	name  string
+	attrs []Attribute
+}
+
+type ctxKey struct{}
+
+type spanKey struct{}
+
+// Return a context whose spans are created by t. A nil t disables tracing.
+func NewContext(ctx context.Context, t *Tracer) context.Context {
+	return context.WithValue(ctx, ctxKey{}, t)
+}
+
+// The current span of ctx. nil if there is none.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Start a span of kind KindInternal as a child of the current span of ctx.
+// Returns a context with the new span as its current span. Returns a nil span
+// if ctx has no tracer.
+func Start(
+	ctx context.Context,
+	name string,
+	attrs ...Attribute,
+) (context.Context, *Span) {
+	return StartKind(ctx, name, KindInternal, attrs...)
+}
+
+// Start a span of the given kind
+func StartKind(
+	ctx context.Context,
+	name string,
+	kind int,
+	attrs ...Attribute,
+) (context.Context, *Span) {
+	t, _ := ctx.Value(ctxKey{}).(*Tracer)
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{
+		t:      t,
+		spanID: randomHex(8),
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+		attrs:  attrs,
+	}
+	if p := SpanFromContext(ctx); p != nil {
+		s.traceID = p.traceID
+		s.parent = p.spanID
+	} else {
+		s.traceID = randomHex(16)
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+func (s *Span) AddEvent(name string, attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.events = append(s.events, event{
+		time:  time.Now(),
+		name:  name,
+		attrs: attrs,
+	})
+}
+
+// Set the status to StatusError if err is not nil, and StatusOK otherwise
+func (s *Span) SetError(err error) {
+	if s == nil {
+		return
+	}
+	s.l.Lock()
+	defer s.l.Unlock()
+	if err != nil {
+		s.status = StatusError
+		s.message = err.Error()
+	} else {
+		s.status = StatusOK
+		s.message = ""
+	}
+}
+
+// End the span. Exports the trace if the span is its root.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.l.Lock()
+	s.end = time.Now()
+	s.l.Unlock()
+	s.t.finish(s)
+}
+
+func (t *Tracer) finish(s *Span) {
+	t.l.Lock()
+	spans := append(t.pending[s.traceID], s)
+	if s.parent != "" {
+		t.pending[s.traceID] = spans
+		t.l.Unlock()
+		return
+	}
+	delete(t.pending, s.traceID)
+	t.l.Unlock()
+
+	req := t.request(spans)
+	for _, e := range t.Exporters {
+		err := e.Export(context.Background(), req)
+		if err != nil {
+			log.Printf("[WARN] [tracing] export failed: %s", err.Error())
+		}
+	}
+}
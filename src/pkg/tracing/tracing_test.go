@@ -0,0 +1,184 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/leocp1/terraform-provider-packernix/src/pkg/tracing"
+)
+
+type recorder struct {
+	l    sync.Mutex
+	reqs []*ExportRequest
+}
+
+func (r *recorder) Export(ctx context.Context, req *ExportRequest) error {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.reqs = append(r.reqs, req)
+	return nil
+}
+
+func TestDisabled(t *testing.T) {
+	ctx, s := Start(context.Background(), "root")
+	if s != nil || SpanFromContext(ctx) != nil {
+		t.Errorf("span created without a tracer")
+	}
+	s.SetAttributes(String("k", "v"))
+	s.AddEvent("e")
+	s.SetError(errors.New("fail"))
+	s.End()
+}
+
+func TestTrace(t *testing.T) {
+	r := &recorder{}
+	tr := NewTracer([]Attribute{String("service.name", "test")}, "scope", r)
+	ctx := NewContext(context.Background(), tr)
+
+	ctx, root := Start(ctx, "root", String("k", "v"))
+	_, child := StartKind(ctx, "child", KindClient)
+	child.AddEvent("say", String("message", "hi"))
+	child.SetError(errors.New("fail"))
+	child.End()
+	if len(r.reqs) != 0 {
+		t.Fatalf("exported before the root span ended")
+	}
+	root.SetAttributes(Int("n", 1), StringSlice("ids", []string{"a"}))
+	root.SetError(nil)
+	root.End()
+	if len(r.reqs) != 1 {
+		t.Fatalf("expected 1 export, but got %d", len(r.reqs))
+	}
+
+	rs := r.reqs[0].ResourceSpans[0]
+	if *rs.Resource.Attributes[0].Value.StringValue != "test" {
+		t.Errorf("unexpected resource %#v", rs.Resource)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, but got %d", len(spans))
+	}
+	c, p := spans[0], spans[1]
+	if c.Name != "child" || p.Name != "root" {
+		t.Errorf("unexpected span order %#v", spans)
+	}
+	if c.TraceID != p.TraceID || c.ParentSpanID != p.SpanID ||
+		p.ParentSpanID != "" || len(p.TraceID) != 32 || len(p.SpanID) != 16 {
+		t.Errorf("unexpected ids %#v %#v", c, p)
+	}
+	if c.Kind != KindClient || c.Status.Code != StatusError ||
+		c.Status.Message != "fail" || p.Status.Code != StatusOK {
+		t.Errorf("unexpected kind or status %#v %#v", c, p)
+	}
+	if len(c.Events) != 1 || c.Events[0].Name != "say" {
+		t.Errorf("unexpected events %#v", c.Events)
+	}
+
+	b, err := json.Marshal(p.Attributes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"key":"k","value":{"stringValue":"v"}},` +
+		`{"key":"n","value":{"intValue":"1"}},` +
+		`{"key":"ids","value":{"arrayValue":{"values":[` +
+		`{"stringValue":"a"}]}}}]`
+	if string(b) != expected {
+		t.Errorf("expected %s, but got %s", expected, b)
+	}
+}
+
+func TestExporterFromEnv(t *testing.T) {
+	var got *ExportRequest
+	var header string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			header = r.Header.Get("Authorization")
+			if r.URL.Path != "/v1/traces" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			b, _ := ioutil.ReadAll(r.Body)
+			got = &ExportRequest{}
+			json.Unmarshal(b, got)
+		},
+	))
+	defer srv.Close()
+
+	env := map[string]string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT": srv.URL + "/",
+		"OTEL_EXPORTER_OTLP_HEADERS":  "Authorization=Bearer%20abc",
+		"OTEL_EXPORTER_OTLP_TIMEOUT":  "500",
+	}
+	getenv := func(k string) string { return env[k] }
+	he, err := ExporterFromEnv(getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if he.Timeout != 500*time.Millisecond {
+		t.Errorf("unexpected timeout %s", he.Timeout)
+	}
+	req := &ExportRequest{ResourceSpans: []ResourceSpans{}}
+	err = he.Export(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, req) || header != "Bearer abc" {
+		t.Errorf("unexpected request %#v with header %#v", got, header)
+	}
+
+	env["OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"] = srv.URL + "/other"
+	he, err = ExporterFromEnv(getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if he.Export(context.Background(), req) == nil {
+		t.Errorf("expected an error from a failed request")
+	}
+
+	env["OTEL_TRACES_EXPORTER"] = "none"
+	he, err = ExporterFromEnv(getenv)
+	if he != nil || err != nil {
+		t.Errorf("expected exporting to be disabled")
+	}
+	delete(env, "OTEL_TRACES_EXPORTER")
+
+	env["OTEL_EXPORTER_OTLP_PROTOCOL"] = "grpc"
+	_, err = ExporterFromEnv(getenv)
+	if err == nil {
+		t.Errorf("expected grpc to be unsupported")
+	}
+
+	he, err = ExporterFromEnv(func(string) string { return "" })
+	if he != nil || err != nil {
+		t.Errorf("expected no exporter without an endpoint")
+	}
+}
+
+func TestResourceFromEnv(t *testing.T) {
+	env := map[string]string{
+		"OTEL_RESOURCE_ATTRIBUTES": "deployment.environment=prod",
+	}
+	attrs, err := ResourceFromEnv(func(k string) string { return env[k] }, "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Attribute{
+		String("deployment.environment", "prod"),
+		String("service.name", "d"),
+	}
+	if !reflect.DeepEqual(attrs, expected) {
+		t.Errorf("expected %#v, but got %#v", expected, attrs)
+	}
+}